@@ -28,7 +28,7 @@ func NewService() *Hello {
 
 func (e *Hello) Hello(request hello.URequest, response *hello.URespone) error {
 
-	resp, err := e.helloEndpoint(context.Background(), request)
+	resp, err := e.helloEndpoint(request.Context(), request)
 	if nil != err {
 		return err
 	}
@@ -40,7 +40,7 @@ func (e *Hello) Hello(request hello.URequest, response *hello.URespone) error {
 
 func (e *Hello) HowAreYou(request hello.URequest, response *hello.URespone) error {
 
-	resp, err := e.howAreYouEndpoint(context.Background(), request)
+	resp, err := e.howAreYouEndpoint(request.Context(), request)
 	if nil != err {
 		return err
 	}
@@ -52,7 +52,7 @@ func (e *Hello) HowAreYou(request hello.URequest, response *hello.URespone) erro
 
 func (e *Hello) WhatName(request hello.URequest, response *hello.URespone) (err error) {
 
-	resp, err := e.whatNameEndpoint(context.Background(), request)
+	resp, err := e.whatNameEndpoint(request.Context(), request)
 	if nil != err {
 		return err
 	}
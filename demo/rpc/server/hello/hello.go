@@ -1,6 +1,10 @@
 package hello
 
+import jkmd "github.com/jkprj/jkfr/gokit/transport/metadata"
+
 type URequest struct {
+	jkmd.Carrier // 服务端通过 request.Context() 获取客户端发送的元数据和截止时间
+
 	Name  string `json:"Name,omitempty"`
 	Pause uint64 `json:"Pause,omitempty"`
 }
@@ -0,0 +1,144 @@
+package jkfrtest
+
+import (
+	"net"
+	"sync"
+
+	jkgrpc "github.com/jkprj/jkfr/gokit/transport/grpc"
+	jkresolver "github.com/jkprj/jkfr/gokit/transport/grpc/resolver"
+	grpc_pools "github.com/jkprj/jkfr/gokit/transport/pool/grpc"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// 在内存监听上运行的grpc服务
+type GRPCServer struct {
+	name     string
+	listener *Listener
+	errc     <-chan error
+
+	mt      sync.Mutex
+	clients []*jkgrpc.GRPCClient
+	conns   []*grpc.ClientConn
+
+	closeOnce sync.Once
+}
+
+// 创建并启动grpc服务，服务注册到静态后端后返回，
+// ops 可以指定中间件、grpc.ServerOption等服务选项，服务地址、监听和注册后端会被替换
+func NewGRPCServer(name string, serverEndpoints interface{}, registerServerFunc jkgrpc.RegisterServerFunc, ops ...jkgrpc.ServerOption) (*GRPCServer, error) {
+
+	listener := NewListener()
+	ready := make(chan struct{})
+
+	opts := []jkgrpc.ServerOption{}
+	opts = append(opts, ops...)
+	opts = append(opts,
+		jkgrpc.ServerAddr(listener.addr),
+		jkgrpc.ServerListenerFatory(func(cfg *jkgrpc.ServerConfig) (net.Listener, error) {
+			close(ready)
+			return listener, nil
+		}),
+		jkgrpc.ServerRegOption(regOptions()...),
+	)
+
+	errc, err := startServer(name, listener.addr, ready, func() error {
+		return jkgrpc.RunServer(name, serverEndpoints, registerServerFunc, opts...)
+	})
+	if nil != err {
+		listener.Close()
+		return nil, err
+	}
+
+	return &GRPCServer{name: name, listener: listener, errc: errc}, nil
+}
+
+// 服务的虚拟地址
+func (s *GRPCServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// 创建连接到该服务的客户端，服务关闭时客户端也会关闭，
+// ops 可以指定负载均衡、重试、grpc.DialOption等客户端选项，注册后端和连接方式会被替换
+func (s *GRPCServer) NewClient(clientFatory grpc_pools.ClientFatory, ops ...jkgrpc.ClientOption) (*jkgrpc.GRPCClient, error) {
+
+	opts := []jkgrpc.ClientOption{}
+	opts = append(opts, ops...)
+	opts = append(opts,
+		jkgrpc.ClientRegOption(regOptions()...),
+		jkgrpc.ClientConsulTags(s.listener.addr),
+		jkgrpc.ClientGRPCDialOps(grpc.WithContextDialer(DialContext)),
+	)
+
+	client, err := jkgrpc.NewClient(s.name, clientFatory, opts...)
+	if nil != err {
+		return nil, err
+	}
+
+	s.mt.Lock()
+	s.clients = append(s.clients, client)
+	s.mt.Unlock()
+
+	return client, nil
+}
+
+// 创建客户端并注册为服务名称的默认客户端，之后 jkgrpc.Call(name, ...) 等函数使用该客户端
+func (s *GRPCServer) RegistryClient(clientFatory grpc_pools.ClientFatory, ops ...jkgrpc.ClientOption) error {
+
+	client, err := s.NewClient(clientFatory, ops...)
+	if nil != err {
+		return err
+	}
+
+	jkgrpc.RegistryClient(client)
+
+	return nil
+}
+
+// 通过 jkfr:/// 解析器连接该服务，可以用于protoc生成的客户端(如 pb.NewHelloClient)，
+// 服务关闭时连接也会关闭，ops 可以指定负载均衡配置等连接选项
+func (s *GRPCServer) Dial(ops ...grpc.DialOption) (*grpc.ClientConn, error) {
+
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	opts = append(opts, ops...)
+	opts = append(opts,
+		grpc.WithResolvers(jkresolver.NewBuilder(regOptions()...)),
+		grpc.WithContextDialer(DialContext),
+	)
+
+	conn, err := grpc.Dial(jkresolver.Target(s.name)+"?tags="+s.listener.addr, opts...)
+	if nil != err {
+		return nil, err
+	}
+
+	s.mt.Lock()
+	s.conns = append(s.conns, conn)
+	s.mt.Unlock()
+
+	return conn, nil
+}
+
+// 关闭创建的客户端，关闭监听并等待服务注销
+func (s *GRPCServer) Close() error {
+
+	s.closeOnce.Do(func() {
+		s.mt.Lock()
+		clients := s.clients
+		conns := s.conns
+		s.mt.Unlock()
+
+		for _, client := range clients {
+			client.Close()
+		}
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+
+		s.listener.Close()
+		<-s.errc
+	})
+
+	return nil
+}
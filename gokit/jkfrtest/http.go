@@ -0,0 +1,132 @@
+package jkfrtest
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	jkhttp "github.com/jkprj/jkfr/gokit/transport/http"
+	jkutils "github.com/jkprj/jkfr/gokit/utils"
+
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+// 在内存监听上运行的http服务
+type HttpServer struct {
+	name      string
+	listener  *Listener
+	errc      <-chan error
+	transport *http.Transport
+
+	mt         sync.Mutex
+	clients    []*jkhttp.HttpClient
+	registered bool
+
+	closeOnce sync.Once
+}
+
+// 创建并启动http服务，服务注册到静态后端后返回，
+// ops 可以指定中间件、GetAction等服务选项，服务地址、监听和注册后端会被替换
+func NewHttpServer(name string, handler http.Handler, ops ...jkhttp.ServerOption) (*HttpServer, error) {
+
+	listener := NewListener()
+	ready := make(chan struct{})
+
+	opts := []jkhttp.ServerOption{}
+	opts = append(opts, ops...)
+	opts = append(opts,
+		jkhttp.ServerAddr(listener.addr),
+		jkhttp.ServerListenerFatory(func(cfg *jkhttp.ServerConfig) (net.Listener, error) {
+			close(ready)
+			return listener, nil
+		}),
+		jkhttp.ServerRegOption(regOptions()...),
+	)
+
+	errc, err := startServer(name, listener.addr, ready, func() error {
+		return jkhttp.RunServer(name, handler, opts...)
+	})
+	if nil != err {
+		listener.Close()
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return DialContext(ctx, addr)
+		},
+	}
+
+	return &HttpServer{name: name, listener: listener, errc: errc, transport: transport}, nil
+}
+
+// 服务的虚拟地址
+func (s *HttpServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// 创建连接到该服务的客户端，服务关闭时客户端也会关闭，
+// ops 可以指定负载均衡、重试、请求头等客户端选项，注册后端、协议和连接方式会被替换
+func (s *HttpServer) NewClient(ops ...jkhttp.ClientOption) (*jkhttp.HttpClient, error) {
+
+	opts := []jkhttp.ClientOption{}
+	opts = append(opts, ops...)
+	opts = append(opts,
+		jkhttp.ClientScheme(jkutils.HTTP),
+		jkhttp.ClientRegOption(regOptions()...),
+		jkhttp.ClientConsulTags(s.listener.addr),
+		jkhttp.ClientHttpClientOps(kithttp.SetClient(&http.Client{Transport: s.transport})),
+	)
+
+	client, err := jkhttp.NewClient(s.name, opts...)
+	if nil != err {
+		return nil, err
+	}
+
+	s.mt.Lock()
+	s.clients = append(s.clients, client)
+	s.mt.Unlock()
+
+	return client, nil
+}
+
+// 创建客户端并注册为服务名称的默认客户端，之后 jkhttp.Get(name, ...) 等函数使用该客户端
+func (s *HttpServer) RegistryClient(ops ...jkhttp.ClientOption) error {
+
+	client, err := s.NewClient(ops...)
+	if nil != err {
+		return err
+	}
+
+	jkhttp.RegistryClient(client)
+
+	s.mt.Lock()
+	s.registered = true
+	s.mt.Unlock()
+
+	return nil
+}
+
+// 关闭创建的客户端和空闲连接，关闭监听并等待服务注销
+func (s *HttpServer) Close() error {
+
+	s.closeOnce.Do(func() {
+		s.mt.Lock()
+		clients, registered := s.clients, s.registered
+		s.mt.Unlock()
+
+		if registered {
+			jkhttp.Remove(s.name)
+		}
+		for _, client := range clients {
+			client.Close()
+		}
+
+		s.transport.CloseIdleConnections()
+		s.listener.Close()
+		<-s.errc
+	})
+
+	return nil
+}
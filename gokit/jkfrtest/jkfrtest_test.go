@@ -0,0 +1,130 @@
+package jkfrtest_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	grpchandlers "github.com/jkprj/jkfr/demo/grpc/server/handlers"
+	"github.com/jkprj/jkfr/demo/rpc/server/hello"
+	"github.com/jkprj/jkfr/demo/rpc/server/hello/endpoints"
+	"github.com/jkprj/jkfr/gokit/jkfrtest"
+	jkgrpc "github.com/jkprj/jkfr/gokit/transport/grpc"
+	jkhttp "github.com/jkprj/jkfr/gokit/transport/http"
+	jkrpc "github.com/jkprj/jkfr/gokit/transport/rpc"
+	pb "github.com/jkprj/jkfr/protobuf/demo"
+	helloSvc "github.com/jkprj/jkfr/protobuf/demo/hello-service/svc"
+	hellogrpc "github.com/jkprj/jkfr/protobuf/demo/hello-service/svc/client/grpc"
+	helloServer "github.com/jkprj/jkfr/protobuf/demo/hello-service/svc/server"
+
+	"google.golang.org/grpc"
+)
+
+func TestRPCServer(t *testing.T) {
+
+	server, err := jkfrtest.NewRPCServer("jkfrtest_rpc", endpoints.NewService())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client, err := server.NewClient()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	resp := &hello.URespone{}
+	if err = client.Call("Hello.Hello", &hello.URequest{Name: "jk", Pause: 1}, resp); nil != err || 1 != resp.Pause {
+		t.Fatalf("resp: %v, err: %v", resp, err)
+	}
+
+	if err = server.RegistryClient(); nil != err {
+		t.Fatal(err)
+	}
+
+	resp = &hello.URespone{}
+	if err = jkrpc.Call("jkfrtest_rpc", "Hello.HowAreYou", &hello.URequest{Pause: 2}, resp); nil != err || 2 != resp.Pause {
+		t.Fatalf("resp: %v, err: %v", resp, err)
+	}
+}
+
+func TestGRPCServer(t *testing.T) {
+
+	eps := helloServer.NewEndpoints(grpchandlers.NewService())
+
+	server, err := jkfrtest.NewGRPCServer("jkfrtest_grpc", &eps, func(grpcServer *grpc.Server, serverEndpoints interface{}) {
+		pb.RegisterHelloServer(grpcServer, serverEndpoints.(*helloSvc.Endpoints))
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	clientFatory := func(conn *grpc.ClientConn) (interface{}, error) { return hellogrpc.New(conn) }
+	if err = server.RegistryClient(clientFatory); nil != err {
+		t.Fatal(err)
+	}
+
+	rsp, err := jkgrpc.Call("jkfrtest_grpc", "SayHello", &pb.HelloRequest{Name: "jk"})
+	if nil != err || "" == rsp.(*pb.HelloReply).Message {
+		t.Fatalf("rsp: %v, err: %v", rsp, err)
+	}
+}
+
+func TestGRPCDial(t *testing.T) {
+
+	eps := helloServer.NewEndpoints(grpchandlers.NewService())
+
+	server, err := jkfrtest.NewGRPCServer("jkfrtest_grpc_dial", &eps, func(grpcServer *grpc.Server, serverEndpoints interface{}) {
+		pb.RegisterHelloServer(grpcServer, serverEndpoints.(*helloSvc.Endpoints))
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn, err := server.Dial()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	rsp, err := pb.NewHelloClient(conn).SayHello(context.Background(), &pb.HelloRequest{Name: "jk"}, grpc.WaitForReady(true))
+	if nil != err || "" == rsp.Message {
+		t.Fatalf("rsp: %v, err: %v", rsp, err)
+	}
+}
+
+func TestHttpServer(t *testing.T) {
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(append([]byte(r.URL.Path+":"), body...))
+	})
+
+	server, err := jkfrtest.NewHttpServer("jkfrtest_http", handler)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	if err = server.RegistryClient(); nil != err {
+		t.Fatal(err)
+	}
+
+	data, err := jkhttp.Post("jkfrtest_http", "/echo", []byte("jk"))
+	if nil != err || "/echo:jk" != string(data) {
+		t.Fatalf("data: %s, err: %v", data, err)
+	}
+}
+
+func TestDialClosedListener(t *testing.T) {
+
+	l := jkfrtest.NewListener()
+	addr := l.Addr().String()
+	l.Close()
+
+	if _, err := jkfrtest.Dial(addr); nil == err {
+		t.Fatal("dial closed listener should fail")
+	}
+}
@@ -0,0 +1,145 @@
+// Package jkfrtest 进程内的测试工具：在内存监听上运行 rpc、grpc、http 服务，
+// 并创建连接到该服务的客户端，不需要consul和真实的网络端口。
+//
+// 服务以虚拟地址注册到静态后端(registry.BACKEND_STATIC)，客户端按该地址的tag发现服务，
+// 请求经过客户端真实的中间件、负载均衡、重试和连接池，只有建立连接时改为连接内存监听。
+//
+//	server, err := jkfrtest.NewRPCServer("hello", endpoints.NewService())
+//	defer server.Close()
+//
+//	server.RegistryClient()                   // jkrpc.Call("hello", ...) 使用内存连接
+//	client, err := server.NewClient()         // 或者直接使用客户端
+package jkfrtest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jkregistry "github.com/jkprj/jkfr/gokit/registry"
+
+	"google.golang.org/grpc/test/bufconn"
+)
+
+const bufSize = 1024 * 1024
+
+var ErrNoListener = errors.New("jkfrtest: no listener on address")
+var ErrRegisterTimeout = errors.New("jkfrtest: wait server register timeout")
+
+var listeners map[string]*Listener = map[string]*Listener{} // 虚拟地址 -> 内存监听
+var mtListener sync.RWMutex
+var lastPort uint32 = 0
+
+// 内存监听，每个监听分配一个唯一的虚拟地址(127.0.0.1:序号)，只能通过 Dial 连接
+type Listener struct {
+	*bufconn.Listener
+	addr string
+}
+
+type listenerAddr string
+
+func (addr listenerAddr) Network() string { return "jkfrtest" }
+func (addr listenerAddr) String() string  { return string(addr) }
+
+func NewListener() *Listener {
+
+	port := atomic.AddUint32(&lastPort, 1)
+
+	l := &Listener{
+		Listener: bufconn.Listen(bufSize),
+		addr:     "127.0.0.1:" + strconv.Itoa(int(port)),
+	}
+
+	mtListener.Lock()
+	listeners[l.addr] = l
+	mtListener.Unlock()
+
+	return l
+}
+
+// 虚拟地址
+func (l *Listener) Addr() net.Addr {
+	return listenerAddr(l.addr)
+}
+
+func (l *Listener) Close() error {
+
+	mtListener.Lock()
+	delete(listeners, l.addr)
+	mtListener.Unlock()
+
+	return l.Listener.Close()
+}
+
+// 连接虚拟地址对应的内存监听
+func Dial(addr string) (net.Conn, error) {
+	return DialContext(context.Background(), addr)
+}
+
+func DialContext(ctx context.Context, addr string) (net.Conn, error) {
+
+	mtListener.RLock()
+	l, ok := listeners[addr]
+	mtListener.RUnlock()
+
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: "jkfrtest", Addr: listenerAddr(addr), Err: ErrNoListener}
+	}
+
+	return l.DialContext(ctx)
+}
+
+// 服务注册和客户端发现都使用进程内的静态后端，不启动健康检查、管理和prometheus服务
+func regOptions() []jkregistry.RegOption {
+	return []jkregistry.RegOption{
+		jkregistry.WithBackend(jkregistry.BACKEND_STATIC),
+		jkregistry.WithTTLCheck(0, nil),
+		jkregistry.WithHTTPHealthCheck(false),
+		jkregistry.WithAdminAddr(""),
+		jkregistry.WithPrometheusAddr(""),
+	}
+}
+
+// 服务在后台注册，等待注册信息可以被发现，之后创建的客户端可以立即获取到服务实例
+func waitRegistered(name, addr string) error {
+
+	timeout := time.After(5 * time.Second)
+	for {
+		entries, _, err := jkregistry.Services(name, regOptions()...)
+		if nil != err {
+			return err
+		}
+
+		for _, entry := range entries {
+			if addr == entry.Service.Address+":"+strconv.Itoa(entry.Service.Port) {
+				return nil
+			}
+		}
+
+		select {
+		case <-timeout:
+			return ErrRegisterTimeout
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+// 在协程中运行阻塞的 RunServer，等到服务创建监听并注册后返回，
+// 返回的chan在 RunServer 结束时收到其返回值
+func startServer(name, addr string, ready <-chan struct{}, run func() error) (<-chan error, error) {
+
+	errc := make(chan error, 1)
+	go func() { errc <- run() }()
+
+	select {
+	case <-ready:
+	case err := <-errc:
+		return nil, err
+	}
+
+	return errc, waitRegistered(name, addr)
+}
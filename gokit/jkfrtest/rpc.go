@@ -0,0 +1,152 @@
+package jkfrtest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	jkpool "github.com/jkprj/jkfr/gokit/transport/pool"
+	rpcpool "github.com/jkprj/jkfr/gokit/transport/pool/rpc"
+	jkrpc "github.com/jkprj/jkfr/gokit/transport/rpc"
+)
+
+// 在内存监听上运行的rpc服务
+type RPCServer struct {
+	*jkrpc.RPCServer
+
+	name     string
+	listener *Listener
+
+	mt         sync.Mutex
+	clients    []*jkrpc.RPCClient
+	registered bool
+
+	closeOnce sync.Once
+}
+
+// 创建并启动rpc服务，服务使用tcp方式(RunServerWithTcp)处理连接，注册到静态后端，
+// ops 可以指定编解码、中间件等服务选项，服务地址、监听和注册后端会被替换
+func NewRPCServer(name string, service interface{}, ops ...jkrpc.ServerOption) (*RPCServer, error) {
+
+	listener := NewListener()
+
+	opts := []jkrpc.ServerOption{}
+	opts = append(opts, ops...)
+	opts = append(opts,
+		jkrpc.ServerAddr(listener.addr),
+		jkrpc.ServerListenerFatory(func(cfg *jkrpc.ServerConfig) (net.Listener, error) { return listener, nil }),
+		jkrpc.ServerRun(jkrpc.RunServerWithTcp),
+		jkrpc.ServerRegOption(regOptions()...),
+		jkrpc.ServerShutdownWait(0),
+	)
+
+	server, err := jkrpc.NewRPCServer(name, service, opts...)
+	if nil != err {
+		listener.Close()
+		return nil, err
+	}
+
+	go server.Serve()
+
+	if err = waitRegistered(name, listener.addr); nil != err {
+		server.Shutdown(context.Background())
+		return nil, err
+	}
+
+	return &RPCServer{RPCServer: server, name: name, listener: listener}, nil
+}
+
+// 创建连接到该服务的客户端，服务关闭时客户端也会关闭，
+// ops 可以指定编解码(需要与服务端一致)、负载均衡、重试等客户端选项，注册后端和连接方式会被替换
+func (s *RPCServer) NewClient(ops ...jkrpc.ClientOption) (*jkrpc.RPCClient, error) {
+
+	client, err := s.newClient(ops...)
+	if nil != err {
+		return nil, err
+	}
+
+	s.mt.Lock()
+	s.clients = append(s.clients, client)
+	s.mt.Unlock()
+
+	return client, nil
+}
+
+// 创建客户端并注册为服务名称的默认客户端，之后 jkrpc.Call(name, ...) 等函数使用该客户端，
+// 注册的客户端由 jkrpc 管理，再次注册或服务关闭时关闭
+func (s *RPCServer) RegistryClient(ops ...jkrpc.ClientOption) error {
+
+	client, err := s.newClient(ops...)
+	if nil != err {
+		return err
+	}
+
+	jkrpc.RegistryClient(client)
+
+	s.mt.Lock()
+	s.registered = true
+	s.mt.Unlock()
+
+	return nil
+}
+
+func (s *RPCServer) newClient(ops ...jkrpc.ClientOption) (*jkrpc.RPCClient, error) {
+
+	opts := []jkrpc.ClientOption{}
+	opts = append(opts, ops...)
+	opts = append(opts,
+		jkrpc.ClientRegOption(regOptions()...),
+		jkrpc.ClientConsulTags(s.listener.addr),
+		jkrpc.ClientCreateFatory(rpcClientFatory),
+	)
+
+	return jkrpc.NewClient(s.name, opts...)
+}
+
+// 关闭创建的客户端，注销并关闭服务
+func (s *RPCServer) Close() (err error) {
+
+	s.closeOnce.Do(func() {
+		s.mt.Lock()
+		clients, registered := s.clients, s.registered
+		s.mt.Unlock()
+
+		if registered {
+			jkrpc.Close(s.name)
+		}
+		for _, client := range clients {
+			client.Close()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err = s.Shutdown(ctx)
+		s.listener.Close()
+	})
+
+	return err
+}
+
+// 连接内存监听的rpc客户端
+func rpcClientFatory(cfg *jkrpc.ClientConfig) jkpool.ClientFatory {
+	return func(o *jkpool.Options) (jkpool.PoolClient, net.Conn, error) {
+
+		ctx := context.Background()
+		if o.DialTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, o.DialTimeout)
+			defer cancel()
+		}
+
+		conn, err := DialContext(ctx, o.ServerAddr)
+		if nil != err {
+			return nil, nil, err
+		}
+
+		cli, err := rpcpool.DefaultNewRpcClient(conn, o)
+
+		return cli, conn, err
+	}
+}
@@ -0,0 +1,185 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	jklog "github.com/jkprj/jkfr/log"
+
+	"github.com/go-kit/kit/endpoint"
+	kithttp "github.com/go-kit/kit/transport/http"
+	"github.com/gorilla/mux"
+)
+
+var adminSvrOnce sync.Once
+
+// 进程内注册的服务，管理接口按服务ID查找
+var mtRegistrars sync.RWMutex
+var registrars map[string]*Registrar = map[string]*Registrar{}
+
+func addRegistrar(r *Registrar) {
+	mtRegistrars.Lock()
+	defer mtRegistrars.Unlock()
+
+	registrars[r.getRegistration().ID] = r
+}
+
+func removeRegistrar(r *Registrar) {
+	mtRegistrars.Lock()
+	defer mtRegistrars.Unlock()
+
+	id := r.getRegistration().ID
+	if registrars[id] == r {
+		delete(registrars, id)
+	}
+}
+
+// 管理接口返回的服务实例状态
+type AdminInstance struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Addr        string            `json:"addr"`
+	Tags        []string          `json:"tags"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	Draining    bool              `json:"draining"`
+	Maintenance bool              `json:"maintenance"`
+}
+
+type adminRequest struct {
+	id     string // 服务ID，为空时作用于进程内所有注册的服务
+	reason string // 摘流原因
+}
+
+// 管理接口的错误，带http状态码
+type adminError struct {
+	code int
+	msg  string
+}
+
+func (e adminError) Error() string {
+	return e.msg
+}
+
+func (e adminError) StatusCode() int {
+	return e.code
+}
+
+// 管理接口http处理器，绑定了http服务的服务可以挂载到自己的路由上，管理接口没有鉴权，不要对外暴露
+// GET    /admin/instances                 进程内注册的服务实例状态
+// PUT    /admin/drain?id=xxx&reason=xxx   摘流，id为空时摘流进程内所有注册的服务
+// DELETE /admin/drain?id=xxx              恢复摘流的服务
+func AdminHandler() http.Handler {
+
+	router := mux.NewRouter()
+
+	router.Methods("Get").Path("/admin/instances").Handler(kithttp.NewServer(
+		makeAdminEndpoint(nil), decodeAdminRequest, encodeAdminResponse,
+	))
+	router.Methods("Put", "Post").Path("/admin/drain").Handler(kithttp.NewServer(
+		makeAdminEndpoint(func(r *Registrar, reason string) error { return r.Drain(reason) }),
+		decodeAdminRequest, encodeAdminResponse,
+	))
+	router.Methods("Delete").Path("/admin/drain").Handler(kithttp.NewServer(
+		makeAdminEndpoint(func(r *Registrar, reason string) error { return r.Undrain() }),
+		decodeAdminRequest, encodeAdminResponse,
+	))
+
+	return router
+}
+
+// 启动管理接口http服务，该服务只会启动一次，启动失败时只记录日志，不影响服务注册
+func runAdminServer(regCfg *RegConfig) {
+
+	adminSvrOnce.Do(func() {
+
+		httpSvr := &http.Server{Addr: regCfg.AdminAddr, Handler: AdminHandler()}
+
+		go func() {
+			jklog.Infow("admin server start", "addr", regCfg.AdminAddr)
+
+			if err := httpSvr.ListenAndServe(); nil != err {
+				jklog.Errorw("admin server ListenAndServe fail", "addr", regCfg.AdminAddr, "err", err)
+			}
+		}()
+	})
+}
+
+// 构造管理接口endpoint，action为nil时只查询状态，返回操作后的服务实例状态
+func makeAdminEndpoint(action func(r *Registrar, reason string) error) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+
+		req := request.(adminRequest)
+
+		regs, err := findRegistrars(req.id)
+		if nil != err {
+			return nil, err
+		}
+
+		instances := make([]AdminInstance, 0, len(regs))
+		for _, r := range regs {
+			if nil != action {
+				if err = action(r, req.reason); nil != err {
+					jklog.Errorw("admin action fail", "id", r.getRegistration().ID, "err", err)
+					return nil, adminError{code: http.StatusInternalServerError, msg: err.Error()}
+				}
+			}
+
+			instances = append(instances, r.adminInstance())
+		}
+
+		return instances, nil
+	}
+}
+
+func findRegistrars(id string) ([]*Registrar, error) {
+	mtRegistrars.RLock()
+	defer mtRegistrars.RUnlock()
+
+	if "" != id {
+		r, ok := registrars[id]
+		if !ok {
+			return nil, adminError{code: http.StatusNotFound, msg: "service not registered: " + id}
+		}
+		return []*Registrar{r}, nil
+	}
+
+	regs := make([]*Registrar, 0, len(registrars))
+	for _, r := range registrars {
+		regs = append(regs, r)
+	}
+
+	sort.Slice(regs, func(i, j int) bool {
+		return regs[i].getRegistration().ID < regs[j].getRegistration().ID
+	})
+
+	return regs, nil
+}
+
+func (p *Registrar) adminInstance() AdminInstance {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	return AdminInstance{
+		ID:          p.registration.ID,
+		Name:        p.registration.Name,
+		Addr:        p.registration.Address + ":" + strconv.Itoa(p.registration.Port),
+		Tags:        p.registration.Tags,
+		Meta:        p.registration.Meta,
+		Draining:    "" != p.registration.Meta[META_DRAIN],
+		Maintenance: p.maintenance,
+	}
+}
+
+func decodeAdminRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	query := r.URL.Query()
+	return adminRequest{id: query.Get("id"), reason: query.Get("reason")}, nil
+}
+
+func encodeAdminResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	return json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,165 @@
+package registry
+
+import (
+	"errors"
+	"sync"
+
+	jklog "github.com/jkprj/jkfr/log"
+
+	"github.com/go-kit/kit/sd"
+	kitcosul "github.com/go-kit/kit/sd/consul"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	BACKEND_CONSUL = "consul"
+	BACKEND_STATIC = "static"
+)
+
+// 服务注册/发现后端，包含注册、注销、查询服务列表和监听服务变化
+type Backend interface {
+	kitcosul.Client
+
+	// 创建服务实例监听器，服务实例发生变化时通知订阅者
+	NewInstancer(service string, tags []string, passingOnly bool) sd.Instancer
+}
+
+// 支持TTL健康检查的后端，用于上报心跳
+type TTLUpdater interface {
+	// status 为 passing，warning，critical
+	UpdateTTL(checkID, output, status string) error
+}
+
+// 支持检查服务是否已注册的后端，用于发现注册信息丢失后重新注册
+type RegistrationChecker interface {
+	IsRegistered(serviceID string) (bool, error)
+}
+
+// 支持维护模式的后端，维护模式中的服务健康状态为critical
+type MaintenanceSetter interface {
+	EnableServiceMaintenance(serviceID, reason string) error
+	DisableServiceMaintenance(serviceID string) error
+}
+
+// 根据配置创建注册/发现后端
+type BackendFatory func(regCfg *RegConfig) (Backend, error)
+
+var mtBackend sync.RWMutex
+var name2BackendFatory map[string]BackendFatory = map[string]BackendFatory{
+	BACKEND_CONSUL: consulBackendFatory,
+	BACKEND_STATIC: staticBackendFatory,
+}
+
+// 注册后端实现，同名后端会被替换
+func RegisterBackend(name string, fatory BackendFatory) {
+	if "" == name || nil == fatory {
+		return
+	}
+
+	mtBackend.Lock()
+	defer mtBackend.Unlock()
+
+	name2BackendFatory[name] = fatory
+}
+
+func getBackendFatory(name string) BackendFatory {
+	mtBackend.RLock()
+	defer mtBackend.RUnlock()
+
+	return name2BackendFatory[name]
+}
+
+// 创建注册/发现后端对象
+// Parameters :
+// name 服务名称
+// ops  服务注册选项，通过 WithBackend 选择后端，默认为consul
+func NewBackend(name string, ops ...RegOption) (backend Backend, err error) {
+	backend, _, err = newBackend(name, ops...)
+	if nil != err {
+		return nil, err
+	}
+
+	return backend, nil
+}
+
+func newBackend(name string, ops ...RegOption) (backend Backend, regCfg *RegConfig, err error) {
+
+	regCfg = getConfig(name, ops...)
+
+	fatory := getBackendFatory(regCfg.Backend)
+	if nil == fatory {
+		jklog.Errorw("registry backend not found", "name", name, "backend", regCfg.Backend)
+		return nil, nil, errors.New("registry backend not found:" + regCfg.Backend)
+	}
+
+	backend, err = fatory(regCfg)
+	if nil != err {
+		jklog.Errorw("create registry backend fail", "name", name, "backend", regCfg.Backend, "err", err)
+		return nil, nil, err
+	}
+
+	return backend, regCfg, nil
+}
+
+// consul后端
+type consulBackend struct {
+	kitcosul.Client
+	api         *consulapi.Client
+	snapshotDir string
+	filter      string           // consul过滤表达式
+	predicates  []InstanceFilter // 本地过滤函数
+
+	datacenter          string   // 服务发现的数据中心，为空时为consul agent所在数据中心
+	failoverDatacenters []string // 故障转移的远程数据中心，按顺序
+	failoverThreshold   int      // 健康的服务实例少于该值时故障转移
+}
+
+func consulBackendFatory(regCfg *RegConfig) (Backend, error) {
+	consulApiClient, err := getConsulApiClient(regCfg)
+	if nil != err {
+		return nil, err
+	}
+
+	return &consulBackend{Client: kitcosul.NewClient(consulApiClient), api: consulApiClient,
+		snapshotDir: regCfg.SnapshotDir, filter: regCfg.Filter, predicates: regCfg.filters,
+		datacenter: regCfg.Datacenter, failoverDatacenters: regCfg.FailoverDatacenters, failoverThreshold: regCfg.FailoverThreshold}, nil
+}
+
+func (cb *consulBackend) UpdateTTL(checkID, output, status string) error {
+	return cb.api.Agent().UpdateTTLOpts(checkID, output, status, nil)
+}
+
+// 通过consul agent的服务列表检查是否还有注册信息
+func (cb *consulBackend) IsRegistered(serviceID string) (bool, error) {
+	services, err := cb.api.Agent().Services()
+	if nil != err {
+		return false, err
+	}
+
+	_, ok := services[serviceID]
+	return ok, nil
+}
+
+func (cb *consulBackend) EnableServiceMaintenance(serviceID, reason string) error {
+	return cb.api.Agent().EnableServiceMaintenance(serviceID, reason)
+}
+
+func (cb *consulBackend) DisableServiceMaintenance(serviceID string) error {
+	return cb.api.Agent().DisableServiceMaintenance(serviceID)
+}
+
+func (cb *consulBackend) NewInstancer(service string, tags []string, passingOnly bool) sd.Instancer {
+	filter := newEntryFilter(tags, cb.filter, cb.predicates)
+
+	if 0 == len(cb.failoverDatacenters) {
+		return newConsulInstancer(cb.Client, service, filter, passingOnly, cb.datacenter, snapshotFile(cb.snapshotDir, service, cb.datacenter, filter, passingOnly))
+	}
+
+	children := make([]*consulInstancer, 0, len(cb.failoverDatacenters)+1)
+	for _, datacenter := range append([]string{cb.datacenter}, cb.failoverDatacenters...) {
+		snapshot := snapshotFile(cb.snapshotDir, service, datacenter, filter, passingOnly)
+		children = append(children, newConsulInstancer(cb.Client, service, filter, passingOnly, datacenter, snapshot))
+	}
+
+	return newFailoverInstancer(service, cb.failoverThreshold, children)
+}
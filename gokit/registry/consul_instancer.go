@@ -0,0 +1,325 @@
+package registry
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jksd "github.com/jkprj/jkfr/gokit/sd"
+	jklog "github.com/jkprj/jkfr/log"
+
+	"github.com/go-kit/kit/sd"
+	kitcosul "github.com/go-kit/kit/sd/consul"
+	"github.com/go-kit/kit/util/conn"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+var errInstancerStopped = errors.New("quit and closed consul instancer")
+
+// consul服务实例监听器，与 kitconsul.Instancer 一样通过阻塞查询监听服务变化，
+// 另外保存服务实例注册时的权重和元数据(实现 jksd.MetaInstancer)；
+// 指定了快照文件时保存最后一次获取的服务实例，启动时consul不可用则使用快照(实现 jksd.StaleInstancer)
+type consulInstancer struct {
+	client      kitcosul.Client
+	service     string
+	filter      entryFilter
+	passingOnly bool
+	datacenter  string // 数据中心，为空时为consul agent所在数据中心
+	snapshot    string // 快照文件，为空时不保存快照
+	stale       int32  // 为1时服务实例来自快照
+
+	mt          sync.RWMutex
+	state       sd.Event // 当前的服务实例，出错时保持出错前的服务实例，从未成功获取时为出错事件
+	last        sd.Event // 最后一次通知的事件，用于去重
+	metas       map[string]jksd.InstanceMeta
+	subscribers map[chan<- sd.Event]struct{}
+
+	// 按顺序通知订阅者，发送事件时不持有mt，订阅者处理事件时可以调用 InstanceMeta
+	mtPublish sync.Mutex
+
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+func newConsulInstancer(client kitcosul.Client, service string, filter entryFilter, passingOnly bool, datacenter, snapshot string) *consulInstancer {
+
+	ci := &consulInstancer{
+		client:      client,
+		service:     service,
+		filter:      filter,
+		passingOnly: passingOnly,
+		datacenter:  datacenter,
+		snapshot:    snapshot,
+		metas:       map[string]jksd.InstanceMeta{},
+		subscribers: map[chan<- sd.Event]struct{}{},
+		quit:        make(chan struct{}),
+	}
+
+	entries, index, err := ci.getEntries(0)
+	if nil != err {
+		jklog.Errorw("get consul service entries fail", "service", service, "datacenter", datacenter, "tags", filter.tags, "filter", filter.expr, "err", err)
+	} else {
+		jklog.Infow("get consul service entries", "service", service, "datacenter", datacenter, "tags", filter.tags, "filter", filter.expr, "instances", len(entries))
+	}
+
+	if nil == err || !ci.loadSnapshot() {
+		ci.update(entries, err)
+	}
+	go ci.loop(index)
+
+	return ci
+}
+
+func (ci *consulInstancer) loop(lastIndex uint64) {
+
+	d := 10 * time.Millisecond
+
+	for {
+		entries, index, err := ci.getEntries(lastIndex)
+
+		switch {
+		case errInstancerStopped == err:
+			return
+		case nil != err:
+			jklog.Errorw("get consul service entries fail", "service", ci.service, "err", err)
+			time.Sleep(d)
+			d = conn.Exponential(d)
+			ci.update(nil, err)
+		case 0 == index:
+			jklog.Errorw("consul index is not sane", "service", ci.service)
+			time.Sleep(d)
+			d = conn.Exponential(d)
+		case index < lastIndex:
+			jklog.Errorw("consul index is less than previous, resetting to default", "service", ci.service)
+			lastIndex = 0
+			time.Sleep(d)
+			d = conn.Exponential(d)
+		default:
+			lastIndex = index
+			ci.update(entries, nil)
+			d = 10 * time.Millisecond
+		}
+	}
+}
+
+func (ci *consulInstancer) getEntries(lastIndex uint64) ([]*consulapi.ServiceEntry, uint64, error) {
+
+	type response struct {
+		entries []*consulapi.ServiceEntry
+		index   uint64
+		err     error
+	}
+
+	resc := make(chan response, 1)
+
+	go func() {
+		queryOpts := ci.filter.queryOptions(&consulapi.QueryOptions{WaitIndex: lastIndex, Datacenter: ci.datacenter})
+		entries, meta, err := ci.client.Service(ci.service, ci.filter.queryTag(), ci.passingOnly, queryOpts)
+		if nil != err {
+			resc <- response{err: err}
+			return
+		}
+
+		resc <- response{entries: ci.filter.filter(entries), index: meta.LastIndex}
+	}()
+
+	select {
+	case res := <-resc:
+		return res.entries, res.index, res.err
+	case <-ci.quit:
+		return nil, 0, errInstancerStopped
+	}
+}
+
+// consul不可用时使用快照中的服务实例，直到从consul获取到服务实例
+func (ci *consulInstancer) loadSnapshot() bool {
+
+	if "" == ci.snapshot {
+		return false
+	}
+
+	snap, err := loadSnapshot(ci.snapshot)
+	if nil != err {
+		jklog.Warnw("load discovery snapshot fail", "service", ci.service, "file", ci.snapshot, "err", err)
+		return false
+	}
+
+	// 快照保存时的过滤条件可能与现在不同，按现在的过滤条件重新过滤
+	event, metas := makeEvent(ci.filter.filter(snap.Entries))
+
+	jklog.Warnw("consul unavailable, use discovery snapshot", "service", ci.service, "file", ci.snapshot, "time", snap.Time, "instances", event.Instances)
+
+	ci.publish(event, metas, true)
+
+	return true
+}
+
+// 保存快照，没有服务实例时不保存，避免覆盖之前可用的快照
+func (ci *consulInstancer) saveSnapshot(entries []*consulapi.ServiceEntry) {
+
+	if "" == ci.snapshot || 0 == len(entries) {
+		return
+	}
+
+	snap := discoverySnapshot{Service: ci.service, Tags: ci.filter.tags, Filter: ci.filter.expr, Time: time.Now(), Entries: entries}
+	if err := saveSnapshot(ci.snapshot, snap); nil != err {
+		jklog.Errorw("save discovery snapshot fail", "service", ci.service, "file", ci.snapshot, "err", err)
+	}
+}
+
+// Stale 服务实例是否来自快照
+func (ci *consulInstancer) Stale() bool {
+	return 1 == atomic.LoadInt32(&ci.stale)
+}
+
+// 更新服务实例和元数据，有变化时通知订阅者，元数据先于实例更新
+func (ci *consulInstancer) update(entries []*consulapi.ServiceEntry, err error) {
+
+	if nil != err {
+		ci.mt.RLock()
+		metas := ci.metas
+		ci.mt.RUnlock()
+
+		ci.publish(sd.Event{Err: err}, metas, false)
+		return
+	}
+
+	event, metas := makeEvent(entries)
+	if ci.publish(event, metas, false) {
+		ci.saveSnapshot(entries)
+	}
+}
+
+func makeEvent(entries []*consulapi.ServiceEntry) (sd.Event, map[string]jksd.InstanceMeta) {
+
+	event := sd.Event{Instances: make([]string, 0, len(entries))}
+	metas := make(map[string]jksd.InstanceMeta, len(entries))
+
+	for _, entry := range entries {
+		instance, meta := makeInstanceMeta(entry)
+		event.Instances = append(event.Instances, instance)
+		metas[instance] = meta
+	}
+
+	return event, metas
+}
+
+// 通知订阅者，出错时通知错误但保持之前的服务实例，之后订阅的订阅者和 current 仍然得到出错前的服务实例，返回是否有变化
+func (ci *consulInstancer) publish(event sd.Event, metas map[string]jksd.InstanceMeta, stale bool) bool {
+	ci.mtPublish.Lock()
+	defer ci.mtPublish.Unlock()
+
+	ci.mt.Lock()
+
+	// 快照状态变化时即使服务实例相同也通知订阅者
+	staleChanged := false
+	if nil == event.Err {
+		var v int32
+		if stale {
+			v = 1
+		}
+		staleChanged = atomic.SwapInt32(&ci.stale, v) != v
+	}
+
+	if !staleChanged && reflect.DeepEqual(ci.last, event) && reflect.DeepEqual(ci.metas, metas) {
+		ci.mt.Unlock()
+		return false
+	}
+
+	ci.last = event
+	if nil == event.Err || nil == ci.state.Instances {
+		ci.state = event
+	}
+	ci.metas = metas
+	subscribers := ci.subscriberList()
+	ci.mt.Unlock()
+
+	for _, ch := range subscribers {
+		ch <- event
+	}
+
+	return true
+}
+
+func (ci *consulInstancer) subscriberList() []chan<- sd.Event {
+	subscribers := make([]chan<- sd.Event, 0, len(ci.subscribers))
+	for ch := range ci.subscribers {
+		subscribers = append(subscribers, ch)
+	}
+	return subscribers
+}
+
+// 服务实例地址和元数据，健康检查为warning时使用Warning权重
+func makeInstanceMeta(entry *consulapi.ServiceEntry) (string, jksd.InstanceMeta) {
+
+	addr := entry.Node.Address
+	if "" != entry.Service.Address {
+		addr = entry.Service.Address
+	}
+
+	meta := jksd.InstanceMeta{
+		ID:         entry.Service.ID,
+		Tags:       entry.Service.Tags,
+		Meta:       entry.Service.Meta,
+		Health:     entry.Checks.AggregatedStatus(),
+		Weight:     entry.Service.Weights.Passing,
+		Datacenter: entry.Node.Datacenter,
+	}
+
+	if consulapi.HealthWarning == meta.Health {
+		meta.Weight = entry.Service.Weights.Warning
+	}
+
+	return addr + ":" + strconv.Itoa(entry.Service.Port), meta
+}
+
+// 当前的服务实例，从未成功获取时为出错事件，故障转移时跳过该数据中心
+func (ci *consulInstancer) current() sd.Event {
+	ci.mt.RLock()
+	defer ci.mt.RUnlock()
+
+	return ci.state
+}
+
+// InstanceMeta 获取服务实例注册时的权重和元数据
+func (ci *consulInstancer) InstanceMeta(instance string) (jksd.InstanceMeta, bool) {
+	ci.mt.RLock()
+	defer ci.mt.RUnlock()
+
+	meta, ok := ci.metas[instance]
+	return meta, ok
+}
+
+// Register 订阅服务变化，订阅时会先推送当前服务实例
+func (ci *consulInstancer) Register(ch chan<- sd.Event) {
+	ci.mtPublish.Lock()
+	defer ci.mtPublish.Unlock()
+
+	ci.mt.Lock()
+	ci.subscribers[ch] = struct{}{}
+	state := ci.state
+	ci.mt.Unlock()
+
+	ch <- state
+}
+
+// Deregister 取消订阅，等待正在进行的通知完成，返回后不会再向ch发送事件
+func (ci *consulInstancer) Deregister(ch chan<- sd.Event) {
+	ci.mtPublish.Lock()
+	defer ci.mtPublish.Unlock()
+
+	ci.mt.Lock()
+	defer ci.mt.Unlock()
+
+	delete(ci.subscribers, ch)
+}
+
+// Stop 停止监听服务变化
+func (ci *consulInstancer) Stop() {
+	ci.quitOnce.Do(func() {
+		close(ci.quit)
+	})
+}
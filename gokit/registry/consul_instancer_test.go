@@ -0,0 +1,107 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	jksd "github.com/jkprj/jkfr/gokit/sd"
+
+	"github.com/go-kit/kit/endpoint"
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/sd"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func newTestInstancer() *consulInstancer {
+	return &consulInstancer{
+		service:     "hello",
+		metas:       map[string]jksd.InstanceMeta{},
+		subscribers: map[chan<- sd.Event]struct{}{},
+		quit:        make(chan struct{}),
+	}
+}
+
+func testEvent(n int) (sd.Event, map[string]jksd.InstanceMeta) {
+	event := sd.Event{Instances: []string{}}
+	metas := map[string]jksd.InstanceMeta{}
+	for i := 0; i < n; i++ {
+		instance := fmt.Sprintf("127.0.0.1:%d", 8080+i)
+		event.Instances = append(event.Instances, instance)
+		metas[instance] = jksd.InstanceMeta{ID: instance, Health: consulapi.HealthPassing, Weight: 1}
+	}
+	return event, metas
+}
+
+// 订阅者处理事件时会调用 InstanceMeta，连续通知不能和订阅者互相等待锁
+func TestPublishWithMetaSubscriber(t *testing.T) {
+
+	ci := newTestInstancer()
+
+	factory := func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		return func(context.Context, interface{}) (interface{}, error) { return nil, nil }, nil, nil
+	}
+	endpointer := jksd.NewEndpointer(ci, factory, kitlog.NewNopLogger())
+
+	w := &Watcher{Instancer: ci, service: "hello", events: make(chan sd.Event), ch: make(chan WatchEvent, 16), done: make(chan struct{})}
+	go w.loop()
+	ci.Register(w.events)
+	go func() {
+		for range w.Events() {
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 50; i++ {
+			event, metas := testEvent(i%5 + 1)
+			ci.publish(event, metas, false)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish deadlock")
+	}
+
+	endpointer.Close()
+	w.Stop()
+}
+
+// 出错时通知错误，但之后订阅的订阅者和 current 仍然得到出错前的服务实例
+func TestPublishErrorKeepsState(t *testing.T) {
+
+	ci := newTestInstancer()
+
+	ci.publish(sd.Event{Err: errors.New("consul unavailable")}, ci.metas, false)
+	if nil == ci.current().Err {
+		t.Fatal("never succeeded, current should be error")
+	}
+
+	event, metas := testEvent(2)
+	ci.publish(event, metas, false)
+
+	ch := make(chan sd.Event, 2)
+	ci.Register(ch)
+	<-ch
+
+	ci.publish(sd.Event{Err: errors.New("consul unavailable")}, metas, false)
+	if e := <-ch; nil == e.Err {
+		t.Fatal("subscriber should receive error")
+	}
+
+	if cur := ci.current(); nil != cur.Err || 2 != len(cur.Instances) {
+		t.Fatalf("current: %+v", cur)
+	}
+
+	late := make(chan sd.Event, 1)
+	ci.Register(late)
+	if e := <-late; nil != e.Err || 2 != len(e.Instances) {
+		t.Fatalf("late subscriber: %+v", e)
+	}
+}
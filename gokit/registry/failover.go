@@ -0,0 +1,235 @@
+package registry
+
+import (
+	"reflect"
+	"sync"
+
+	jksd "github.com/jkprj/jkfr/gokit/sd"
+	jklog "github.com/jkprj/jkfr/log"
+
+	"github.com/go-kit/kit/sd"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// 多数据中心服务实例监听器，每个数据中心各自监听服务变化，
+// 优先使用本地数据中心的服务实例，本地健康的服务实例少于阈值时，按顺序故障转移到远程数据中心
+type failoverInstancer struct {
+	service   string
+	threshold int
+	children  []*consulInstancer // 第一个为本地数据中心，其他按故障转移顺序
+	chans     []chan sd.Event
+
+	mt          sync.RWMutex
+	events      []sd.Event // 每个数据中心最后一次的服务变化
+	healthies   []int      // 每个数据中心健康的服务实例数
+	selected    int        // 当前使用的数据中心，-1表示没有
+	state       sd.Event
+	subscribers map[chan<- sd.Event]struct{}
+
+	// 按顺序通知订阅者，发送事件时不持有mt，订阅者处理事件时可以调用 InstanceMeta、Stale、Remote
+	mtPublish sync.Mutex
+
+	stopOnce sync.Once
+}
+
+func newFailoverInstancer(service string, threshold int, children []*consulInstancer) *failoverInstancer {
+
+	fi := &failoverInstancer{
+		service:     service,
+		threshold:   threshold,
+		children:    children,
+		chans:       make([]chan sd.Event, len(children)),
+		events:      make([]sd.Event, len(children)),
+		healthies:   make([]int, len(children)),
+		selected:    -1,
+		subscribers: map[chan<- sd.Event]struct{}{},
+	}
+
+	// 先同步获取每个数据中心当前的服务实例，再监听变化
+	for i, child := range children {
+		fi.events[i] = child.current()
+		fi.healthies[i] = fi.healthy(i, fi.events[i])
+	}
+	fi.selected, fi.state = fi.choose()
+
+	for i, child := range children {
+		fi.chans[i] = make(chan sd.Event)
+		go fi.receive(i)
+		child.Register(fi.chans[i])
+	}
+
+	return fi
+}
+
+// 在持有锁之前统计健康的服务实例数，避免与数据中心监听器互相等待锁
+func (fi *failoverInstancer) receive(i int) {
+	for event := range fi.chans[i] {
+		fi.update(i, event, fi.healthy(i, event))
+	}
+}
+
+func (fi *failoverInstancer) update(i int, event sd.Event, healthy int) {
+	fi.mtPublish.Lock()
+	defer fi.mtPublish.Unlock()
+
+	fi.mt.Lock()
+
+	fi.events[i] = event
+	fi.healthies[i] = healthy
+
+	selected, state := fi.choose()
+	if selected != fi.selected {
+		jklog.Warnw("discovery datacenter changed", "service", fi.service,
+			"from", fi.datacenterName(fi.selected), "to", fi.datacenterName(selected), "instances", state.Instances)
+	}
+
+	if selected == fi.selected && reflect.DeepEqual(fi.state, state) {
+		fi.mt.Unlock()
+		return
+	}
+
+	fi.selected = selected
+	fi.state = state
+	subscribers := make([]chan<- sd.Event, 0, len(fi.subscribers))
+	for ch := range fi.subscribers {
+		subscribers = append(subscribers, ch)
+	}
+	fi.mt.Unlock()
+
+	for _, ch := range subscribers {
+		ch <- state
+	}
+}
+
+// 选择数据中心：按顺序第一个健康服务实例不少于阈值的数据中心；
+// 都少于阈值时按顺序选择第一个有服务实例的数据中心；
+// 所有数据中心都出错时返回第一个错误，订阅者继续使用之前的服务实例
+func (fi *failoverInstancer) choose() (int, sd.Event) {
+
+	first := -1
+	var err error
+
+	for i, event := range fi.events {
+		if nil != event.Err {
+			if nil == err {
+				err = event.Err
+			}
+			continue
+		}
+
+		if fi.healthies[i] >= fi.threshold {
+			return i, event
+		}
+
+		if -1 == first && len(event.Instances) > 0 {
+			first = i
+		}
+	}
+
+	if -1 != first {
+		return first, fi.events[first]
+	}
+
+	if nil != err {
+		return fi.selected, sd.Event{Err: err}
+	}
+
+	return 0, sd.Event{Instances: []string{}}
+}
+
+func (fi *failoverInstancer) healthy(i int, event sd.Event) int {
+
+	n := 0
+	for _, instance := range event.Instances {
+		if meta, ok := fi.children[i].InstanceMeta(instance); !ok || consulapi.HealthPassing == meta.Health {
+			n++
+		}
+	}
+
+	return n
+}
+
+func (fi *failoverInstancer) datacenterName(i int) string {
+	if i < 0 {
+		return ""
+	}
+	if "" == fi.children[i].datacenter {
+		return "local"
+	}
+	return fi.children[i].datacenter
+}
+
+// InstanceMeta 获取当前使用的数据中心的服务实例元数据
+func (fi *failoverInstancer) InstanceMeta(instance string) (jksd.InstanceMeta, bool) {
+	fi.mt.RLock()
+	selected := fi.selected
+	fi.mt.RUnlock()
+
+	if selected < 0 {
+		return jksd.InstanceMeta{}, false
+	}
+
+	return fi.children[selected].InstanceMeta(instance)
+}
+
+// Remote 服务实例所在数据中心，以及是否为远程数据中心(故障转移)
+func (fi *failoverInstancer) Remote(instance string) (string, bool) {
+	fi.mt.RLock()
+	selected := fi.selected
+	fi.mt.RUnlock()
+
+	if selected <= 0 {
+		return fi.datacenterName(0), false
+	}
+
+	datacenter := fi.children[selected].datacenter
+	if meta, ok := fi.children[selected].InstanceMeta(instance); ok && "" != meta.Datacenter {
+		datacenter = meta.Datacenter
+	}
+
+	return datacenter, true
+}
+
+// Stale 当前使用的数据中心的服务实例是否来自快照
+func (fi *failoverInstancer) Stale() bool {
+	fi.mt.RLock()
+	selected := fi.selected
+	fi.mt.RUnlock()
+
+	return selected >= 0 && fi.children[selected].Stale()
+}
+
+// Register 订阅服务变化，订阅时会先推送当前服务实例
+func (fi *failoverInstancer) Register(ch chan<- sd.Event) {
+	fi.mtPublish.Lock()
+	defer fi.mtPublish.Unlock()
+
+	fi.mt.Lock()
+	fi.subscribers[ch] = struct{}{}
+	state := fi.state
+	fi.mt.Unlock()
+
+	ch <- state
+}
+
+// Deregister 取消订阅，等待正在进行的通知完成，返回后不会再向ch发送事件
+func (fi *failoverInstancer) Deregister(ch chan<- sd.Event) {
+	fi.mtPublish.Lock()
+	defer fi.mtPublish.Unlock()
+
+	fi.mt.Lock()
+	defer fi.mt.Unlock()
+
+	delete(fi.subscribers, ch)
+}
+
+// Stop 停止所有数据中心的监听
+func (fi *failoverInstancer) Stop() {
+	fi.stopOnce.Do(func() {
+		for i, child := range fi.children {
+			child.Deregister(fi.chans[i])
+			child.Stop()
+			close(fi.chans[i])
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	jksd "github.com/jkprj/jkfr/gokit/sd"
+
+	"github.com/go-kit/kit/endpoint"
+	kitlog "github.com/go-kit/kit/log"
+)
+
+// 订阅者处理事件时会调用 InstanceMeta、Stale、Remote，两个数据中心连续变化时不能互相等待锁
+func TestFailoverPublishWithMetaSubscriber(t *testing.T) {
+
+	local, remote := newTestInstancer(), newTestInstancer()
+	remote.datacenter = "dc2"
+
+	fi := newFailoverInstancer("hello", 2, []*consulInstancer{local, remote})
+
+	factory := func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		fi.Remote(instance)
+		return func(context.Context, interface{}) (interface{}, error) { return nil, nil }, nil, nil
+	}
+	endpointer := jksd.NewEndpointer(fi, factory, kitlog.NewNopLogger())
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 50; i++ {
+			// 本地数据中心的实例数在阈值上下变化，触发故障转移
+			event, metas := testEvent(i % 3)
+			local.publish(event, metas, false)
+			event, metas = testEvent(i%4 + 2)
+			remote.publish(event, metas, false)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("failover publish deadlock")
+	}
+
+	endpointer.Close()
+	fi.Stop()
+}
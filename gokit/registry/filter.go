@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"hash/fnv"
+	"strconv"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// 服务实例过滤函数，返回true时保留该服务实例
+type InstanceFilter func(entry *consulapi.ServiceEntry) bool
+
+// 服务实例过滤条件，Services、服务实例监听器和服务发现快照使用相同的过滤条件：
+// 包含全部tags，满足consul过滤表达式，并且所有过滤函数都返回true
+type entryFilter struct {
+	tags       []string         // 需要包含的全部tags
+	expr       string           // consul过滤表达式，由consul执行
+	predicates []InstanceFilter // 本地过滤函数
+}
+
+func newEntryFilter(tags []string, expr string, predicates []InstanceFilter) entryFilter {
+	return entryFilter{tags: tags, expr: expr, predicates: predicates}
+}
+
+// consul查询服务只支持一个tag，其他tag在本地过滤
+func (f entryFilter) queryTag() string {
+	if len(f.tags) > 0 {
+		return f.tags[0]
+	}
+
+	return ""
+}
+
+// 在查询选项中加上consul过滤表达式，不修改原查询选项
+func (f entryFilter) queryOptions(queryOpts *consulapi.QueryOptions) *consulapi.QueryOptions {
+
+	opts := consulapi.QueryOptions{}
+	if nil != queryOpts {
+		opts = *queryOpts
+	}
+
+	if "" != f.expr {
+		opts.Filter = f.expr
+	}
+
+	return &opts
+}
+
+// 本地过滤，consul过滤表达式已由consul执行
+func (f entryFilter) match(entry *consulapi.ServiceEntry) bool {
+
+	if nil == entry.Service || !hasTags(entry.Service.Tags, f.tags) {
+		return false
+	}
+
+	for _, predicate := range f.predicates {
+		if !predicate(entry) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f entryFilter) filter(entries []*consulapi.ServiceEntry) []*consulapi.ServiceEntry {
+
+	filtered := make([]*consulapi.ServiceEntry, 0, len(entries))
+	for _, entry := range entries {
+		if f.match(entry) {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered
+}
+
+// 区分不同过滤条件的快照文件，过滤函数无法区分，需要由调用方保证同一服务的过滤函数相同
+func (f entryFilter) key() string {
+	if "" == f.expr {
+		return ""
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(f.expr))
+
+	return strconv.FormatUint(uint64(h.Sum32()), 16)
+}
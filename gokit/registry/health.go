@@ -0,0 +1,156 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	jklog "github.com/jkprj/jkfr/log"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	HEALTH_GROUP_LIVENESS  = "liveness"  // 存活检查，失败说明进程需要重启
+	HEALTH_GROUP_READINESS = "readiness" // 就绪检查，失败说明暂时不能处理请求，如依赖的数据库不可用
+)
+
+// 健康检查函数，返回nil表示健康。consul http检查时ctx为请求的ctx，没有截止时间，consul超时断开连接时取消；
+// ttl检查时ctx的截止时间为心跳间隔，注销时取消，检查函数需要自行控制耗时
+type HealthCheckFunc func(ctx context.Context) error
+
+// 单项健康检查结果
+type HealthCheckResult struct {
+	Status     string `json:"status"`          // passing 或 critical
+	Error      string `json:"error,omitempty"` // 检查失败的原因
+	DurationMS int64  `json:"duration_ms"`     // 检查耗时(毫秒)
+}
+
+// 健康检查报告，任意一项检查失败时Status为critical，http状态码为503
+type HealthCheckResponse struct {
+	Status string                       `json:"status"`
+	Checks map[string]HealthCheckResult `json:"checks,omitempty"`
+}
+
+type healthCheck struct {
+	check  HealthCheckFunc
+	groups map[string]bool
+}
+
+var mtHealthCheck sync.RWMutex
+var healthChecks map[string]*healthCheck = map[string]*healthCheck{}
+
+// 添加健康检查，同名检查会被替换
+// Parameters :
+// name   检查名称，会出现在健康检查报告中
+// check  检查函数
+// groups 所属分组 HEALTH_GROUP_LIVENESS，HEALTH_GROUP_READINESS，不指定时同时属于两个分组
+func AddHealthCheck(name string, check HealthCheckFunc, groups ...string) {
+	if "" == name || nil == check {
+		return
+	}
+
+	if 0 == len(groups) {
+		groups = []string{HEALTH_GROUP_LIVENESS, HEALTH_GROUP_READINESS}
+	}
+
+	hc := &healthCheck{check: check, groups: map[string]bool{}}
+	for _, group := range groups {
+		hc.groups[group] = true
+	}
+
+	mtHealthCheck.Lock()
+	defer mtHealthCheck.Unlock()
+
+	healthChecks[name] = hc
+}
+
+// 删除健康检查
+func RemoveHealthCheck(name string) {
+	mtHealthCheck.Lock()
+	defer mtHealthCheck.Unlock()
+
+	delete(healthChecks, name)
+}
+
+// 执行健康检查，各项检查并发执行
+// Parameters :
+// group 检查分组，为空时执行所有检查
+func RunHealthChecks(ctx context.Context, group string) HealthCheckResponse {
+
+	mtHealthCheck.RLock()
+	checks := make(map[string]HealthCheckFunc, len(healthChecks))
+	for name, hc := range healthChecks {
+		if "" == group || hc.groups[group] {
+			checks[name] = hc.check
+		}
+	}
+	mtHealthCheck.RUnlock()
+
+	resp := HealthCheckResponse{Status: consulapi.HealthPassing, Checks: make(map[string]HealthCheckResult, len(checks))}
+
+	var mt sync.Mutex
+	var wg sync.WaitGroup
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check HealthCheckFunc) {
+			defer wg.Done()
+
+			result := runHealthCheck(ctx, name, check)
+
+			mt.Lock()
+			resp.Checks[name] = result
+			mt.Unlock()
+		}(name, check)
+	}
+
+	wg.Wait()
+
+	for _, result := range resp.Checks {
+		if consulapi.HealthPassing != result.Status {
+			resp.Status = consulapi.HealthCritical
+			break
+		}
+	}
+
+	return resp
+}
+
+func runHealthCheck(ctx context.Context, name string, check HealthCheckFunc) (result HealthCheckResult) {
+
+	bg := time.Now()
+
+	defer func() {
+		if r := recover(); nil != r {
+			jklog.Errorw("health check panic", "name", name, "panic", r)
+			result.Status = consulapi.HealthCritical
+			result.Error = fmt.Sprint("panic: ", r)
+		}
+		result.DurationMS = time.Since(bg).Milliseconds()
+	}()
+
+	if err := check(ctx); nil != err {
+		return HealthCheckResult{Status: consulapi.HealthCritical, Error: err.Error()}
+	}
+
+	return HealthCheckResult{Status: consulapi.HealthPassing}
+}
+
+// TTL健康检查的心跳状态函数，返回consul健康状态(passing，warning，critical)和说明
+type TTLHealthFunc func(ctx context.Context) (status string, output string)
+
+// 默认的心跳状态：根据 AddHealthCheck 添加的所有检查上报 passing 或 critical
+func defaultTTLHealth(ctx context.Context) (status string, output string) {
+
+	resp := RunHealthChecks(ctx, "")
+
+	data, err := json.Marshal(resp)
+	if nil != err {
+		return resp.Status, resp.Status
+	}
+
+	return resp.Status, string(data)
+}
@@ -1,6 +1,8 @@
 package registry
 
 import (
+	"strings"
+
 	"github.com/jkprj/jkfr/gokit/utils"
 	jklog "github.com/jkprj/jkfr/log"
 	jkos "github.com/jkprj/jkfr/os"
@@ -28,6 +30,7 @@ type RegConfig struct {
 	SvcPort    int    `json:"-" toml:"-"` // 服务绑定端口
 
 	ServerAddr string `json:"ServerAddr" toml:"ServerAddr"` // 服务地址
+	Backend    string `json:"Backend" toml:"Backend"`       // 服务注册/发现后端，默认consul
 	ConsulAddr string `json:"ConsulAddr" toml:"ConsulAddr"` // consul服务地址
 	Namespace  string `json:"Namespace" toml:"Namespace"`   // 注册consul时的Namespace，非企业版，似乎无效
 	UserName   string `json:"UserName" toml:"UserName"`     // consul服务的用户名(如果需要)
@@ -38,8 +41,15 @@ type RegConfig struct {
 	DeregisterCriticalServiceAfter int    `json:"DeregisterCriticalServiceAfter" toml:"DeregisterCriticalServiceAfter"` // consul健康检查Criticald多久后取消注册
 	HealthCheckInterval            int    `json:"HealthCheckInterval" toml:"HealthCheckInterval"`                       // consul健康检查间隔时间
 	HealthCheckTimeOut             int    `json:"HealthCheckTimeOut" toml:"HealthCheckTimeOut"`                         // consul健康检查超时时间
+	HTTPHealthCheck                bool   `json:"HTTPHealthCheck" toml:"HTTPHealthCheck"`                               // 绑定了服务端口时也启动http健康检查服务，consul通过 AddHealthCheck 添加的检查判断服务是否健康
+	TTLCheck                       int    `json:"TTLCheck" toml:"TTLCheck"`                                             // TTL健康检查时间(秒)，>0 时使用TTL健康检查代替tcp/http检查，由服务定时上报心跳
+	AntiEntropyInterval            int    `json:"AntiEntropyInterval" toml:"AntiEntropyInterval"`                       // 检查consul是否丢失注册信息的间隔时间(秒)，丢失时重新注册
+	AdminAddr                      string `json:"AdminAddr" toml:"AdminAddr"`                                           // 管理接口(摘流/恢复)http服务地址，为空时不启动
+	SnapshotDir                    string `json:"SnapshotDir" toml:"SnapshotDir"`                                       // 服务发现快照目录，为空时不保存快照
 
-	ConsulTags []string `json:"ConsulTags" toml:"ConsulTags"` // 注册到consul的tags
+	ConsulTags []string          `json:"ConsulTags" toml:"ConsulTags"` // 注册到consul的tags
+	Meta       map[string]string `json:"Meta" toml:"Meta"`             // 注册到consul的元数据，如版本
+	Weight     int               `json:"Weight" toml:"Weight"`         // 注册到consul的权重，weighted负载均衡策略按权重分配请求，<=0 时不设置(consul默认为1)
 
 	// 注册等待超时时间
 	WaitTime int `json:"WaitTime" toml:"WaitTime"` // 注册时，等待响应超时时间
@@ -54,6 +64,20 @@ type RegConfig struct {
 	ConfigPath  string                  `json:"-" toml:"-"`                     // 配置文件路径
 	PassingOnly bool                    `json:"PassingOnly" toml:"PassingOnly"` // 服务发现时是否只获取正常的服务信息
 	QueryOpts   *consulapi.QueryOptions `json:"-" toml:"-"`                     // 服务发现选项
+	Filter      string                  `json:"Filter" toml:"Filter"`           // 服务发现的consul过滤表达式，如 Service.Meta.version == "v2" or "canary" in Service.Tags
+
+	// 多数据中心服务发现，优先使用本地数据中心，健康的服务实例少于 FailoverThreshold 时按顺序故障转移到 FailoverDatacenters
+	Datacenter          string   `json:"Datacenter" toml:"Datacenter"`                   // 服务发现的本地数据中心，为空时为consul agent所在数据中心
+	FailoverDatacenters []string `json:"FailoverDatacenters" toml:"FailoverDatacenters"` // 故障转移的远程数据中心，按顺序
+	FailoverThreshold   int      `json:"FailoverThreshold" toml:"FailoverThreshold"`     // 健康的服务实例少于该值时故障转移
+
+	// 静态后端(static)使用，key为服务名称，value为服务地址列表
+	StaticInstances    map[string][]string `json:"StaticInstances" toml:"StaticInstances"`       // 静态服务实例
+	StaticPollInterval int                 `json:"StaticPollInterval" toml:"StaticPollInterval"` // 静态后端检查配置文件变化的间隔时间(秒)
+
+	optInstances map[string][]string // 运行时通过 WithStaticInstances 指定的服务实例，优先于配置文件
+	ttlHealth    TTLHealthFunc       // 运行时通过 WithTTLCheck 指定的心跳状态函数
+	filters      []InstanceFilter    // 运行时通过 WithInstanceFilter 指定的本地过滤函数
 }
 
 // 读取配置
@@ -63,11 +87,21 @@ func defaultconfig(name string) *RegConfig {
 	// 从环境变量读取配置，未配置环境变量则设置默认值
 	cfg.ServerName = name
 	cfg.ServerAddr = jkos.GetEnvString("R_SERVER_ADDR", "")
+	cfg.Backend = jkos.GetEnvString("R_BACKEND", BACKEND_CONSUL)
 	cfg.ConsulAddr = jkos.GetEnvString("R_CONSUL_ADDR", "127.0.0.1:8500")
 	cfg.HealthCheckAddr = jkos.GetEnvString("R_HEALTH_CHECK_ADDR", "127.0.0.1")
 	cfg.HealthCheckBindAddr = jkos.GetEnvString("R_HEALTH_CHECK_BIND_ADDR", "")
 	cfg.HealthCheckInterval = jkos.GetEnvInt("R_HEALTH_CHECK_INTERVAL", 1)
 	cfg.HealthCheckTimeOut = jkos.GetEnvInt("R_HEALTH_CHECK_TIMEOUT", 60)
+	cfg.HTTPHealthCheck = jkos.GetEnvBool("R_HTTP_HEALTH_CHECK", false)
+	cfg.TTLCheck = jkos.GetEnvInt("R_TTL_CHECK", 0)
+	cfg.AntiEntropyInterval = jkos.GetEnvInt("R_ANTI_ENTROPY_INTERVAL", 30)
+	cfg.AdminAddr = jkos.GetEnvString("R_ADMIN_ADDR", "")
+	cfg.SnapshotDir = jkos.GetEnvString("R_SNAPSHOT_DIR", "")
+	cfg.Filter = jkos.GetEnvString("R_FILTER", "")
+	cfg.Datacenter = jkos.GetEnvString("R_DATACENTER", "")
+	cfg.FailoverDatacenters = jkos.GetEnvStrings("R_FAILOVER_DATACENTERS", ",", nil)
+	cfg.FailoverThreshold = jkos.GetEnvInt("R_FAILOVER_THRESHOLD", 1)
 	cfg.DeregisterCriticalServiceAfter = jkos.GetEnvInt("R_DEREGISTER_CRITICAL_SERVICE_AFTER", 30)
 	cfg.PassingOnly = jkos.GetEnvBool("R_PASSING_ONLY", true)
 	cfg.Namespace = jkos.GetEnvString("R_NAMESPACE", "")
@@ -78,7 +112,10 @@ func defaultconfig(name string) *RegConfig {
 	cfg.UserName = jkos.GetEnvString("R_USERNAME", "")
 	cfg.Password = jkos.GetEnvString("R_PASSWORD", "")
 	cfg.ConsulTags = jkos.GetEnvStrings("R_CONSUL_TAGS", ",", nil)
+	cfg.Meta = getEnvMeta("R_META")
+	cfg.Weight = jkos.GetEnvInt("R_WEIGHT", 0)
 	cfg.WaitTime = jkos.GetEnvInt("R_WAIT_TIME", 60)
+	cfg.StaticPollInterval = jkos.GetEnvInt("R_STATIC_POLL_INTERVAL", 5)
 
 	// 从环境变量读取配置文件路径，然后读取配置文件
 	cfg.ConfigPath = jkos.GetEnvString("R_CONFIG_PATH", "")
@@ -95,29 +132,46 @@ func defaultconfig(name string) *RegConfig {
 	return cfg
 }
 
-// 尝试读取默认路径的配置文件配置
-func loadDefaultServerConfig(name string, cfg *RegConfig) {
-
-	fileName := jkos.CurDir() + "/conf/" + name
+// 从环境变量读取元数据，格式为 key1:value1,key2:value2
+func getEnvMeta(key string) map[string]string {
 
-	conf := fileName + ".toml"
-	if jkos.IsFileExists(conf) {
-		WithFile(conf)(cfg)
+	items := jkos.GetEnvStrings(key, ",", nil)
+	if 0 == len(items) {
+		return nil
 	}
 
-	conf = fileName + ".json"
-	if jkos.IsFileExists(conf) {
-		WithFile(conf)(cfg)
+	meta := make(map[string]string, len(items))
+	for _, item := range items {
+		kv := strings.SplitN(item, ":", 2)
+		if 2 != len(kv) || "" == strings.TrimSpace(kv[0]) {
+			jklog.Warnw("invalid meta item", "env", key, "item", item)
+			continue
+		}
+		meta[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
 	}
 
-	conf = jkos.CurDir() + "/conf/registry.json"
-	if jkos.IsFileExists(conf) {
-		WithFile(conf)(cfg)
+	return meta
+}
+
+// 尝试读取默认路径的配置文件配置
+func loadDefaultServerConfig(name string, cfg *RegConfig) {
+	for _, conf := range defaultConfigFiles(name) {
+		if jkos.IsFileExists(conf) {
+			WithFile(conf)(cfg)
+		}
 	}
+}
+
+// 默认配置文件路径，按读取顺序排列
+func defaultConfigFiles(name string) []string {
+
+	fileName := jkos.CurDir() + "/conf/" + name
 
-	conf = jkos.CurDir() + "/conf/registry.toml"
-	if jkos.IsFileExists(conf) {
-		WithFile(conf)(cfg)
+	return []string{
+		fileName + ".toml",
+		fileName + ".json",
+		jkos.CurDir() + "/conf/registry.json",
+		jkos.CurDir() + "/conf/registry.toml",
 	}
 }
 
@@ -133,6 +187,13 @@ func WithServerAddr(addr string) RegOption {
 	}
 }
 
+// 服务注册/发现后端，需要是已通过 RegisterBackend 注册的后端名称
+func WithBackend(backend string) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.Backend = backend
+	}
+}
+
 // consul服务地址
 func WithConsulAddr(addr string) RegOption {
 	return func(cfg *RegConfig) {
@@ -190,6 +251,81 @@ func WithHealthCheckTimeOut(timeout int) RegOption {
 	}
 }
 
+// 绑定了服务端口时也使用http健康检查，而不是tcp检查服务端口，http健康检查会执行 AddHealthCheck 添加的检查
+func WithHTTPHealthCheck(enable bool) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.HTTPHealthCheck = enable
+	}
+}
+
+// 使用TTL健康检查，适用于consul无法访问服务的情况(如NAT后面的服务)，服务每 ttl/3 秒上报一次心跳，
+// 超过ttl秒没有心跳consul将服务标记为critical
+// Parameters :
+// ttl    TTL健康检查时间(秒)，<=0 时不使用TTL健康检查
+// health 心跳时获取服务健康状态，为nil时根据 AddHealthCheck 添加的检查上报 passing 或 critical
+func WithTTLCheck(ttl int, health TTLHealthFunc) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.TTLCheck = ttl
+		cfg.ttlHealth = health
+	}
+}
+
+// 检查consul是否丢失注册信息的间隔时间(秒)
+func WithAntiEntropyInterval(interval int) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.AntiEntropyInterval = interval
+	}
+}
+
+// 管理接口(摘流/恢复)http服务地址，如 127.0.0.1:9090，管理接口没有鉴权，应该只绑定内网地址
+func WithAdminAddr(addr string) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.AdminAddr = addr
+	}
+}
+
+// 服务发现快照目录，保存每个服务最后一次从consul获取的服务实例，启动时consul不可用则使用快照
+func WithSnapshotDir(dir string) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.SnapshotDir = dir
+	}
+}
+
+// 服务发现的consul过滤表达式，由consul执行，语法见consul文档 Filtering，静态后端不支持
+func WithFilter(expr string) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.Filter = expr
+	}
+}
+
+// 服务发现的本地过滤函数，可以多次指定，所有过滤函数都返回true的服务实例才会被发现
+func WithInstanceFilter(filters ...InstanceFilter) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.filters = append(cfg.filters, filters...)
+	}
+}
+
+// 服务发现的本地数据中心，为空时为consul agent所在数据中心
+func WithDatacenter(datacenter string) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.Datacenter = datacenter
+	}
+}
+
+// 故障转移的远程数据中心，本地数据中心健康的服务实例少于 FailoverThreshold 时按顺序使用
+func WithFailoverDatacenters(datacenters ...string) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.FailoverDatacenters = datacenters
+	}
+}
+
+// 健康的服务实例少于该值时故障转移到远程数据中心
+func WithFailoverThreshold(threshold int) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.FailoverThreshold = threshold
+	}
+}
+
 // 注册到consul的tags
 func WithTags(tags ...string) RegOption {
 	return func(cfg *RegConfig) {
@@ -197,6 +333,26 @@ func WithTags(tags ...string) RegOption {
 	}
 }
 
+// 注册到consul的元数据，会与已有的元数据合并，相同key替换
+func WithMeta(meta map[string]string) RegOption {
+	return func(cfg *RegConfig) {
+		if nil == cfg.Meta {
+			cfg.Meta = map[string]string{}
+		}
+
+		for k, v := range meta {
+			cfg.Meta[k] = v
+		}
+	}
+}
+
+// 注册到consul的权重，weighted负载均衡策略按权重分配请求，如配置减半的服务器设置为其他服务器的一半
+func WithWeight(weight int) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.Weight = weight
+	}
+}
+
 // 注册时，等待响应超时时间
 func WithWaitTime(waitTime int) RegOption {
 	return func(cfg *RegConfig) {
@@ -246,6 +402,33 @@ func WithQueryOptions(queryOpts *consulapi.QueryOptions) RegOption {
 	}
 }
 
+// 静态服务实例，指定后服务注册/发现后端切换为static，不再依赖consul
+// Parameters :
+// name  服务名称
+// addrs 服务地址列表，格式为 host:port
+func WithStaticInstances(name string, addrs ...string) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.Backend = BACKEND_STATIC
+
+		if nil == cfg.StaticInstances {
+			cfg.StaticInstances = map[string][]string{}
+		}
+		if nil == cfg.optInstances {
+			cfg.optInstances = map[string][]string{}
+		}
+
+		cfg.StaticInstances[name] = addrs
+		cfg.optInstances[name] = addrs
+	}
+}
+
+// 静态后端检查配置文件变化的间隔时间(秒)
+func WithStaticPollInterval(interval int) RegOption {
+	return func(cfg *RegConfig) {
+		cfg.StaticPollInterval = interval
+	}
+}
+
 // 配置文件路径
 func WithFile(cfgPath string) RegOption {
 	return func(cfg *RegConfig) {
@@ -0,0 +1,371 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	jksd "github.com/jkprj/jkfr/gokit/sd"
+	jklog "github.com/jkprj/jkfr/log"
+
+	kitcosul "github.com/go-kit/kit/sd/consul"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// 元数据中该key的值不为空时服务处于摘流状态，见 Registrar.Drain
+const META_DRAIN = jksd.META_DRAIN
+
+var (
+	ErrRegistrarClosed = errors.New("registrar is closed")
+	ErrNotSupported    = errors.New("not supported by registry backend")
+)
+
+// 服务注册句柄，负责后台保持注册(TTL心跳或检查consul是否丢失注册信息)，
+// 并且可以在不重启服务的情况下更新tags、元数据和维护模式
+type Registrar struct {
+	client kitcosul.Client
+
+	mt           sync.Mutex
+	registration *consulapi.AgentServiceRegistration
+	fixedTags    []string // 服务名称和服务地址，更新tags时保留
+	maintenance  bool
+	reason       string // 维护模式的原因
+
+	ttl         time.Duration // TTL健康检查时间，为0时不使用TTL健康检查
+	health      TTLHealthFunc // TTL健康检查的心跳状态
+	ttlUpdater  TTLUpdater
+	antiEntropy time.Duration // 检查consul是否丢失注册信息的间隔
+
+	quit      chan struct{} // 关闭后停止后台goroutine
+	done      chan struct{} // 后台goroutine退出后关闭
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// 构造Registrar对象
+func NewRegistrar(client kitcosul.Client, r *consulapi.AgentServiceRegistration) *Registrar {
+	return &Registrar{client: client, registration: r, quit: make(chan struct{})}
+}
+
+// 注册服务，维护模式中的服务重新注册后保持维护模式
+func (p *Registrar) Register() error {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	return p.register()
+}
+
+func (p *Registrar) register() error {
+
+	err := p.client.Register(p.registration)
+	if nil != err {
+		return err
+	}
+
+	if p.maintenance {
+		if ms, ok := p.client.(MaintenanceSetter); ok {
+			return ms.EnableServiceMaintenance(p.registration.ID, p.reason)
+		}
+	}
+
+	return nil
+}
+
+// 注销服务，同 Close
+func (p *Registrar) Deregister() error {
+	return p.Close()
+}
+
+// 停止后台goroutine并注销服务，等待后台goroutine退出后再注销，避免注销后又被重新注册，可以重复调用
+func (p *Registrar) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		removeRegistrar(p)
+
+		if nil != p.done {
+			<-p.done
+		}
+
+		p.mt.Lock()
+		defer p.mt.Unlock()
+
+		p.closeErr = p.client.Deregister(p.registration)
+	})
+
+	return p.closeErr
+}
+
+// 更新注册到consul的tags并重新注册，服务名称和服务地址tag会保留
+func (p *Registrar) UpdateTags(tags ...string) error {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	registration := *p.registration
+	registration.Tags = append(append([]string{}, tags...), p.fixedTags...)
+
+	return p.update(&registration)
+}
+
+// 更新注册到consul的元数据并重新注册，value为空字符串的key会被删除，其他key保持不变
+func (p *Registrar) UpdateMeta(meta map[string]string) error {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	return p.update(p.mergeMeta(meta))
+}
+
+func (p *Registrar) mergeMeta(meta map[string]string) *consulapi.AgentServiceRegistration {
+
+	registration := *p.registration
+	registration.Meta = make(map[string]string, len(p.registration.Meta)+len(meta))
+	for k, v := range p.registration.Meta {
+		registration.Meta[k] = v
+	}
+	for k, v := range meta {
+		if "" == v {
+			delete(registration.Meta, k)
+		} else {
+			registration.Meta[k] = v
+		}
+	}
+
+	return &registration
+}
+
+func (p *Registrar) update(registration *consulapi.AgentServiceRegistration) error {
+
+	if p.isClosed() {
+		return ErrRegistrarClosed
+	}
+
+	p.registration = registration
+
+	err := p.register()
+	if nil != err {
+		jklog.Errorw("update registration fail, retry later", "regObj", registration, "err", err)
+	}
+
+	return err
+}
+
+// 进入维护模式，consul会将服务标记为critical，PassingOnly的客户端不再发现该服务，服务本身继续运行
+func (p *Registrar) SetMaintenance(reason string) error {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	ms, ok := p.client.(MaintenanceSetter)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	p.maintenance = true
+	p.reason = reason
+
+	return ms.EnableServiceMaintenance(p.registration.ID, reason)
+}
+
+// 退出维护模式
+func (p *Registrar) ClearMaintenance() error {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	ms, ok := p.client.(MaintenanceSetter)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	p.maintenance = false
+	p.reason = ""
+
+	return ms.DisableServiceMaintenance(p.registration.ID)
+}
+
+// 是否在维护模式中
+func (p *Registrar) InMaintenance() bool {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	return p.maintenance
+}
+
+// 摘流：元数据中设置 drain=reason 并重新注册，后端支持时同时进入维护模式，
+// PassingOnly的客户端不再发现该服务，本框架的客户端不再为该服务分配新请求，已发出的请求正常完成
+func (p *Registrar) Drain(reason string) error {
+	if "" == reason {
+		reason = "true"
+	}
+
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	if _, ok := p.client.(MaintenanceSetter); ok {
+		p.maintenance = true
+		p.reason = reason
+	}
+
+	return p.update(p.mergeMeta(map[string]string{META_DRAIN: reason}))
+}
+
+// 恢复摘流的服务，同时退出维护模式
+func (p *Registrar) Undrain() error {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	if ms, ok := p.client.(MaintenanceSetter); ok && p.maintenance {
+		if err := ms.DisableServiceMaintenance(p.registration.ID); nil != err {
+			return err
+		}
+		p.maintenance = false
+		p.reason = ""
+	}
+
+	return p.update(p.mergeMeta(map[string]string{META_DRAIN: ""}))
+}
+
+// 是否在摘流中
+func (p *Registrar) Draining() bool {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	return "" != p.registration.Meta[META_DRAIN]
+}
+
+// 当前的注册信息，不能修改
+func (p *Registrar) getRegistration() *consulapi.AgentServiceRegistration {
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	return p.registration
+}
+
+func (p *Registrar) isClosed() bool {
+	select {
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// 启动后台goroutine保持注册：
+// TTL健康检查时每 ttl/3 上报一次心跳，上报失败时重新注册；
+// 否则每 antiEntropy 检查一次consul是否还有注册信息，没有时重新注册，
+// 由于consul deregister其他服务时，经常会导致其他服务的健康检查也deregister；
+// 后端不支持检查注册信息时每小时重新注册一次
+func (p *Registrar) start() {
+
+	p.done = make(chan struct{})
+
+	go func() {
+		defer close(p.done)
+
+		registered := false
+
+		for {
+			wait := p.keepInterval()
+
+			if !registered {
+				if err := p.Register(); nil != err {
+					jklog.Errorw("RegistryServer fail", "regObj", p.getRegistration(), "err", err)
+					wait = time.Second * 5
+				} else {
+					jklog.Infow("RegistryServer succ", "regObj", p.getRegistration())
+					registered = true
+				}
+			} else {
+				registered = p.stillRegistered()
+				if !registered {
+					wait = 0
+				}
+			}
+
+			if registered && nil != p.ttlUpdater {
+				if err := p.heartbeat(); nil != err {
+					jklog.Errorw("update ttl fail, to register again", "id", p.getRegistration().ID, "err", err)
+					registered = false
+					wait = time.Second
+				}
+			}
+
+			select {
+			case <-p.quit:
+				return
+			case <-time.After(wait):
+			}
+		}
+	}()
+}
+
+func (p *Registrar) keepInterval() time.Duration {
+
+	var interval time.Duration
+
+	if nil != p.ttlUpdater {
+		interval = p.ttl / 3
+	} else if _, ok := p.client.(RegistrationChecker); ok {
+		interval = p.antiEntropy
+	} else {
+		interval = time.Hour
+	}
+
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	return interval
+}
+
+// 检查consul是否还有注册信息，TTL健康检查通过心跳判断，不支持检查的后端每次都重新注册
+func (p *Registrar) stillRegistered() bool {
+
+	if nil != p.ttlUpdater {
+		return true
+	}
+
+	rc, ok := p.client.(RegistrationChecker)
+	if !ok {
+		return false
+	}
+
+	id := p.getRegistration().ID
+
+	registered, err := rc.IsRegistered(id)
+	if nil != err {
+		jklog.Errorw("check registration fail", "id", id, "err", err)
+		return true // 无法确认时不重新注册
+	}
+
+	if !registered {
+		jklog.Warnw("registration lost, to register again", "id", id)
+	}
+
+	return registered
+}
+
+// 上报一次心跳，获取健康状态的超时时间为心跳间隔，关闭时取消
+func (p *Registrar) heartbeat() error {
+
+	health := p.health
+	if nil == health {
+		health = defaultTTLHealth
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.keepInterval())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-p.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	status, output := health(ctx)
+	if consulapi.HealthPassing != status && consulapi.HealthWarning != status {
+		status = consulapi.HealthCritical
+	}
+
+	return p.ttlUpdater.UpdateTTL(p.getRegistration().Check.CheckID, output, status)
+}
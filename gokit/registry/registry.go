@@ -22,10 +22,6 @@ import (
 
 type SubscribeRegistrarConfigInited func(regCfg *RegConfig)
 
-type HealthCheckResponse struct {
-	status int `json:"status"`
-}
-
 var healthCheckHttpServerAddr string = ""    // consul健康检查绑定服务地址
 var healthCheckHttpServer *http.Server = nil // consul健康检查服务http对象
 var registrySvrOnce sync.Once
@@ -33,7 +29,7 @@ var mapConsulRegRWMutex sync.RWMutex
 
 var healthCheckRateLimit *rate.Limiter = rate.NewLimiter(200, 10) // consul健康检查服务限流器
 
-var mapConsulReg map[string]kitcosul.Client = make(map[string]kitcosul.Client) // 缓存consulc_client对象
+var mapConsulReg map[string]*consulapi.Client = make(map[string]*consulapi.Client) // 缓存consulc_client对象
 
 var subscribeConfigInitedHandles []SubscribeRegistrarConfigInited = make([]SubscribeRegistrarConfigInited, 0, 10)
 
@@ -43,26 +39,6 @@ func AppendNotifyConfigInitedHandle(handle SubscribeRegistrarConfigInited) {
 	}
 }
 
-type Registrar struct {
-	client       kitcosul.Client
-	registration *consulapi.AgentServiceRegistration
-}
-
-// 构造Registrar对象
-func NewRegistrar(client kitcosul.Client, r *consulapi.AgentServiceRegistration) *Registrar {
-	return &Registrar{client: client, registration: r}
-}
-
-// 注册服务
-func (p *Registrar) Register() error {
-	return p.client.Register(p.registration)
-}
-
-// 注销服务
-func (p *Registrar) Deregister() error {
-	return p.client.Deregister(p.registration)
-}
-
 // 创建consulc_lient对象
 func NewConsulClient(name string, ops ...RegOption) (consulClient kitcosul.Client, err error) {
 	consulClient, _, err = newConsulClient(name, ops...)
@@ -76,43 +52,46 @@ func NewConsulClient(name string, ops ...RegOption) (consulClient kitcosul.Clien
 // 创建consulc_lient对象
 func newConsulClient(name string, ops ...RegOption) (consulClient kitcosul.Client, regCfg *RegConfig, err error) {
 
-	regCfg, consulClientCfg := getConfig(name, ops...)
-
-	consulClient = getConsulReg(consulClientCfg.Address)
-	if nil != consulClient {
-		return consulClient, regCfg, nil
-	}
+	regCfg = getConfig(name, ops...)
 
-	consulApiClient, err := consulapi.NewClient(consulClientCfg)
+	consulClient, err = getConsulClient(regCfg)
 	if nil != err {
-		jklog.Errorw("consulapi.NewClient fail", "consulClientCfg", consulClientCfg, "err", err.Error())
 		return nil, nil, err
 	}
 
-	consulClient = kitcosul.NewClient(consulApiClient)
+	return consulClient, regCfg, nil
+}
 
-	pushConsulReg(consulClientCfg.Address, consulClient)
+// 根据配置获取consulc_lient对象，相同consul地址的对象只会创建一次
+func getConsulClient(regCfg *RegConfig) (consulClient kitcosul.Client, err error) {
 
-	return consulClient, regCfg, nil
+	consulApiClient, err := getConsulApiClient(regCfg)
+	if nil != err {
+		return nil, err
+	}
+
+	return kitcosul.NewClient(consulApiClient), nil
 }
 
-// 注册，由于consul deregister其他服务时，经常会导致其他服务的健康检查也deregister，
-// 这时就算服务异常，consul就无法发现服务是否正常，这里就使用每隔段时间就重新注册一次来解决
-func do_register(registry *Registrar, regObj *consulapi.AgentServiceRegistration) {
+// 根据配置获取consul api对象，相同consul地址的对象只会创建一次
+func getConsulApiClient(regCfg *RegConfig) (consulApiClient *consulapi.Client, err error) {
 
-	go func() {
-		for {
-			err := registry.Register()
-			if nil != err {
-				jklog.Errorw("RegistryServer fail", "regObj", regObj, "err", err)
-				time.Sleep(time.Second * 5)
-			} else {
-				jklog.Infow("RegistryServer succ", "regObj", regObj)
-				time.Sleep(time.Hour)
-			}
-		}
-	}()
+	consulClientCfg := makeConsulClientConfig(regCfg)
 
+	consulApiClient = getConsulReg(consulClientCfg.Address)
+	if nil != consulApiClient {
+		return consulApiClient, nil
+	}
+
+	consulApiClient, err = consulapi.NewClient(consulClientCfg)
+	if nil != err {
+		jklog.Errorw("consulapi.NewClient fail", "consulClientCfg", consulClientCfg, "err", err.Error())
+		return nil, err
+	}
+
+	pushConsulReg(consulClientCfg.Address, consulApiClient)
+
+	return consulApiClient, nil
 }
 
 // 注册服务
@@ -121,9 +100,9 @@ func do_register(registry *Registrar, regObj *consulapi.AgentServiceRegistration
 // ops  服务注册选项，如果重复指定选项，后面的选项会替换前面的选项
 func RegistryServer(name string, ops ...RegOption) (Registry *Registrar, err error) {
 
-	consulClient, regCfg, err := newConsulClient(name, ops...)
+	backend, regCfg, err := newBackend(name, ops...)
 	if nil != err {
-		jklog.Error("newConsulClient fail", "name", regCfg.ServerName, "addr", regCfg.ServerAddr, "err", err)
+		jklog.Errorw("newBackend fail", "name", name, "err", err)
 		return nil, err
 	}
 
@@ -133,15 +112,33 @@ func RegistryServer(name string, ops ...RegOption) (Registry *Registrar, err err
 		return nil, err
 	}
 
-	// 端口0说明没有绑定服务，启动http作为consul检查检查
-	if 0 == regCfg.SvcPort {
+	ttlUpdater, supportTTL := backend.(TTLUpdater)
+	if regCfg.TTLCheck > 0 && !supportTTL {
+		jklog.Warnw("registry backend not support ttl check, use tcp/http check", "name", name, "backend", regCfg.Backend)
+		regCfg.TTLCheck = 0
+	}
+
+	// 端口0说明没有绑定服务，启动http作为consul检查检查；绑定了服务时也可以指定使用http健康检查
+	if (0 == regCfg.SvcPort && regCfg.TTLCheck <= 0) || regCfg.HTTPHealthCheck {
 		runHealthCheckServer(regCfg)
 	}
 
 	regObj := makeConsulAgentServiceRegistration(name, regCfg.SvcHost, regCfg.SvcPort, regCfg)
 
-	registry := NewRegistrar(consulClient, regObj)
-	do_register(registry, regObj)
+	registry := NewRegistrar(backend, regObj)
+	registry.fixedTags = []string{name, regCfg.ServerAddr}
+	registry.antiEntropy = time.Duration(regCfg.AntiEntropyInterval) * time.Second
+	if regCfg.TTLCheck > 0 {
+		registry.ttl = time.Duration(regCfg.TTLCheck) * time.Second
+		registry.health = regCfg.ttlHealth
+		registry.ttlUpdater = ttlUpdater
+	}
+	registry.start()
+	addRegistrar(registry)
+
+	if "" != regCfg.AdminAddr {
+		runAdminServer(regCfg)
+	}
 	// err = registry.Register()
 	// if nil != err {
 	// 	jklog.Errorw("RegistryServer fail", "regObj", regObj, "err", err)
@@ -166,30 +163,37 @@ func RegistryServerWithServerAddr(name, svrAddr string, ops ...RegOption) (Regis
 }
 
 // 读取配置，default->环境变量->配置文件->option
-func getConfig(name string, ops ...RegOption) (regCfg *RegConfig, consulClientCfg *consulapi.Config) {
+func getConfig(name string, ops ...RegOption) (regCfg *RegConfig) {
 	regCfg = defaultconfig(name)
-	consulClientCfg = consulapi.DefaultConfig()
 
-	regCfg.WaitTime = int(consulClientCfg.WaitTime / time.Second)
+	regCfg.WaitTime = int(consulapi.DefaultConfig().WaitTime / time.Second)
 
 	for _, op := range ops {
 		op(regCfg)
 	}
 
+	utils.ResetServerAddr(&regCfg.HealthCheckAddr, &regCfg.HealthCheckBindAddr)
+
+	for _, handle := range subscribeConfigInitedHandles {
+		handle(regCfg)
+	}
+
+	return
+}
+
+// 构造consul_client配置
+func makeConsulClientConfig(regCfg *RegConfig) (consulClientCfg *consulapi.Config) {
+	consulClientCfg = consulapi.DefaultConfig()
+
 	consulClientCfg.WaitTime = time.Duration(regCfg.WaitTime) * time.Second
 	consulClientCfg.Address = regCfg.ConsulAddr
-	utils.ResetServerAddr(&regCfg.HealthCheckAddr, &regCfg.HealthCheckBindAddr)
 	// consulClientCfg.Namespace = regCfg.Namespace // 似乎企业版才支持Namespace
 
 	if "" != regCfg.UserName {
 		consulClientCfg.HttpAuth = &consulapi.HttpBasicAuth{Username: regCfg.UserName, Password: regCfg.Password}
 	}
 
-	for _, handle := range subscribeConfigInitedHandles {
-		handle(regCfg)
-	}
-
-	return
+	return consulClientCfg
 }
 
 // 启动consul健康检查服务，该服务只会启动一次，再有服务注册不会再启动，并且相关服务选项只有第一次注册时指定有效
@@ -223,19 +227,34 @@ func makeHealthCheckHttpServer(regCfg *RegConfig) *http.Server {
 	}
 	jklog.Info("healthCheckHttpServerAddr:", healthCheckHttpServerAddr)
 
-	router := mux.NewRouter()
-	router.Methods("Get").Path("/health").Handler(kithttp.NewServer(
-		makeHealthCheckEndPoint(),
-		decodeHealthCheckRequest,
-		encodeHealthCheckResponse,
-	))
-
 	healthCheckHttpServer = &http.Server{Addr: healthCheckHttpServerAddr}
-	healthCheckHttpServer.Handler = router
+	healthCheckHttpServer.Handler = HealthCheckHandler()
 
 	return healthCheckHttpServer
 }
 
+// 健康检查http处理器，绑定了http服务的服务可以挂载到自己的路由上
+// /health 执行所有检查，/health/live 执行存活检查，/health/ready 执行就绪检查，
+// 检查失败时返回503和各项检查的结果
+func HealthCheckHandler() http.Handler {
+
+	router := mux.NewRouter()
+
+	for path, group := range map[string]string{
+		"/health":       "",
+		"/health/live":  HEALTH_GROUP_LIVENESS,
+		"/health/ready": HEALTH_GROUP_READINESS,
+	} {
+		router.Methods("Get").Path(path).Handler(kithttp.NewServer(
+			makeHealthCheckEndPoint(group),
+			decodeHealthCheckRequest,
+			encodeHealthCheckResponse,
+		))
+	}
+
+	return router
+}
+
 // 异步启动consul健康检查http服务
 func goRunHttpServer(regCfg *RegConfig, httpSvr *http.Server) chan error {
 
@@ -254,7 +273,7 @@ func goRunHttpServer(regCfg *RegConfig, httpSvr *http.Server) chan error {
 }
 
 // 构造consul健康检查频率endpoint
-func makeHealthCheckEndPoint() endpoint.Endpoint {
+func makeHealthCheckEndPoint(group string) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 
 		healthCheckRateLimit.Wait(ctx)
@@ -263,12 +282,18 @@ func makeHealthCheckEndPoint() endpoint.Endpoint {
 		// req.ParseForm()
 		// jklog.Debugw("consel HealthCheck", "host", req.RemoteAddr)
 
-		return HealthCheckResponse{status: 1}, nil
+		return RunHealthChecks(ctx, group), nil
 	}
 }
 
 func encodeHealthCheckResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+
+	// 非2xx状态码consul会将服务标记为critical
+	if resp, ok := response.(HealthCheckResponse); ok && consulapi.HealthPassing != resp.Status {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
 	return json.NewEncoder(w).Encode(response)
 }
 
@@ -289,15 +314,12 @@ func makeConsulAgentServiceRegistration(name, svcHost string, svcPort int, regCf
 		DeregisterCriticalServiceAfter: strconv.Itoa(regCfg.DeregisterCriticalServiceAfter) + "m",
 	}
 
-	if 0 == svcPort {
-		hostCheckUrl, port, _ := unet.ParseHostAddr(healthCheckHttpServerAddr)
-		if "" == hostCheckUrl {
-			hostCheckUrl = svcHost
-		}
-		hostCheckUrl = hostCheckUrl + ":" + strconv.Itoa(port)
-		asCheck.HTTP = "http://" + hostCheckUrl + "/health"
-
-		jklog.Infow("health check info", "hostCheckUrl", hostCheckUrl, "svchost", svcHost, "svcPort", svcPort)
+	if regCfg.TTLCheck > 0 {
+		asCheck.TTL = strconv.Itoa(regCfg.TTLCheck) + "s"
+		asCheck.Interval = ""
+		asCheck.Timeout = ""
+	} else if 0 == svcPort {
+		asCheck.HTTP = makeHealthCheckUrl(svcHost, svcPort)
 	} else {
 		asCheck.TCP = regCfg.ServerAddr
 	}
@@ -313,12 +335,40 @@ func makeConsulAgentServiceRegistration(name, svcHost string, svcPort int, regCf
 	regObj.Address = svcHost
 	regObj.Port = svcPort
 	regObj.Check = &asCheck
+	regObj.Meta = regCfg.Meta
+
+	// 绑定了服务端口时，tcp检查服务端口，http检查执行 AddHealthCheck 添加的检查
+	if 0 != svcPort && regCfg.HTTPHealthCheck {
+		httpCheck := asCheck
+		httpCheck.CheckID = "check_http_" + id
+		httpCheck.TCP = ""
+		httpCheck.HTTP = makeHealthCheckUrl(svcHost, svcPort)
+		regObj.Checks = consulapi.AgentServiceChecks{&httpCheck}
+	}
+
+	if regCfg.Weight > 0 {
+		regObj.Weights = &consulapi.AgentWeights{Passing: regCfg.Weight, Warning: 1}
+	}
 
 	return regObj
 }
 
+// consul健康检查服务的url
+func makeHealthCheckUrl(svcHost string, svcPort int) string {
+
+	hostCheckUrl, port, _ := unet.ParseHostAddr(healthCheckHttpServerAddr)
+	if "" == hostCheckUrl {
+		hostCheckUrl = svcHost
+	}
+	hostCheckUrl = hostCheckUrl + ":" + strconv.Itoa(port)
+
+	jklog.Infow("health check info", "hostCheckUrl", hostCheckUrl, "svchost", svcHost, "svcPort", svcPort)
+
+	return "http://" + hostCheckUrl + "/health"
+}
+
 // 缓存consul_client对象，避免重复创建
-func pushConsulReg(consulAddr string, consulClient kitcosul.Client) {
+func pushConsulReg(consulAddr string, consulClient *consulapi.Client) {
 	mapConsulRegRWMutex.Lock()
 	defer mapConsulRegRWMutex.Unlock()
 
@@ -326,7 +376,7 @@ func pushConsulReg(consulAddr string, consulClient kitcosul.Client) {
 }
 
 // 从缓存中获取consul_client对象
-func getConsulReg(consulAddr string) kitcosul.Client {
+func getConsulReg(consulAddr string) *consulapi.Client {
 	mapConsulRegRWMutex.RLock()
 	defer mapConsulRegRWMutex.RUnlock()
 
@@ -337,20 +387,63 @@ func getConsulReg(consulAddr string) kitcosul.Client {
 	return nil
 }
 
-// 发现服务
+// 发现服务，返回包含全部tags(WithTags)，满足过滤表达式(WithFilter)和过滤函数(WithInstanceFilter)的服务实例
 // Parameters :
 // service:服务名称
 // ops:服务注册选项，后面的选项会替换前面的选项
 func Services(service string, ops ...RegOption) ([]*consulapi.ServiceEntry, *consulapi.QueryMeta, error) {
 
-	consulClient, regCfg, err := newConsulClient(service, ops...)
+	backend, regCfg, err := newBackend(service, ops...)
 	if nil != err {
 		return nil, nil, err
 	}
 
-	if len(regCfg.ConsulTags) > 0 {
-		return consulClient.Service(service, regCfg.ConsulTags[0], regCfg.PassingOnly, regCfg.QueryOpts)
+	filter := newEntryFilter(regCfg.ConsulTags, regCfg.Filter, regCfg.filters)
+
+	// 与服务实例监听器一样，本地数据中心健康的服务实例少于阈值时按顺序使用远程数据中心，
+	// 都少于阈值时使用第一个有服务实例的数据中心
+	// 数据中心出错时跳过，全部出错时返回最后一个错误
+	var chosen []*consulapi.ServiceEntry
+	var chosenMeta *consulapi.QueryMeta
+	var lastErr error
+
+	for _, datacenter := range append([]string{regCfg.Datacenter}, regCfg.FailoverDatacenters...) {
+
+		queryOpts := filter.queryOptions(regCfg.QueryOpts)
+		if "" != datacenter {
+			queryOpts.Datacenter = datacenter
+		}
+
+		entries, meta, err := backend.Service(service, filter.queryTag(), regCfg.PassingOnly, queryOpts)
+		if nil != err {
+			jklog.Errorw("Services fail", "service", service, "datacenter", datacenter, "err", err)
+			lastErr = err
+			continue
+		}
+
+		entries = filter.filter(entries)
+		if countHealthy(entries) >= regCfg.FailoverThreshold {
+			return entries, meta, nil
+		}
+
+		if nil == chosenMeta || (0 == len(chosen) && len(entries) > 0) {
+			chosen, chosenMeta = entries, meta
+		}
 	}
 
-	return consulClient.Service(service, "", regCfg.PassingOnly, regCfg.QueryOpts)
+	if nil == chosenMeta {
+		return nil, nil, lastErr
+	}
+
+	return chosen, chosenMeta, nil
+}
+
+func countHealthy(entries []*consulapi.ServiceEntry) int {
+	n := 0
+	for _, entry := range entries {
+		if consulapi.HealthPassing == entry.Checks.AggregatedStatus() {
+			n++
+		}
+	}
+	return n
 }
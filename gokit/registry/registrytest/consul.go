@@ -0,0 +1,758 @@
+// Package registrytest 内存中的consul http api，用于不依赖真实consul的集成测试。
+//
+// 支持 consulapi 和服务实例监听器用到的接口：agent服务注册、注销、健康检查更新和维护模式，
+// health、catalog服务查询，dc参数，tag、passing参数，部分过滤表达式，以及 X-Consul-Index 阻塞查询。
+// 不会执行tcp/http健康检查，注册时这类检查为passing，TTL检查为critical，可以通过 SetHealth 修改。
+//
+//	consul := registrytest.NewConsul()
+//	defer consul.Close()
+//
+//	registry.RegistryServer("hello", registry.WithConsulAddr(consul.Addr()))
+package registrytest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	DEFAULT_DATACENTER = "dc1"
+	DEFAULT_NODE       = "registrytest"
+
+	defaultWait = 5 * time.Minute  // 阻塞查询默认等待时间，与consul相同
+	maxWait     = 10 * time.Minute // 阻塞查询最长等待时间，与consul相同
+)
+
+type Option func(c *Consul)
+
+// 本地数据中心，agent接口注册的服务在该数据中心，默认dc1
+func WithDatacenter(datacenter string) Option {
+	return func(c *Consul) {
+		c.datacenter = datacenter
+	}
+}
+
+// 节点名称，默认registrytest
+func WithNode(node string) Option {
+	return func(c *Consul) {
+		c.node = node
+	}
+}
+
+// 内存中的consul，每个数据中心只有一个节点
+type Consul struct {
+	*httptest.Server
+
+	datacenter string
+	node       string
+
+	mt           sync.Mutex
+	index        uint64                         // 每次修改加1
+	changed      chan struct{}                  // 每次修改时关闭，唤醒阻塞查询
+	services     map[string]map[string]*service // 数据中心 -> 服务实例ID -> 服务实例
+	serviceIndex map[string]map[string]uint64   // 数据中心 -> 服务名称 -> 最后修改的index
+	unavailable  map[string]bool                // 不可用的数据中心
+	datacenters  map[string]struct{}            // 已知的数据中心
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+type service struct {
+	svc    *consulapi.AgentService
+	checks []*consulapi.HealthCheck
+}
+
+// 创建并启动内存中的consul
+func NewConsul(ops ...Option) *Consul {
+
+	c := &Consul{
+		datacenter:   DEFAULT_DATACENTER,
+		node:         DEFAULT_NODE,
+		index:        1,
+		changed:      make(chan struct{}),
+		services:     map[string]map[string]*service{},
+		serviceIndex: map[string]map[string]uint64{},
+		unavailable:  map[string]bool{},
+		datacenters:  map[string]struct{}{},
+		quit:         make(chan struct{}),
+	}
+
+	for _, op := range ops {
+		op(c)
+	}
+
+	c.datacenters[c.datacenter] = struct{}{}
+	c.Server = httptest.NewServer(c.Handler())
+
+	return c
+}
+
+// consul地址，host:port，用于 registry.WithConsulAddr
+func (c *Consul) Addr() string {
+	return c.Listener.Addr().String()
+}
+
+// 关闭服务，正在等待的阻塞查询立即返回
+func (c *Consul) Close() {
+	c.closeOnce.Do(func() {
+		close(c.quit)
+		c.Server.Close()
+	})
+}
+
+// 当前index
+func (c *Consul) Index() uint64 {
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	return c.index
+}
+
+// 在指定数据中心注册服务实例，用于准备远程数据中心的服务实例，datacenter为空时为本地数据中心
+func (c *Consul) Register(datacenter string, reg *consulapi.AgentServiceRegistration) {
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	c.register(c.dc(datacenter), reg)
+}
+
+// 在指定数据中心注销服务实例，服务实例不存在时返回false
+func (c *Consul) Deregister(datacenter, id string) bool {
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	return c.deregister(c.dc(datacenter), id)
+}
+
+// 修改所有数据中心中服务实例的健康检查状态(维护模式除外)，没有健康检查时添加 service:ID 检查，服务实例不存在时返回false
+func (c *Consul) SetHealth(id, status string) bool {
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	found := false
+	for dc, services := range c.services {
+		s, ok := services[id]
+		if !ok {
+			continue
+		}
+
+		updated := false
+		for _, check := range s.checks {
+			if !isMaintenance(check) {
+				check.Status = status
+				updated = true
+			}
+		}
+		// 没有健康检查的服务实例添加一个检查
+		if !updated {
+			s.checks = append(s.checks, makeCheck(c.node, s.svc, &consulapi.AgentServiceCheck{Status: status}, 0, 1))
+		}
+		c.modified(dc, s.svc.Service)
+		found = true
+	}
+
+	return found
+}
+
+// 设置数据中心是否不可用，不可用时查询该数据中心返回500
+func (c *Consul) SetUnavailable(datacenter string, unavailable bool) {
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	c.unavailable[c.dc(datacenter)] = unavailable
+	c.datacenters[c.dc(datacenter)] = struct{}{}
+	c.modified("", "")
+}
+
+// consul http api处理器，NewConsul 已经用它启动了服务，也可以挂载到其他服务上
+func (c *Consul) Handler() http.Handler {
+
+	router := mux.NewRouter()
+
+	router.Methods("GET").Path("/v1/agent/self").HandlerFunc(c.agentSelf)
+	router.Methods("GET").Path("/v1/agent/services").HandlerFunc(c.agentServices)
+	router.Methods("GET").Path("/v1/agent/service/{id}").HandlerFunc(c.agentService)
+	router.Methods("PUT").Path("/v1/agent/service/register").HandlerFunc(c.agentRegister)
+	router.Methods("PUT").Path("/v1/agent/service/deregister/{id}").HandlerFunc(c.agentDeregister)
+	router.Methods("PUT").Path("/v1/agent/service/maintenance/{id}").HandlerFunc(c.agentMaintenance)
+	router.Methods("PUT").Path("/v1/agent/check/update/{id}").HandlerFunc(c.agentCheckUpdate)
+	router.Methods("PUT").Path("/v1/agent/check/{status:pass|warn|fail}/{id}").HandlerFunc(c.agentCheckUpdate)
+	router.Methods("GET").Path("/v1/health/service/{service}").HandlerFunc(c.healthService)
+	router.Methods("GET").Path("/v1/catalog/datacenters").HandlerFunc(c.catalogDatacenters)
+	router.Methods("GET").Path("/v1/catalog/services").HandlerFunc(c.catalogServices)
+	router.Methods("GET").Path("/v1/catalog/service/{service}").HandlerFunc(c.catalogService)
+	router.Methods("GET").Path("/v1/status/leader").HandlerFunc(c.statusLeader)
+
+	return router
+}
+
+func (c *Consul) agentSelf(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]map[string]interface{}{
+		"Config": {"Datacenter": c.datacenter, "NodeName": c.node},
+	})
+}
+
+func (c *Consul) agentServices(w http.ResponseWriter, r *http.Request) {
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	services := map[string]*consulapi.AgentService{}
+	for id, s := range c.services[c.datacenter] {
+		services[id] = s.svc
+	}
+
+	writeJSON(w, services)
+}
+
+func (c *Consul) agentService(w http.ResponseWriter, r *http.Request) {
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	s, ok := c.services[c.datacenter][mux.Vars(r)["id"]]
+	if !ok {
+		http.Error(w, "unknown service ID", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, s.svc)
+}
+
+func (c *Consul) agentRegister(w http.ResponseWriter, r *http.Request) {
+
+	reg := &consulapi.AgentServiceRegistration{}
+	if err := json.NewDecoder(r.Body).Decode(reg); nil != err {
+		http.Error(w, "Request decode failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if "" == reg.Name {
+		http.Error(w, "Missing service name", http.StatusBadRequest)
+		return
+	}
+
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	c.register(c.datacenter, reg)
+}
+
+func (c *Consul) agentDeregister(w http.ResponseWriter, r *http.Request) {
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	if !c.deregister(c.datacenter, mux.Vars(r)["id"]) {
+		http.Error(w, "Unknown service ID", http.StatusNotFound)
+	}
+}
+
+// 与consul一样，维护模式通过添加一个critical的 _service_maintenance:ID 检查实现
+func (c *Consul) agentMaintenance(w http.ResponseWriter, r *http.Request) {
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	id := mux.Vars(r)["id"]
+	s, ok := c.services[c.datacenter][id]
+	if !ok {
+		http.Error(w, "Unknown service ID", http.StatusNotFound)
+		return
+	}
+
+	enable, err := strconv.ParseBool(r.URL.Query().Get("enable"))
+	if nil != err {
+		http.Error(w, "Missing value for enable", http.StatusBadRequest)
+		return
+	}
+
+	checks := make([]*consulapi.HealthCheck, 0, len(s.checks)+1)
+	for _, check := range s.checks {
+		if !isMaintenance(check) {
+			checks = append(checks, check)
+		}
+	}
+
+	if enable {
+		reason := r.URL.Query().Get("reason")
+		if "" == reason {
+			reason = "Maintenance mode is enabled for this service, but no reason was provided. This is a default message."
+		}
+		checks = append(checks, &consulapi.HealthCheck{
+			Node:        c.node,
+			CheckID:     consulapi.ServiceMaintPrefix + id,
+			Name:        "Service Maintenance Mode",
+			Status:      consulapi.HealthCritical,
+			Notes:       reason,
+			ServiceID:   id,
+			ServiceName: s.svc.Service,
+		})
+	}
+
+	s.checks = checks
+	c.modified(c.datacenter, s.svc.Service)
+}
+
+func (c *Consul) agentCheckUpdate(w http.ResponseWriter, r *http.Request) {
+
+	status, output := "", r.URL.Query().Get("note")
+	switch mux.Vars(r)["status"] {
+	case "pass":
+		status = consulapi.HealthPassing
+	case "warn":
+		status = consulapi.HealthWarning
+	case "fail":
+		status = consulapi.HealthCritical
+	default:
+		update := struct{ Status, Output string }{}
+		if err := json.NewDecoder(r.Body).Decode(&update); nil != err {
+			http.Error(w, "Request decode failed: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		status, output = update.Status, update.Output
+	}
+
+	switch status {
+	case consulapi.HealthPassing, consulapi.HealthWarning, consulapi.HealthCritical:
+	default:
+		http.Error(w, "Invalid check status: \""+status+"\"", http.StatusBadRequest)
+		return
+	}
+
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	id := mux.Vars(r)["id"]
+	for _, s := range c.services[c.datacenter] {
+		for _, check := range s.checks {
+			if id == check.CheckID {
+				check.Status = status
+				check.Output = output
+				c.modified(c.datacenter, s.svc.Service)
+				return
+			}
+		}
+	}
+
+	http.Error(w, "Unknown check ID \""+id+"\"", http.StatusNotFound)
+}
+
+func (c *Consul) healthService(w http.ResponseWriter, r *http.Request) {
+
+	name := mux.Vars(r)["service"]
+	query := r.URL.Query()
+
+	eval, err := newEvaluator(query.Get("filter"))
+	if nil != err {
+		http.Error(w, "Failed to create boolean expression evaluator: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dc, ok := c.queryDatacenter(w, r)
+	if !ok {
+		return
+	}
+
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	index := c.block(r, func() uint64 { return c.serviceIndex[dc][name] })
+
+	_, passing := query["passing"]
+	entries := []*consulapi.ServiceEntry{}
+	for _, s := range c.sortedServices(dc) {
+		if name != s.svc.Service || !hasTags(s.svc.Tags, query["tag"]) {
+			continue
+		}
+
+		entry := c.makeEntry(dc, s)
+		if passing && consulapi.HealthPassing != entry.Checks.AggregatedStatus() {
+			continue
+		}
+		if eval.match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+
+	writeIndex(w, index)
+	writeJSON(w, entries)
+}
+
+func (c *Consul) catalogDatacenters(w http.ResponseWriter, r *http.Request) {
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	datacenters := make([]string, 0, len(c.datacenters))
+	for dc := range c.datacenters {
+		datacenters = append(datacenters, dc)
+	}
+	sort.Strings(datacenters)
+
+	writeJSON(w, datacenters)
+}
+
+func (c *Consul) catalogServices(w http.ResponseWriter, r *http.Request) {
+
+	dc, ok := c.queryDatacenter(w, r)
+	if !ok {
+		return
+	}
+
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	index := c.block(r, func() uint64 { return c.index })
+
+	services := map[string][]string{}
+	for _, s := range c.services[dc] {
+		tags := services[s.svc.Service]
+		if nil == tags {
+			tags = []string{}
+		}
+		for _, tag := range s.svc.Tags {
+			if !hasTags(tags, []string{tag}) {
+				tags = append(tags, tag)
+			}
+		}
+		services[s.svc.Service] = tags
+	}
+
+	writeIndex(w, index)
+	writeJSON(w, services)
+}
+
+func (c *Consul) catalogService(w http.ResponseWriter, r *http.Request) {
+
+	name := mux.Vars(r)["service"]
+
+	dc, ok := c.queryDatacenter(w, r)
+	if !ok {
+		return
+	}
+
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	index := c.block(r, func() uint64 { return c.serviceIndex[dc][name] })
+
+	services := []*consulapi.CatalogService{}
+	for _, s := range c.sortedServices(dc) {
+		if name != s.svc.Service || !hasTags(s.svc.Tags, r.URL.Query()["tag"]) {
+			continue
+		}
+
+		services = append(services, &consulapi.CatalogService{
+			Node:           c.node,
+			Address:        "127.0.0.1",
+			Datacenter:     dc,
+			ServiceID:      s.svc.ID,
+			ServiceName:    s.svc.Service,
+			ServiceAddress: s.svc.Address,
+			ServiceTags:    s.svc.Tags,
+			ServiceMeta:    s.svc.Meta,
+			ServicePort:    s.svc.Port,
+			ServiceWeights: consulapi.Weights{Passing: s.svc.Weights.Passing, Warning: s.svc.Weights.Warning},
+		})
+	}
+
+	writeIndex(w, index)
+	writeJSON(w, services)
+}
+
+func (c *Consul) statusLeader(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, "127.0.0.1:8300")
+}
+
+// 查询的数据中心，数据中心未知或不可用时返回500
+func (c *Consul) queryDatacenter(w http.ResponseWriter, r *http.Request) (string, bool) {
+	c.mt.Lock()
+	defer c.mt.Unlock()
+
+	dc := c.dc(r.URL.Query().Get("dc"))
+
+	if _, ok := c.datacenters[dc]; !ok || c.unavailable[dc] {
+		http.Error(w, "No path to datacenter", http.StatusInternalServerError)
+		return "", false
+	}
+
+	return dc, true
+}
+
+// 阻塞查询：请求带index参数时，等待到index函数的返回值大于请求的index或超时，
+// 调用时需要持有锁，等待时释放锁，返回index函数的返回值(至少为1)
+func (c *Consul) block(r *http.Request, index func() uint64) uint64 {
+
+	current := func() uint64 {
+		if i := index(); i > 0 {
+			return i
+		}
+		return 1
+	}
+
+	waitIndex, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if 0 == waitIndex || current() > waitIndex {
+		return current()
+	}
+
+	wait := defaultWait
+	if d, err := time.ParseDuration(r.URL.Query().Get("wait")); nil == err && d > 0 {
+		wait = d
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for current() <= waitIndex {
+		changed := c.changed
+
+		c.mt.Unlock()
+		select {
+		case <-changed:
+			c.mt.Lock()
+		case <-timer.C:
+			c.mt.Lock()
+			return current()
+		case <-r.Context().Done():
+			c.mt.Lock()
+			return current()
+		case <-c.quit:
+			c.mt.Lock()
+			return current()
+		}
+	}
+
+	return current()
+}
+
+// 注册服务实例，已存在的检查保持原来的状态
+func (c *Consul) register(dc string, reg *consulapi.AgentServiceRegistration) {
+
+	if nil == c.services[dc] {
+		c.services[dc] = map[string]*service{}
+	}
+	c.datacenters[dc] = struct{}{}
+
+	id := reg.ID
+	if "" == id {
+		id = reg.Name
+	}
+
+	svc := &consulapi.AgentService{
+		ID:         id,
+		Service:    reg.Name,
+		Tags:       reg.Tags,
+		Meta:       reg.Meta,
+		Port:       reg.Port,
+		Address:    reg.Address,
+		Weights:    consulapi.AgentWeights{Passing: 1, Warning: 1},
+		Datacenter: dc,
+	}
+	if nil == svc.Tags {
+		svc.Tags = []string{}
+	}
+	if nil == svc.Meta {
+		svc.Meta = map[string]string{}
+	}
+	if nil != reg.Weights {
+		svc.Weights = *reg.Weights
+	}
+
+	previous := map[string]*consulapi.HealthCheck{}
+	if old, ok := c.services[dc][id]; ok {
+		for _, check := range old.checks {
+			previous[check.CheckID] = check
+		}
+		if old.svc.Service != reg.Name {
+			c.modified(dc, old.svc.Service)
+		}
+	}
+
+	regChecks := reg.Checks
+	if nil != reg.Check {
+		regChecks = append(consulapi.AgentServiceChecks{reg.Check}, regChecks...)
+	}
+
+	checks := make([]*consulapi.HealthCheck, 0, len(regChecks))
+	for i, regCheck := range regChecks {
+		check := makeCheck(c.node, svc, regCheck, i, len(regChecks))
+		if prev, ok := previous[check.CheckID]; ok && "" == regCheck.Status {
+			check.Status, check.Output = prev.Status, prev.Output
+		}
+		checks = append(checks, check)
+	}
+	if maint, ok := previous[consulapi.ServiceMaintPrefix+id]; ok {
+		checks = append(checks, maint)
+	}
+
+	c.services[dc][id] = &service{svc: svc, checks: checks}
+	c.modified(dc, reg.Name)
+}
+
+func (c *Consul) deregister(dc, id string) bool {
+
+	s, ok := c.services[dc][id]
+	if !ok {
+		return false
+	}
+
+	delete(c.services[dc], id)
+	c.modified(dc, s.svc.Service)
+
+	return true
+}
+
+// 修改后增加index并唤醒阻塞查询，name不为空时记录服务最后修改的index
+func (c *Consul) modified(dc, name string) {
+
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+
+	if "" == name {
+		return
+	}
+
+	if nil == c.serviceIndex[dc] {
+		c.serviceIndex[dc] = map[string]uint64{}
+	}
+	c.serviceIndex[dc][name] = c.index
+}
+
+func (c *Consul) dc(datacenter string) string {
+	if "" == datacenter {
+		return c.datacenter
+	}
+
+	return datacenter
+}
+
+// 按服务实例ID排序，保证每次查询结果顺序相同
+func (c *Consul) sortedServices(dc string) []*service {
+
+	services := make([]*service, 0, len(c.services[dc]))
+	for _, s := range c.services[dc] {
+		services = append(services, s)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].svc.ID < services[j].svc.ID })
+
+	return services
+}
+
+// 构造服务实例，返回副本，避免调用方修改内部状态
+func (c *Consul) makeEntry(dc string, s *service) *consulapi.ServiceEntry {
+
+	svc := *s.svc
+
+	checks := consulapi.HealthChecks{&consulapi.HealthCheck{
+		Node:    c.node,
+		CheckID: "serfHealth",
+		Name:    "Serf Health Status",
+		Status:  consulapi.HealthPassing,
+		Output:  "Agent alive and reachable",
+	}}
+	for _, check := range s.checks {
+		cp := *check
+		checks = append(checks, &cp)
+	}
+
+	return &consulapi.ServiceEntry{
+		Node: &consulapi.Node{
+			ID:         c.node,
+			Node:       c.node,
+			Address:    "127.0.0.1",
+			Datacenter: dc,
+		},
+		Service: &svc,
+		Checks:  checks,
+	}
+}
+
+// 与consul一样，未指定CheckID时一个检查为 service:ID，多个检查为 service:ID:序号；
+// TTL检查初始状态为critical，不会执行的tcp/http等检查初始状态为passing
+func makeCheck(node string, svc *consulapi.AgentService, regCheck *consulapi.AgentServiceCheck, i, count int) *consulapi.HealthCheck {
+
+	id := regCheck.CheckID
+	if "" == id {
+		id = "service:" + svc.ID
+		if count > 1 {
+			id += ":" + strconv.Itoa(i+1)
+		}
+	}
+
+	name := regCheck.Name
+	if "" == name {
+		name = "Service '" + svc.Service + "' check"
+	}
+
+	status := regCheck.Status
+	if "" == status {
+		status = consulapi.HealthPassing
+		if "" != regCheck.TTL {
+			status = consulapi.HealthCritical
+		}
+	}
+
+	checkType := "tcp"
+	switch {
+	case "" != regCheck.TTL:
+		checkType = "ttl"
+	case "" != regCheck.HTTP:
+		checkType = "http"
+	case "" != regCheck.GRPC:
+		checkType = "grpc"
+	}
+
+	return &consulapi.HealthCheck{
+		Node:        node,
+		CheckID:     id,
+		Name:        name,
+		Status:      status,
+		Notes:       regCheck.Notes,
+		ServiceID:   svc.ID,
+		ServiceName: svc.Service,
+		ServiceTags: svc.Tags,
+		Type:        checkType,
+	}
+}
+
+func isMaintenance(check *consulapi.HealthCheck) bool {
+	return strings.HasPrefix(check.CheckID, consulapi.ServiceMaintPrefix)
+}
+
+func hasTags(tags, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, tag := range tags {
+			if tag == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+func writeIndex(w http.ResponseWriter, index uint64) {
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", "0")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
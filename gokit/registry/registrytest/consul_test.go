@@ -0,0 +1,183 @@
+package registrytest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jkprj/jkfr/gokit/registry"
+	"github.com/jkprj/jkfr/gokit/registry/registrytest"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+func TestBlockingQuery(t *testing.T) {
+
+	consul := registrytest.NewConsul()
+	defer consul.Close()
+
+	client, err := consulapi.NewClient(&consulapi.Config{Address: consul.Addr()})
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	entries, meta, err := client.Health().Service("hello", "", true, nil)
+	if nil != err || 0 != len(entries) {
+		t.Fatalf("entries: %v, err: %v", entries, err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		consul.Register("", &consulapi.AgentServiceRegistration{ID: "hello_1", Name: "hello", Address: "127.0.0.1", Port: 8080})
+	}()
+
+	begin := time.Now()
+	entries, next, err := client.Health().Service("hello", "", true, &consulapi.QueryOptions{WaitIndex: meta.LastIndex, WaitTime: 5 * time.Second})
+	if nil != err || 1 != len(entries) || next.LastIndex <= meta.LastIndex {
+		t.Fatalf("entries: %v, index: %d, err: %v", entries, next.LastIndex, err)
+	}
+	if time.Since(begin) < 100*time.Millisecond {
+		t.Fatal("query did not block")
+	}
+
+	// 没有变化时等待到超时，返回相同的index
+	_, timeout, err := client.Health().Service("hello", "", true, &consulapi.QueryOptions{WaitIndex: next.LastIndex, WaitTime: 100 * time.Millisecond})
+	if nil != err || timeout.LastIndex != next.LastIndex {
+		t.Fatalf("index: %d, want: %d, err: %v", timeout.LastIndex, next.LastIndex, err)
+	}
+}
+
+func TestRegistryServerAndWatch(t *testing.T) {
+
+	consul := registrytest.NewConsul()
+	defer consul.Close()
+
+	reg, err := registry.RegistryServer("hello", registry.WithConsulAddr(consul.Addr()), registry.WithServerAddr("127.0.0.1:18080"))
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	watcher, err := registry.Watch("hello", registry.WithConsulAddr(consul.Addr()))
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer watcher.Stop()
+
+	waitInstances(t, watcher, 1)
+
+	// 维护模式的服务实例不再是passing
+	if err = reg.Drain("upgrade"); nil != err {
+		t.Fatal(err)
+	}
+	waitInstances(t, watcher, 0)
+
+	if err = reg.Undrain(); nil != err {
+		t.Fatal(err)
+	}
+	waitInstances(t, watcher, 1)
+
+	if err = reg.Close(); nil != err {
+		t.Fatal(err)
+	}
+	waitInstances(t, watcher, 0)
+}
+
+func TestFailoverDatacenter(t *testing.T) {
+
+	consul := registrytest.NewConsul()
+	defer consul.Close()
+
+	consul.Register("", &consulapi.AgentServiceRegistration{ID: "hello_1", Name: "hello", Address: "127.0.0.1", Port: 8080})
+	consul.Register("dc2", &consulapi.AgentServiceRegistration{ID: "hello_2", Name: "hello", Address: "127.0.0.2", Port: 8080})
+
+	ops := []registry.RegOption{registry.WithConsulAddr(consul.Addr()), registry.WithFailoverDatacenters("dc2")}
+
+	watcher, err := registry.Watch("hello", ops...)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer watcher.Stop()
+
+	waitFor(t, watcher, inDatacenter("dc1"))
+
+	consul.SetHealth("hello_1", consulapi.HealthCritical)
+	waitFor(t, watcher, inDatacenter("dc2"))
+
+	entries, _, err := registry.Services("hello", ops...)
+	if nil != err || 1 != len(entries) || "hello_2" != entries[0].Service.ID {
+		t.Fatalf("entries: %v, err: %v", entries, err)
+	}
+
+	consul.SetHealth("hello_1", consulapi.HealthPassing)
+	waitFor(t, watcher, inDatacenter("dc1"))
+
+	// 本地数据中心不可用时也使用远程数据中心
+	consul.SetUnavailable("", true)
+	waitFor(t, watcher, inDatacenter("dc2"))
+
+	entries, _, err = registry.Services("hello", ops...)
+	if nil != err || 1 != len(entries) || "hello_2" != entries[0].Service.ID {
+		t.Fatalf("entries: %v, err: %v", entries, err)
+	}
+
+	consul.SetUnavailable("dc2", true)
+	if _, _, err = registry.Services("hello", ops...); nil == err {
+		t.Fatal("all datacenters unavailable should fail")
+	}
+}
+
+func TestFilter(t *testing.T) {
+
+	consul := registrytest.NewConsul()
+	defer consul.Close()
+
+	consul.Register("", &consulapi.AgentServiceRegistration{ID: "hello_1", Name: "hello", Port: 8080, Tags: []string{"v1"}, Meta: map[string]string{"zone": "a"}})
+	consul.Register("", &consulapi.AgentServiceRegistration{ID: "hello_2", Name: "hello", Port: 8081, Tags: []string{"v2"}, Meta: map[string]string{"zone": "b"}})
+
+	for expr, want := range map[string]int{
+		`Service.Meta.zone == "a"`:                        1,
+		`Service.Meta.zone != "a"`:                        1,
+		`"v2" in Service.Tags and Service.Port == "8081"`: 1,
+		`"v3" not in Service.Tags`:                        2,
+		`Service.Meta.drain is empty`:                     2,
+	} {
+		entries, _, err := registry.Services("hello", registry.WithConsulAddr(consul.Addr()), registry.WithFilter(expr))
+		if nil != err || want != len(entries) {
+			t.Fatalf("expr: %s, entries: %d, want: %d, err: %v", expr, len(entries), want, err)
+		}
+	}
+
+	if _, _, err := registry.Services("hello", registry.WithConsulAddr(consul.Addr()), registry.WithFilter(`Service.Meta.zone == "a" or Service.Port == "1"`)); nil == err {
+		t.Fatal("unsupported filter should fail")
+	}
+}
+
+func waitInstances(t *testing.T, watcher *registry.Watcher, count int) {
+	t.Helper()
+
+	waitFor(t, watcher, func(instances []registry.Instance) bool { return count == len(instances) })
+}
+
+// 等待服务实例满足条件
+func waitFor(t *testing.T, watcher *registry.Watcher, cond func(instances []registry.Instance) bool) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		if cond(watcher.Instances()) {
+			return
+		}
+
+		select {
+		case <-watcher.Events():
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("wait instances timeout, instances: %v", watcher.Instances())
+		}
+	}
+}
+
+func inDatacenter(datacenter string) func(instances []registry.Instance) bool {
+	return func(instances []registry.Instance) bool {
+		return 1 == len(instances) && datacenter == instances[0].Datacenter
+	}
+}
@@ -0,0 +1,211 @@
+package registrytest
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// consul过滤表达式的子集，只支持用and连接的以下条件：
+//
+//	Selector == "value"，Selector != "value"
+//	"value" in Selector，"value" not in Selector
+//	Selector contains "value"，Selector not contains "value"
+//	Selector is empty，Selector is not empty
+//
+// Selector 支持 Service.ID，Service.Service，Service.Address，Service.Port，Service.Tags，
+// Service.Meta，Service.Meta.<key>，Node.Node，Node.Address，Node.Datacenter
+type evaluator []condition
+
+type condition struct {
+	selector string
+	op       string
+	value    string
+	not      bool
+}
+
+func newEvaluator(expr string) (evaluator, error) {
+
+	tokens, err := tokenize(expr)
+	if nil != err {
+		return nil, err
+	}
+
+	eval := evaluator{}
+	for len(tokens) > 0 {
+		cond, n, err := parseCondition(tokens)
+		if nil != err {
+			return nil, err
+		}
+		if !validSelector(cond.selector) {
+			return nil, errors.New("unsupported selector: " + cond.selector)
+		}
+		eval = append(eval, cond)
+		tokens = tokens[n:]
+
+		if len(tokens) > 0 {
+			if "and" != tokens[0].text || tokens[0].quoted {
+				return nil, errors.New("only 'and' is supported, got: " + tokens[0].text)
+			}
+			tokens = tokens[1:]
+			if 0 == len(tokens) {
+				return nil, errors.New("missing condition after 'and'")
+			}
+		}
+	}
+
+	return eval, nil
+}
+
+type token struct {
+	text   string
+	quoted bool
+}
+
+func tokenize(expr string) ([]token, error) {
+
+	tokens := []token{}
+	fields := strings.Fields(expr)
+
+	for i := 0; i < len(fields); i++ {
+		field := fields[i]
+		if !strings.HasPrefix(field, "\"") && !strings.HasPrefix(field, "`") {
+			tokens = append(tokens, token{text: field})
+			continue
+		}
+
+		// 带空格的字符串值
+		quote := field[:1]
+		for !(len(field) > 1 && strings.HasSuffix(field, quote)) {
+			i++
+			if i >= len(fields) {
+				return nil, errors.New("unterminated string: " + field)
+			}
+			field += " " + fields[i]
+		}
+
+		value := field[1 : len(field)-1]
+		if "\"" == quote {
+			var err error
+			if value, err = strconv.Unquote(field); nil != err {
+				return nil, err
+			}
+		}
+		tokens = append(tokens, token{text: value, quoted: true})
+	}
+
+	return tokens, nil
+}
+
+// 解析一个条件，返回使用的token数
+func parseCondition(tokens []token) (condition, int, error) {
+
+	texts := make([]string, 0, 4)
+	for i := 0; i < len(tokens) && i < 4; i++ {
+		text := tokens[i].text
+		if tokens[i].quoted {
+			text = "\"\""
+		}
+		texts = append(texts, text)
+	}
+
+	switch {
+	case len(texts) >= 3 && ("==" == texts[1] || "!=" == texts[1]):
+		return condition{selector: tokens[0].text, op: "==", value: tokens[2].text, not: "!=" == texts[1]}, 3, nil
+	case len(texts) >= 3 && "in" == texts[1]:
+		return condition{selector: tokens[2].text, op: "in", value: tokens[0].text}, 3, nil
+	case len(texts) >= 4 && "not" == texts[1] && "in" == texts[2]:
+		return condition{selector: tokens[3].text, op: "in", value: tokens[0].text, not: true}, 4, nil
+	case len(texts) >= 3 && "contains" == texts[1]:
+		return condition{selector: tokens[0].text, op: "in", value: tokens[2].text}, 3, nil
+	case len(texts) >= 4 && "not" == texts[1] && "contains" == texts[2]:
+		return condition{selector: tokens[0].text, op: "in", value: tokens[3].text, not: true}, 4, nil
+	case len(texts) >= 3 && "is" == texts[1] && "empty" == texts[2]:
+		return condition{selector: tokens[0].text, op: "empty"}, 3, nil
+	case len(texts) >= 4 && "is" == texts[1] && "not" == texts[2] && "empty" == texts[3]:
+		return condition{selector: tokens[0].text, op: "empty", not: true}, 4, nil
+	}
+
+	return condition{}, 0, errors.New("unsupported condition: " + strings.Join(texts, " "))
+}
+
+func (eval evaluator) match(entry *consulapi.ServiceEntry) bool {
+	for _, cond := range eval {
+		if cond.match(entry) == cond.not {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (cond condition) match(entry *consulapi.ServiceEntry) bool {
+
+	scalar, collection, isCollection := selectValue(entry, cond.selector)
+
+	switch cond.op {
+	case "==":
+		return !isCollection && scalar == cond.value
+	case "in":
+		if !isCollection {
+			return strings.Contains(scalar, cond.value)
+		}
+		return hasTags(collection, []string{cond.value})
+	case "empty":
+		if !isCollection {
+			return "" == scalar
+		}
+		return 0 == len(collection)
+	}
+
+	return false
+}
+
+func validSelector(selector string) bool {
+	switch selector {
+	case "Service.ID", "Service.Service", "Service.Address", "Service.Port", "Service.Tags", "Service.Meta",
+		"Node.Node", "Node.Address", "Node.Datacenter":
+		return true
+	}
+
+	return strings.HasPrefix(selector, "Service.Meta.")
+}
+
+// 选择器的值，Service.Tags 和 Service.Meta(键) 为集合
+func selectValue(entry *consulapi.ServiceEntry, selector string) (string, []string, bool) {
+
+	svc, node := entry.Service, entry.Node
+
+	switch selector {
+	case "Service.ID":
+		return svc.ID, nil, false
+	case "Service.Service":
+		return svc.Service, nil, false
+	case "Service.Address":
+		return svc.Address, nil, false
+	case "Service.Port":
+		return strconv.Itoa(svc.Port), nil, false
+	case "Service.Tags":
+		return "", svc.Tags, true
+	case "Service.Meta":
+		keys := make([]string, 0, len(svc.Meta))
+		for key := range svc.Meta {
+			keys = append(keys, key)
+		}
+		return "", keys, true
+	case "Node.Node":
+		return node.Node, nil, false
+	case "Node.Address":
+		return node.Address, nil, false
+	case "Node.Datacenter":
+		return node.Datacenter, nil, false
+	}
+
+	if strings.HasPrefix(selector, "Service.Meta.") {
+		return svc.Meta[strings.TrimPrefix(selector, "Service.Meta.")], nil, false
+	}
+
+	return "", nil, false
+}
@@ -0,0 +1,87 @@
+package registry
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	jkos "github.com/jkprj/jkfr/os"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// 服务发现快照，保存最后一次从注册中心获取的服务实例，注册中心不可用时启动使用
+type discoverySnapshot struct {
+	Service string                    `json:"service"`
+	Tags    []string                  `json:"tags,omitempty"`
+	Filter  string                    `json:"filter,omitempty"`
+	Time    time.Time                 `json:"time"`
+	Entries []*consulapi.ServiceEntry `json:"entries"`
+}
+
+// 快照文件路径，不同数据中心、tags、过滤表达式和passingOnly发现的服务实例不同，分别保存
+func snapshotFile(dir, service, datacenter string, filter entryFilter, passingOnly bool) string {
+	if "" == dir {
+		return ""
+	}
+
+	name := strings.Join(append([]string{service}, filter.tags...), "_")
+	if "" != datacenter {
+		name = datacenter + "_" + name
+	}
+	if key := filter.key(); "" != key {
+		name += "_" + key
+	}
+	if !passingOnly {
+		name += "_all"
+	}
+	name = strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(name)
+
+	return filepath.Join(dir, name+".json")
+}
+
+// 先写临时文件再改名，避免进程退出时留下不完整的快照
+func saveSnapshot(file string, snap discoverySnapshot) error {
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if nil != err {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(file), 0755); nil != err {
+		return err
+	}
+
+	// 每次写入使用不同的临时文件，同一服务的多个监听器同时保存时不会互相覆盖
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if nil != err {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // rename成功后文件已不存在
+
+	_, err = tmp.Write(data)
+	if nil == err {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); nil == err {
+		err = closeErr
+	}
+	if nil != err {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+func loadSnapshot(file string) (snap discoverySnapshot, err error) {
+
+	data, err := jkos.ReadFile(file)
+	if nil != err {
+		return snap, err
+	}
+
+	err = json.Unmarshal(data, &snap)
+	return snap, err
+}
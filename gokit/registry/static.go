@@ -0,0 +1,410 @@
+package registry
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	jksd "github.com/jkprj/jkfr/gokit/sd"
+	jklog "github.com/jkprj/jkfr/log"
+	unet "github.com/jkprj/jkfr/net"
+	jkos "github.com/jkprj/jkfr/os"
+
+	"github.com/go-kit/kit/sd"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// 进程内通过 Register 注册到静态后端的服务，key为服务名称，value的key为服务ID
+var staticRegistrations map[string]map[string]*consulapi.AgentServiceRegistration = map[string]map[string]*consulapi.AgentServiceRegistration{}
+var staticRegVersion uint64 = 0
+var staticMaintenance map[string]string = map[string]string{} // 维护模式中的服务ID和原因
+var mtStaticReg sync.RWMutex
+
+// 静态后端，服务实例来自配置文件(StaticInstances)或 WithStaticInstances 选项，
+// 适用于没有consul的部署环境
+type staticBackend struct {
+	optInstances map[string][]string // 运行时指定的服务实例
+	files        []string            // 需要检查变化的配置文件
+	pollInterval time.Duration
+	predicates   []InstanceFilter // 本地过滤函数，静态后端不支持consul过滤表达式
+}
+
+func staticBackendFatory(regCfg *RegConfig) (Backend, error) {
+
+	backend := &staticBackend{
+		optInstances: map[string][]string{},
+		pollInterval: time.Duration(regCfg.StaticPollInterval) * time.Second,
+		predicates:   regCfg.filters,
+	}
+
+	if "" != regCfg.Filter {
+		jklog.Warnw("static registry backend not support consul filter expression, ignored", "name", regCfg.ServerName, "filter", regCfg.Filter)
+	}
+
+	for name, addrs := range regCfg.optInstances {
+		backend.optInstances[name] = addrs
+	}
+
+	if "" != regCfg.ConfigPath {
+		backend.files = append(backend.files, regCfg.ConfigPath)
+	}
+	backend.files = append(backend.files, defaultConfigFiles(regCfg.ServerName)...)
+
+	if backend.pollInterval <= 0 {
+		backend.pollInterval = 5 * time.Second
+	}
+
+	return backend, nil
+}
+
+// 注册服务，只在当前进程内有效
+func (sb *staticBackend) Register(r *consulapi.AgentServiceRegistration) error {
+	mtStaticReg.Lock()
+	defer mtStaticReg.Unlock()
+
+	regs, ok := staticRegistrations[r.Name]
+	if !ok {
+		regs = map[string]*consulapi.AgentServiceRegistration{}
+		staticRegistrations[r.Name] = regs
+	}
+
+	regs[r.ID] = r
+	staticRegVersion++
+
+	return nil
+}
+
+// 注销服务
+func (sb *staticBackend) Deregister(r *consulapi.AgentServiceRegistration) error {
+	mtStaticReg.Lock()
+	defer mtStaticReg.Unlock()
+
+	if regs, ok := staticRegistrations[r.Name]; ok {
+		delete(regs, r.ID)
+		delete(staticMaintenance, r.ID)
+		staticRegVersion++
+	}
+
+	return nil
+}
+
+// 检查服务是否已注册
+func (sb *staticBackend) IsRegistered(serviceID string) (bool, error) {
+	mtStaticReg.RLock()
+	defer mtStaticReg.RUnlock()
+
+	for _, regs := range staticRegistrations {
+		if _, ok := regs[serviceID]; ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// 进入维护模式，维护模式中的服务不会被发现
+func (sb *staticBackend) EnableServiceMaintenance(serviceID, reason string) error {
+	mtStaticReg.Lock()
+	defer mtStaticReg.Unlock()
+
+	staticMaintenance[serviceID] = reason
+	staticRegVersion++
+
+	return nil
+}
+
+// 退出维护模式
+func (sb *staticBackend) DisableServiceMaintenance(serviceID string) error {
+	mtStaticReg.Lock()
+	defer mtStaticReg.Unlock()
+
+	if _, ok := staticMaintenance[serviceID]; ok {
+		delete(staticMaintenance, serviceID)
+		staticRegVersion++
+	}
+
+	return nil
+}
+
+// 查询服务实例，静态实例没有健康检查，passingOnly无效，与consul一样只按tag过滤
+func (sb *staticBackend) Service(service, tag string, passingOnly bool, queryOpts *consulapi.QueryOptions) ([]*consulapi.ServiceEntry, *consulapi.QueryMeta, error) {
+
+	mtStaticReg.RLock()
+	lastIndex := staticRegVersion
+	mtStaticReg.RUnlock()
+
+	entries := newEntryFilter(makeTags(tag), "", nil).filter(sb.entries(service))
+
+	return entries, &consulapi.QueryMeta{LastIndex: lastIndex}, nil
+}
+
+func (sb *staticBackend) NewInstancer(service string, tags []string, passingOnly bool) sd.Instancer {
+
+	instancer := &staticInstancer{
+		backend:     sb,
+		service:     service,
+		filter:      newEntryFilter(tags, "", sb.predicates),
+		subscribers: map[chan<- sd.Event]struct{}{},
+		quit:        make(chan struct{}),
+	}
+
+	instancer.modTimes, instancer.regVersion = sb.signature()
+	instancer.state = sd.Event{Instances: sb.instances(service, instancer.filter)}
+	instancer.metas = instancer.makeMetas(instancer.state.Instances)
+
+	go instancer.loop()
+
+	return instancer
+}
+
+// 获取服务实例：运行时指定 > 配置文件，再加上进程内注册的服务(带有注册时的tags和元数据)，
+// 按地址排序，同一地址只保留一个服务实例
+func (sb *staticBackend) entries(service string) []*consulapi.ServiceEntry {
+
+	addrs, ok := sb.optInstances[service]
+	addrs = append([]string{}, addrs...)
+	if !ok {
+		fileCfg := new(RegConfig)
+		for _, file := range sb.files {
+			if jkos.IsFileExists(file) {
+				WithFile(file)(fileCfg)
+			}
+		}
+		addrs = append(addrs, fileCfg.StaticInstances[service]...)
+	}
+
+	addr2entry := map[string]*consulapi.ServiceEntry{}
+
+	for _, addr := range addrs {
+		host, port, err := unet.ParseHostAddr(addr)
+		if nil != err {
+			jklog.Warnw("static instance addr invalid", "service", service, "addr", addr, "err", err)
+			continue
+		}
+
+		addr2entry[host+":"+strconv.Itoa(port)] = makeStaticEntry(&consulapi.AgentServiceRegistration{
+			ID:      service + "_" + host + ":" + strconv.Itoa(port),
+			Name:    service,
+			Address: host,
+			Port:    port,
+		})
+	}
+
+	mtStaticReg.RLock()
+	for _, r := range staticRegistrations[service] {
+		if _, ok := staticMaintenance[r.ID]; !ok {
+			addr2entry[r.Address+":"+strconv.Itoa(r.Port)] = makeStaticEntry(r)
+		}
+	}
+	mtStaticReg.RUnlock()
+
+	keys := make([]string, 0, len(addr2entry))
+	for addr := range addr2entry {
+		keys = append(keys, addr)
+	}
+	sort.Strings(keys)
+
+	entries := make([]*consulapi.ServiceEntry, 0, len(keys))
+	for _, addr := range keys {
+		entries = append(entries, addr2entry[addr])
+	}
+
+	return entries
+}
+
+func makeStaticEntry(r *consulapi.AgentServiceRegistration) *consulapi.ServiceEntry {
+
+	entry := &consulapi.ServiceEntry{
+		Node: &consulapi.Node{Node: "static", Address: r.Address},
+		Service: &consulapi.AgentService{
+			ID:      r.ID,
+			Service: r.Name,
+			Tags:    r.Tags,
+			Meta:    r.Meta,
+			Address: r.Address,
+			Port:    r.Port,
+		},
+		Checks: consulapi.HealthChecks{&consulapi.HealthCheck{Status: consulapi.HealthPassing}},
+	}
+
+	if nil != r.Weights {
+		entry.Service.Weights = *r.Weights
+	}
+
+	return entry
+}
+
+// 获取过滤后的服务实例地址列表
+func (sb *staticBackend) instances(service string, filter entryFilter) []string {
+
+	entries := filter.filter(sb.entries(service))
+
+	addrs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		addrs = append(addrs, entry.Service.Address+":"+strconv.Itoa(entry.Service.Port))
+	}
+
+	return addrs
+}
+
+// 配置文件修改时间和进程内注册版本，用于判断服务实例是否可能发生变化
+func (sb *staticBackend) signature() (modTimes []int64, regVersion uint64) {
+
+	modTimes = make([]int64, len(sb.files))
+	for i, file := range sb.files {
+		if info, err := os.Stat(file); nil == err {
+			modTimes[i] = info.ModTime().UnixNano()
+		}
+	}
+
+	mtStaticReg.RLock()
+	regVersion = staticRegVersion
+	mtStaticReg.RUnlock()
+
+	return modTimes, regVersion
+}
+
+// 静态后端的服务实例监听器，定时检查配置文件和进程内注册的变化，
+// 有变化时与 kitconsul.Instancer 一样通知订阅者
+type staticInstancer struct {
+	backend *staticBackend
+	service string
+	filter  entryFilter
+
+	modTimes   []int64
+	regVersion uint64
+
+	mt          sync.RWMutex
+	state       sd.Event
+	metas       map[string]jksd.InstanceMeta
+	subscribers map[chan<- sd.Event]struct{}
+
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+func (si *staticInstancer) loop() {
+
+	ticker := time.NewTicker(si.backend.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			modTimes, regVersion := si.backend.signature()
+			if regVersion == si.regVersion && reflect.DeepEqual(modTimes, si.modTimes) {
+				continue
+			}
+
+			si.modTimes, si.regVersion = modTimes, regVersion
+			si.update(sd.Event{Instances: si.backend.instances(si.service, si.filter)})
+
+		case <-si.quit:
+			return
+		}
+	}
+}
+
+// 更新服务实例，服务实例或元数据(如进程内注册更新了tags)有变化时通知订阅者
+func (si *staticInstancer) update(event sd.Event) {
+
+	metas := si.makeMetas(event.Instances)
+
+	si.mt.Lock()
+	defer si.mt.Unlock()
+
+	if reflect.DeepEqual(si.state, event) && reflect.DeepEqual(si.metas, metas) {
+		return
+	}
+
+	jklog.Infow("static instances changed", "service", si.service, "instances", event.Instances)
+
+	si.state = event
+	si.metas = metas
+	for ch := range si.subscribers {
+		ch <- event
+	}
+}
+
+// Register 订阅服务变化，订阅时会先推送当前服务实例
+func (si *staticInstancer) Register(ch chan<- sd.Event) {
+	si.mt.Lock()
+	defer si.mt.Unlock()
+
+	si.subscribers[ch] = struct{}{}
+	ch <- si.state
+}
+
+// InstanceMeta 获取进程内注册的服务实例的权重和元数据，配置的静态实例没有元数据
+func (si *staticInstancer) InstanceMeta(instance string) (jksd.InstanceMeta, bool) {
+	mtStaticReg.RLock()
+	defer mtStaticReg.RUnlock()
+
+	for _, r := range staticRegistrations[si.service] {
+		if r.Address+":"+strconv.Itoa(r.Port) == instance {
+			meta := jksd.InstanceMeta{ID: r.ID, Tags: r.Tags, Meta: r.Meta, Health: consulapi.HealthPassing}
+			if nil != r.Weights {
+				meta.Weight = r.Weights.Passing
+			}
+			return meta, true
+		}
+	}
+
+	return jksd.InstanceMeta{}, false
+}
+
+func (si *staticInstancer) makeMetas(instances []string) map[string]jksd.InstanceMeta {
+
+	metas := make(map[string]jksd.InstanceMeta, len(instances))
+	for _, instance := range instances {
+		if meta, ok := si.InstanceMeta(instance); ok {
+			metas[instance] = meta
+		}
+	}
+
+	return metas
+}
+
+// Deregister 取消订阅
+func (si *staticInstancer) Deregister(ch chan<- sd.Event) {
+	si.mt.Lock()
+	defer si.mt.Unlock()
+
+	delete(si.subscribers, ch)
+}
+
+// Stop 停止检查服务变化
+func (si *staticInstancer) Stop() {
+	si.quitOnce.Do(func() {
+		close(si.quit)
+	})
+}
+
+func makeTags(tag string) []string {
+	if "" == tag {
+		return nil
+	}
+
+	return []string{tag}
+}
+
+func hasTags(tags, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, t := range tags {
+			if t == w {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
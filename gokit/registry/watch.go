@@ -0,0 +1,244 @@
+package registry
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+
+	jksd "github.com/jkprj/jkfr/gokit/sd"
+	jklog "github.com/jkprj/jkfr/log"
+
+	"github.com/go-kit/kit/sd"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// 服务实例
+type Instance struct {
+	ID         string            // 服务实例ID
+	Addr       string            // 服务地址，host:port
+	Tags       []string          // 注册时的tags
+	Meta       map[string]string // 注册时的元数据
+	Health     string            // 健康状态：passing，warning，critical，maintenance
+	Weight     int               // 权重
+	Datacenter string            // 所在数据中心
+}
+
+// 服务实例变化事件
+type WatchEvent struct {
+	Instances []Instance // 当前全部服务实例，按Addr排序
+	Added     []Instance // 新增的服务实例
+	Removed   []Instance // 删除的服务实例
+	Updated   []Instance // 地址不变，元数据或健康状态变化的服务实例
+	Err       error      // 服务发现出错，出错时 Instances 为出错前的服务实例，其他字段为空
+}
+
+// 服务实例监听，每次服务实例变化时推送全量快照和变化的服务实例。
+// Watcher 同时实现了 jksd.MetaInstancer，可以用于 jksd.NewEndpointer，
+// 这样 endpointCache 中的服务实例也带有元数据和健康状态
+type Watcher struct {
+	sd.Instancer
+	service string
+
+	mt        sync.RWMutex
+	instances []Instance
+
+	events  chan sd.Event
+	handler func(event WatchEvent)
+	ch      chan WatchEvent
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// 监听服务实例变化，通过 Watcher.Events() 获取变化事件，
+// 需要及时读取事件，否则会阻塞后续事件
+// Parameters :
+// name 服务名称
+// ops  服务发现选项，tags(WithTags)，PassingOnly(WithPassingOnly)等选项有效
+func Watch(name string, ops ...RegOption) (*Watcher, error) {
+	return watch(name, nil, make(chan WatchEvent, 16), ops...)
+}
+
+// 监听服务实例变化，服务实例变化时调用handler，handler在同一个goroutine中按顺序调用
+func WatchFunc(name string, handler func(event WatchEvent), ops ...RegOption) (*Watcher, error) {
+	return watch(name, handler, nil, ops...)
+}
+
+func watch(name string, handler func(event WatchEvent), ch chan WatchEvent, ops ...RegOption) (*Watcher, error) {
+
+	backend, regCfg, err := newBackend(name, ops...)
+	if nil != err {
+		jklog.Errorw("newBackend fail", "name", name, "err", err)
+		return nil, err
+	}
+
+	w := &Watcher{
+		Instancer: backend.NewInstancer(name, regCfg.ConsulTags, regCfg.PassingOnly),
+		service:   name,
+		events:    make(chan sd.Event),
+		handler:   handler,
+		ch:        ch,
+		done:      make(chan struct{}),
+	}
+
+	go w.loop()
+	w.Instancer.Register(w.events)
+
+	return w, nil
+}
+
+// 服务实例变化事件，只有通过 Watch 创建的 Watcher 有效
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.ch
+}
+
+// 当前全部服务实例，按Addr排序
+func (w *Watcher) Instances() []Instance {
+	w.mt.RLock()
+	defer w.mt.RUnlock()
+
+	return w.instances
+}
+
+// InstanceMeta 实现 jksd.MetaInstancer
+func (w *Watcher) InstanceMeta(instance string) (jksd.InstanceMeta, bool) {
+	if mi, ok := w.Instancer.(jksd.MetaInstancer); ok {
+		return mi.InstanceMeta(instance)
+	}
+
+	return jksd.InstanceMeta{}, false
+}
+
+// Stale 实现 jksd.StaleInstancer
+func (w *Watcher) Stale() bool {
+	if si, ok := w.Instancer.(jksd.StaleInstancer); ok {
+		return si.Stale()
+	}
+
+	return false
+}
+
+// 停止监听，Events() 返回的channel会被关闭，可以在 WatchFunc 的handler中调用
+func (w *Watcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.done) // 停止后loop继续读取events，避免阻塞Deregister
+
+		// 在handler中调用时在loop中执行，Instancer推送事件时持有锁并等待loop读取events，
+		// 同步Deregister会互相等待，所以异步注销
+		go func() {
+			w.Instancer.Deregister(w.events)
+			w.Instancer.Stop()
+			close(w.events)
+		}()
+	})
+}
+
+func (w *Watcher) loop() {
+
+	for event := range w.events {
+		select {
+		case <-w.done:
+			continue
+		default:
+			w.handle(event)
+		}
+	}
+
+	if nil != w.ch {
+		close(w.ch)
+	}
+}
+
+func (w *Watcher) emit(event WatchEvent) {
+
+	if nil == w.ch {
+		w.handler(event)
+		return
+	}
+
+	select {
+	case w.ch <- event:
+	case <-w.done:
+	}
+}
+
+func (w *Watcher) handle(event sd.Event) {
+
+	w.mt.RLock()
+	old := w.instances
+	w.mt.RUnlock()
+
+	if nil != event.Err {
+		w.emit(WatchEvent{Instances: old, Err: event.Err})
+		return
+	}
+
+	instances := make([]Instance, 0, len(event.Instances))
+	for _, addr := range event.Instances {
+		instances = append(instances, w.makeInstance(addr))
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Addr < instances[j].Addr
+	})
+
+	we := diffInstances(old, instances)
+	if nil != old && 0 == len(we.Added) && 0 == len(we.Removed) && 0 == len(we.Updated) {
+		return
+	}
+
+	w.mt.Lock()
+	w.instances = instances
+	w.mt.Unlock()
+
+	w.emit(we)
+}
+
+// 没有元数据的服务实例(如配置的静态实例)按健康，权重为1处理
+func (w *Watcher) makeInstance(addr string) Instance {
+
+	ins := Instance{ID: w.service + "_" + addr, Addr: addr, Health: consulapi.HealthPassing, Weight: 1}
+
+	if meta, ok := w.InstanceMeta(addr); ok {
+		ins.ID = meta.ID
+		ins.Tags = meta.Tags
+		ins.Meta = meta.Meta
+		ins.Health = meta.Health
+		ins.Datacenter = meta.Datacenter
+
+		if meta.Weight > 0 {
+			ins.Weight = meta.Weight
+		}
+	}
+
+	return ins
+}
+
+// 比较前后两次服务实例，instances需要按Addr排序
+func diffInstances(old, instances []Instance) WatchEvent {
+
+	we := WatchEvent{Instances: instances}
+
+	olds := make(map[string]Instance, len(old))
+	for _, ins := range old {
+		olds[ins.Addr] = ins
+	}
+
+	for _, ins := range instances {
+		o, ok := olds[ins.Addr]
+		if !ok {
+			we.Added = append(we.Added, ins)
+		} else if !reflect.DeepEqual(o, ins) {
+			we.Updated = append(we.Updated, ins)
+		}
+		delete(olds, ins.Addr)
+	}
+
+	for _, ins := range old {
+		if _, ok := olds[ins.Addr]; ok {
+			we.Removed = append(we.Removed, ins)
+		}
+	}
+
+	return we
+}
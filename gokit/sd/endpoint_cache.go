@@ -21,6 +21,11 @@ type endpointCache struct {
 	cache              map[string]endpointCloser
 	err                error
 	endpoints          []endpoint.Endpoint
+	instances          []string   // 与 endpoints 一一对应
+	details            []Instance // 与 endpoints 一一对应
+	metaOf             func(instance string) (InstanceMeta, bool)
+	staleOf            func() bool
+	stale              bool
 	logger             log.Logger
 	invalidateDeadline time.Time
 	timeNow            func() time.Time
@@ -54,11 +59,13 @@ func (c *endpointCache) Update(event sd.Event) {
 	if event.Err == nil {
 		c.updateCache(event.Instances)
 		c.err = nil
+		c.setStale(c.staleOf != nil && c.staleOf())
 		return
 	}
 
 	// Sad path. Something's gone wrong in sd.
 	c.logger.Log("err", event.Err)
+	c.setStale(len(c.endpoints) > 0)
 	if !c.options.invalidateOnError {
 		return // keep returning the last known endpoints on error
 	}
@@ -78,6 +85,12 @@ func (c *endpointCache) updateCache(instances []string) {
 	// Produce the current set of services.
 	cache := make(map[string]endpointCloser, len(instances))
 	for _, instance := range instances {
+		// Draining instances are closed like removed ones, in-flight requests
+		// still complete since endpoints don't own connections.
+		if c.draining(instance) {
+			continue
+		}
+
 		// If it already exists, just copy it over.
 		if sc, ok := c.cache[instance]; ok {
 			cache[instance] = sc
@@ -103,30 +116,43 @@ func (c *endpointCache) updateCache(instances []string) {
 
 	// Populate the slice of endpoints.
 	endpoints := make([]endpoint.Endpoint, 0, len(cache))
+	validInstances := make([]string, 0, len(cache))
+	details := make([]Instance, 0, len(cache))
 	for _, instance := range instances {
 		// A bad factory may mean an instance is not present.
 		if _, ok := cache[instance]; !ok {
 			continue
 		}
 		endpoints = append(endpoints, cache[instance].Endpoint)
+		validInstances = append(validInstances, instance)
+		details = append(details, c.makeInstance(instance, cache[instance].Endpoint))
 	}
 
 	// Swap and trigger GC for old copies.
 	c.endpoints = endpoints
+	c.instances = validInstances
+	c.details = details
 	c.cache = cache
 }
 
 // Endpoints yields the current set of (presumably identical) endpoints, ordered
 // lexicographically by the corresponding instance string.
 func (c *endpointCache) Endpoints() ([]endpoint.Endpoint, error) {
+	_, endpoints, err := c.InstanceEndpoints()
+	return endpoints, err
+}
+
+// InstanceEndpoints yields the current set of endpoints together with the
+// instance string of each endpoint, ordered lexicographically by instance.
+func (c *endpointCache) InstanceEndpoints() ([]string, []endpoint.Endpoint, error) {
 	// in the steady state we're going to have many goroutines calling Endpoints()
 	// concurrently, so to minimize contention we use a shared R-lock.
 	c.mtx.RLock()
 
 	if c.err == nil || c.timeNow().Before(c.invalidateDeadline) {
-		endpoints := c.endpoints
+		instances, endpoints := c.instances, c.endpoints
 		c.mtx.RUnlock()
-		return endpoints, nil
+		return instances, endpoints, nil
 	}
 
 	c.mtx.RUnlock()
@@ -137,9 +163,54 @@ func (c *endpointCache) Endpoints() ([]endpoint.Endpoint, error) {
 
 	// re-check condition due to a race between RUnlock() and Lock().
 	if c.err == nil || c.timeNow().Before(c.invalidateDeadline) {
-		return c.endpoints, nil
+		return c.instances, c.endpoints, nil
 	}
 
 	c.updateCache(nil) // close any remaining active endpoints
-	return nil, c.err
+	c.setStale(false)
+	return nil, nil, c.err
+}
+
+func (c *endpointCache) setStale(stale bool) {
+	if c.stale == stale {
+		return
+	}
+	c.stale = stale
+	if c.options.staleHandler != nil {
+		c.options.staleHandler(stale)
+	}
+}
+
+func (c *endpointCache) draining(instance string) bool {
+	if c.metaOf == nil {
+		return false
+	}
+	meta, ok := c.metaOf(instance)
+	return ok && meta.Draining()
+}
+
+func (c *endpointCache) makeInstance(instance string, e endpoint.Endpoint) Instance {
+	ins := Instance{Instance: instance, InstanceMeta: InstanceMeta{Weight: 1}, Endpoint: e}
+	if c.metaOf != nil {
+		if meta, ok := c.metaOf(instance); ok {
+			ins.InstanceMeta = meta
+		}
+	}
+	if ins.Weight <= 0 {
+		ins.Weight = 1
+	}
+	return ins
+}
+
+// Instances yields the current set of endpoints together with the instance
+// string and metadata of each endpoint, ordered lexicographically by instance.
+func (c *endpointCache) Instances() ([]Instance, error) {
+	// error handling and invalidation are the same as InstanceEndpoints.
+	if _, _, err := c.InstanceEndpoints(); err != nil {
+		return nil, err
+	}
+
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.details, nil
 }
@@ -16,6 +16,13 @@ type Endpointer interface {
 	Endpoints() ([]endpoint.Endpoint, error)
 }
 
+// InstanceEndpointer is an Endpointer that also yields the instance string of
+// each endpoint, e.g. for balancers that need a stable identity per instance.
+type InstanceEndpointer interface {
+	Endpointer
+	InstanceEndpoints() ([]string, []endpoint.Endpoint, error)
+}
+
 // FixedEndpointer yields a fixed set of endpoints.
 type FixedEndpointer []endpoint.Endpoint
 
@@ -36,6 +43,12 @@ func NewEndpointer(src sd.Instancer, f sd.Factory, logger log.Logger, options ..
 		instancer: src,
 		ch:        make(chan sd.Event),
 	}
+	if mi, ok := src.(MetaInstancer); ok {
+		se.cache.metaOf = mi.InstanceMeta
+	}
+	if si, ok := src.(StaleInstancer); ok {
+		se.cache.staleOf = si.Stale
+	}
 	go se.receive()
 	src.Register(se.ch)
 	return se
@@ -58,9 +71,20 @@ func InvalidateOnError(timeout time.Duration) EndpointerOption {
 	}
 }
 
+// StaleHandler returns EndpointerOption that reports whether the Endpointer
+// is serving stale endpoints: the Instancer published an error and the last
+// known endpoints are still returned, or the Instancer itself reports stale
+// instances (see StaleInstancer). The handler is called only on changes.
+func StaleHandler(handler func(stale bool)) EndpointerOption {
+	return func(opts *endpointerOptions) {
+		opts.staleHandler = handler
+	}
+}
+
 type endpointerOptions struct {
 	invalidateOnError bool
 	invalidateTimeout time.Duration
+	staleHandler      func(stale bool)
 }
 
 // DefaultEndpointer implements an Endpointer interface.
@@ -89,3 +113,13 @@ func (de *DefaultEndpointer) Close() {
 func (de *DefaultEndpointer) Endpoints() ([]endpoint.Endpoint, error) {
 	return de.cache.Endpoints()
 }
+
+// InstanceEndpoints implements InstanceEndpointer.
+func (de *DefaultEndpointer) InstanceEndpoints() ([]string, []endpoint.Endpoint, error) {
+	return de.cache.InstanceEndpoints()
+}
+
+// Instances implements MetaEndpointer.
+func (de *DefaultEndpointer) Instances() ([]Instance, error) {
+	return de.cache.Instances()
+}
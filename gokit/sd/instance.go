@@ -0,0 +1,62 @@
+package sd
+
+import (
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+)
+
+// META_DRAIN 元数据中该key的值不为空时，服务实例处于摘流状态，不再分配新请求
+const META_DRAIN = "drain"
+
+// InstanceMeta is the registration metadata of a service instance.
+type InstanceMeta struct {
+	ID         string            // 服务实例ID
+	Tags       []string          // 注册时的tags
+	Meta       map[string]string // 注册时的元数据，如版本
+	Health     string            // 健康状态：passing，warning，critical，maintenance
+	Weight     int               // 权重，<=0 时按1处理
+	Datacenter string            // 所在数据中心
+}
+
+// Draining reports whether the instance is in maintenance mode or marked to
+// drain, clients should stop sending new requests to it.
+func (m InstanceMeta) Draining() bool {
+	return "maintenance" == m.Health || "" != m.Meta[META_DRAIN]
+}
+
+// MetaInstancer is an Instancer that also knows the registration metadata of
+// the instances it publishes. The metadata must be updated before the Event
+// carrying the instances is sent to subscribers.
+type MetaInstancer interface {
+	sd.Instancer
+	InstanceMeta(instance string) (InstanceMeta, bool)
+}
+
+// StaleInstancer is an Instancer that may publish instances known to be
+// stale, e.g. loaded from a local snapshot while the registry is unreachable.
+type StaleInstancer interface {
+	sd.Instancer
+	Stale() bool
+}
+
+// DatacenterInstancer is an Instancer that discovers instances across
+// datacenters, e.g. failing over to remote datacenters when the local one has
+// too few healthy instances.
+type DatacenterInstancer interface {
+	sd.Instancer
+	Remote(instance string) (datacenter string, remote bool)
+}
+
+// Instance is an endpoint together with its instance string and metadata.
+type Instance struct {
+	Instance string // host:port
+	InstanceMeta
+	Endpoint endpoint.Endpoint
+}
+
+// MetaEndpointer is an Endpointer that also yields the instance string and
+// metadata of each endpoint, e.g. for weighted balancers.
+type MetaEndpointer interface {
+	Endpointer
+	Instances() ([]Instance, error)
+}
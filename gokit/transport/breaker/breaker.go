@@ -0,0 +1,255 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	jklog "github.com/jkprj/jkfr/log"
+	jkos "github.com/jkprj/jkfr/os"
+	"github.com/jkprj/jkfr/prometheus/gauge"
+	putils "github.com/jkprj/jkfr/prometheus/utils"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	STATE_CLOSED    = 0 // 关闭，正常放行请求
+	STATE_OPEN      = 1 // 打开，拒绝所有请求
+	STATE_HALF_OPEN = 2 // 半开，只放行少量探测请求
+)
+
+var ErrOpen = errors.New("circuit breaker is open")
+
+// 判断错误是否计为失败，返回false的错误(如业务错误)不影响熔断
+type Classifier func(err error) bool
+
+// 默认失败判断：调用方取消和熔断拒绝不计为失败
+func DefaultClassifier(err error) bool {
+	return nil != err && !errors.Is(err, context.Canceled) && !errors.Is(err, ErrOpen)
+}
+
+// 负载均衡使用的失败判断：熔断拒绝也算失败，使负载均衡避开熔断中的实例
+func BalancerClassifier(isFailure Classifier) func(err error) bool {
+	if nil == isFailure {
+		isFailure = DefaultClassifier
+	}
+
+	return func(err error) bool {
+		return errors.Is(err, ErrOpen) || isFailure(err)
+	}
+}
+
+// 熔断配置
+type Config struct {
+	Enable         bool    `json:"Enable" toml:"Enable"`                 // 是否开启按服务实例熔断
+	PerAction      bool    `json:"PerAction" toml:"PerAction"`           // 是否开启按action熔断
+	FailureRatio   float64 `json:"FailureRatio" toml:"FailureRatio"`     // 统计窗口内失败率达到该值时熔断
+	MinVolume      int     `json:"MinVolume" toml:"MinVolume"`           // 统计窗口内请求数达到该值才会熔断
+	Window         int     `json:"Window" toml:"Window"`                 // 统计窗口(秒)
+	OpenDuration   int     `json:"OpenDuration" toml:"OpenDuration"`     // 熔断持续时间(秒)，之后进入半开状态
+	HalfOpenProbes int     `json:"HalfOpenProbes" toml:"HalfOpenProbes"` // 半开状态放行的探测请求数，全部成功后关闭熔断
+
+	IsFailure Classifier `json:"-" toml:"-"` // 失败判断，默认为 DefaultClassifier
+}
+
+// 从环境变量读取默认配置
+func DefaultConfig() Config {
+	return Config{
+		Enable:         jkos.GetEnvBool("C_BREAKER_ENABLE", false),
+		PerAction:      jkos.GetEnvBool("C_BREAKER_PER_ACTION", false),
+		FailureRatio:   jkos.GetEnvFloat("C_BREAKER_FAILURE_RATIO", 0.5),
+		MinVolume:      jkos.GetEnvInt("C_BREAKER_MIN_VOLUME", 20),
+		Window:         jkos.GetEnvInt("C_BREAKER_WINDOW", 10),
+		OpenDuration:   jkos.GetEnvInt("C_BREAKER_OPEN_DURATION", 5),
+		HalfOpenProbes: jkos.GetEnvInt("C_BREAKER_HALF_OPEN_PROBES", 3),
+	}
+}
+
+type Breaker struct {
+	cfg       Config
+	isFailure Classifier
+	now       func() time.Time // 当前时间，测试时替换
+
+	mt          sync.Mutex
+	state       int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int // 半开状态已放行的探测请求数
+	probeSucc   int // 半开状态探测成功数
+
+	gaugeVec *prometheus.GaugeVec
+	labels   map[string]string
+}
+
+// 创建熔断器
+// Parameters :
+// cfg    熔断配置
+// name   prometheus 指标名称，为空时不导出状态
+// labels prometheus 指标标签
+func New(cfg Config, name string, labels map[string]string) *Breaker {
+
+	b := &Breaker{cfg: cfg, isFailure: cfg.IsFailure, now: time.Now, windowStart: time.Now(), labels: labels}
+	if nil == b.isFailure {
+		b.isFailure = DefaultClassifier
+	}
+	if b.cfg.HalfOpenProbes <= 0 {
+		b.cfg.HalfOpenProbes = 1
+	}
+
+	if "" != name {
+		b.gaugeVec = gauge.GetGaugeVec(name, putils.GetLabels(labels))
+		b.gaugeVec.With(prometheus.Labels(labels)).Set(STATE_CLOSED)
+	}
+
+	return b
+}
+
+// 创建按服务实例熔断的熔断器，状态导出到 nameSpace_Breaker_Instance_State
+func NewInstanceBreaker(cfg Config, nameSpace, role, service, instance string) *Breaker {
+	labels := map[string]string{"APP": jkos.AppName(), "Role": role, "Service": service, "Instance": instance}
+	return New(cfg, nameSpace+"_Breaker_Instance_State", labels)
+}
+
+// 当前状态
+func (b *Breaker) State() int {
+	b.mt.Lock()
+	defer b.mt.Unlock()
+
+	b.checkOpenTimeout(b.now())
+
+	return b.state
+}
+
+// 请求前调用，熔断时返回 ErrOpen
+func (b *Breaker) Allow() error {
+	b.mt.Lock()
+	defer b.mt.Unlock()
+
+	b.checkOpenTimeout(b.now())
+
+	switch b.state {
+	case STATE_OPEN:
+		return ErrOpen
+	case STATE_HALF_OPEN:
+		if b.probes >= b.cfg.HalfOpenProbes {
+			return ErrOpen
+		}
+		b.probes++
+	}
+
+	return nil
+}
+
+// 请求完成后调用，根据错误更新统计
+func (b *Breaker) Done(err error) {
+
+	failed := b.isFailure(err)
+
+	b.mt.Lock()
+	defer b.mt.Unlock()
+
+	now := b.now()
+
+	switch b.state {
+	case STATE_HALF_OPEN:
+		if failed {
+			b.setState(STATE_OPEN, now)
+		} else if nil == err || !(errors.Is(err, ErrOpen) || isCanceled(err)) {
+			b.probeSucc++
+			if b.probeSucc >= b.cfg.HalfOpenProbes {
+				b.setState(STATE_CLOSED, now)
+			}
+		} else if 0 < b.probes {
+			// 被取消的探测(如对冲请求中失败的一方)不能说明实例已恢复，归还探测名额
+			b.probes--
+		}
+
+	case STATE_CLOSED:
+		if now.Sub(b.windowStart) > time.Duration(b.cfg.Window)*time.Second {
+			b.resetWindow(now)
+		}
+
+		b.requests++
+		if failed {
+			b.failures++
+		}
+
+		if failed && b.requests >= b.cfg.MinVolume && float64(b.failures)/float64(b.requests) >= b.cfg.FailureRatio {
+			b.setState(STATE_OPEN, now)
+		}
+	}
+}
+
+// 删除导出的状态指标，熔断器不再使用时调用
+func (b *Breaker) Close() error {
+	if nil != b.gaugeVec {
+		b.gaugeVec.Delete(prometheus.Labels(b.labels))
+	}
+
+	return nil
+}
+
+// 熔断中间件，熔断时直接返回 ErrOpen
+func (b *Breaker) Middleware() endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+
+			if err = b.Allow(); nil != err {
+				return nil, err
+			}
+
+			response, err = next(ctx, request)
+
+			b.Done(err)
+
+			return response, err
+		}
+	}
+}
+
+// 调用方取消，包括grpc返回的取消状态码
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || codes.Canceled == status.Code(err)
+}
+
+func (b *Breaker) checkOpenTimeout(now time.Time) {
+	if STATE_OPEN == b.state && now.Sub(b.openedAt) >= time.Duration(b.cfg.OpenDuration)*time.Second {
+		b.setState(STATE_HALF_OPEN, now)
+	}
+}
+
+func (b *Breaker) setState(state int, now time.Time) {
+
+	if state == b.state {
+		return
+	}
+
+	jklog.Infow("circuit breaker state change", "labels", b.labels, "from", b.state, "to", state)
+
+	b.state = state
+	b.probes = 0
+	b.probeSucc = 0
+
+	if STATE_OPEN == state {
+		b.openedAt = now
+	}
+
+	b.resetWindow(now)
+
+	if nil != b.gaugeVec {
+		b.gaugeVec.With(prometheus.Labels(b.labels)).Set(float64(state))
+	}
+}
+
+func (b *Breaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+}
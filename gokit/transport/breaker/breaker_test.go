@@ -0,0 +1,171 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errFail = errors.New("fail")
+
+const (
+	opAllow = iota // 调用 Allow，检查返回的错误
+	opDone         // 调用 Done(err)
+	opWait         // 时钟前进 wait
+)
+
+type step struct {
+	op    int
+	err   error         // opAllow 期望的错误，opDone 传入的错误
+	wait  time.Duration // opWait 前进的时间
+	state int           // 执行后期望的状态
+}
+
+func allow(err error, state int) step { return step{op: opAllow, err: err, state: state} }
+func done(err error, state int) step  { return step{op: opDone, err: err, state: state} }
+func wait(d time.Duration, state int) step {
+	return step{op: opWait, wait: d, state: state}
+}
+
+// 失败 n 次，最后一次之后期望 state
+func fails(n, state int) []step {
+	steps := []step{}
+	for i := 0; i < n-1; i++ {
+		steps = append(steps, done(errFail, STATE_CLOSED))
+	}
+	return append(steps, done(errFail, state))
+}
+
+func TestBreakerTransitions(t *testing.T) {
+
+	cfg := Config{FailureRatio: 0.5, MinVolume: 4, Window: 10, OpenDuration: 5, HalfOpenProbes: 2}
+
+	cases := []struct {
+		name  string
+		cfg   Config
+		steps []step
+	}{
+		{
+			name: "closed-open-half_open-closed",
+			cfg:  cfg,
+			steps: []step{
+				done(nil, STATE_CLOSED),
+				done(nil, STATE_CLOSED),
+				done(errFail, STATE_CLOSED),
+				done(errFail, STATE_OPEN),
+				allow(ErrOpen, STATE_OPEN),
+				wait(4*time.Second, STATE_OPEN),
+				wait(time.Second, STATE_HALF_OPEN),
+				allow(nil, STATE_HALF_OPEN),
+				allow(nil, STATE_HALF_OPEN),
+				allow(ErrOpen, STATE_HALF_OPEN),
+				done(nil, STATE_HALF_OPEN),
+				done(nil, STATE_CLOSED),
+				allow(nil, STATE_CLOSED),
+			},
+		},
+		{
+			name:  "min_volume",
+			cfg:   cfg,
+			steps: fails(4, STATE_OPEN),
+		},
+		{
+			name: "failure_ratio",
+			cfg:  cfg,
+			steps: append([]step{
+				done(nil, STATE_CLOSED),
+				done(nil, STATE_CLOSED),
+				done(nil, STATE_CLOSED),
+			}, fails(3, STATE_OPEN)...),
+		},
+		{
+			// 取消和熔断拒绝计入请求数，不计为失败
+			name: "not_failure",
+			cfg:  cfg,
+			steps: []step{
+				done(context.Canceled, STATE_CLOSED),
+				done(ErrOpen, STATE_CLOSED),
+				done(context.Canceled, STATE_CLOSED),
+				done(errFail, STATE_CLOSED),
+				done(errFail, STATE_CLOSED),
+				done(errFail, STATE_OPEN),
+			},
+		},
+		{
+			name: "window_reset",
+			cfg:  cfg,
+			steps: append(append(fails(3, STATE_CLOSED),
+				wait(11*time.Second, STATE_CLOSED)),
+				// 新窗口重新计数，需要再失败4次
+				fails(4, STATE_OPEN)...),
+		},
+		{
+			name: "half_open_probe_fail",
+			cfg:  cfg,
+			steps: append(fails(4, STATE_OPEN),
+				wait(5*time.Second, STATE_HALF_OPEN),
+				allow(nil, STATE_HALF_OPEN),
+				done(errFail, STATE_OPEN),
+				allow(ErrOpen, STATE_OPEN),
+				// 重新计算熔断时间
+				wait(5*time.Second, STATE_HALF_OPEN),
+			),
+		},
+		{
+			name: "half_open_probe_canceled",
+			cfg:  Config{FailureRatio: 0.5, MinVolume: 4, Window: 10, OpenDuration: 5, HalfOpenProbes: 1},
+			steps: append(fails(4, STATE_OPEN),
+				wait(5*time.Second, STATE_HALF_OPEN),
+				allow(nil, STATE_HALF_OPEN),
+				allow(ErrOpen, STATE_HALF_OPEN),
+				// 被取消的探测归还名额，不计为成功
+				done(context.Canceled, STATE_HALF_OPEN),
+				allow(nil, STATE_HALF_OPEN),
+				done(nil, STATE_CLOSED),
+			),
+		},
+		{
+			name: "half_open_probe_grpc_canceled",
+			cfg: Config{FailureRatio: 0.5, MinVolume: 4, Window: 10, OpenDuration: 5, HalfOpenProbes: 1,
+				IsFailure: func(err error) bool { return errors.Is(err, errFail) }},
+			steps: append(fails(4, STATE_OPEN),
+				wait(5*time.Second, STATE_HALF_OPEN),
+				allow(nil, STATE_HALF_OPEN),
+				done(status.Error(codes.Canceled, "canceled"), STATE_HALF_OPEN),
+				allow(nil, STATE_HALF_OPEN),
+				allow(ErrOpen, STATE_HALF_OPEN),
+			),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+
+			now := time.Unix(1000, 0)
+			b := New(c.cfg, "", nil)
+			b.now = func() time.Time { return now }
+			b.windowStart = now
+
+			for i, s := range c.steps {
+				switch s.op {
+				case opAllow:
+					if err := b.Allow(); s.err != err {
+						t.Fatalf("step %d: Allow err: %v, want: %v", i, err, s.err)
+					}
+				case opDone:
+					b.Done(s.err)
+				case opWait:
+					now = now.Add(s.wait)
+				}
+
+				if state := b.State(); s.state != state {
+					t.Fatalf("step %d: state: %d, want: %d", i, state, s.state)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,288 @@
+// Package compress rpc和http传输的负载压缩：压缩算法注册、最小压缩大小和压缩率统计。
+//
+// 压缩按连接(http按服务实例)协商：一端开启压缩时在请求/响应中声明可以接收的压缩算法，
+// 另一端收到声明后才压缩发送的数据，因此不支持压缩的旧版本对端不会收到压缩数据
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	uprometheus "github.com/jkprj/jkfr/gokit/prometheus"
+	jkos "github.com/jkprj/jkfr/os"
+	ucounter "github.com/jkprj/jkfr/prometheus/counter"
+	uhistogram "github.com/jkprj/jkfr/prometheus/histogram"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	GZIP = "gzip"
+)
+
+const DEFAULT_MIN_SIZE = 1024
+
+// 解压后数据的默认最大大小，防止很小的压缩数据解压出超大的数据
+const DEFAULT_MAX_SIZE = 64 << 20
+
+var ErrNotRegistered = errors.New("compress: encoding not registered")
+var ErrTooLarge = errors.New("compress: decompressed data too large")
+
+// 压缩算法
+type Compressor interface {
+	Name() string
+	Compress(w io.Writer) (io.WriteCloser, error)
+	Decompress(r io.Reader) (io.Reader, error)
+}
+
+var compressors map[string]Compressor = map[string]Compressor{}
+var mtCompressor sync.RWMutex
+
+func init() {
+	Register(&gzipCompressor{})
+}
+
+// 注册压缩算法，相同名称后注册的覆盖先注册的
+func Register(c Compressor) {
+	mtCompressor.Lock()
+	defer mtCompressor.Unlock()
+
+	compressors[c.Name()] = c
+}
+
+func Get(name string) Compressor {
+	mtCompressor.RLock()
+	defer mtCompressor.RUnlock()
+
+	return compressors[name]
+}
+
+// 压缩配置
+type Options struct {
+	Encoding  string // 压缩算法，为空时不压缩，也不声明可以接收压缩数据
+	MinSize   int    // 数据不小于该大小(字节)时才压缩
+	MaxSize   int    // 解压后数据的最大大小(字节)，<=0 时使用 DEFAULT_MAX_SIZE
+	NameSpace string // prometheus 指标名称前缀，为空时不统计压缩率
+	Role      string
+	Service   string
+}
+
+func NewOptions(encoding string, minSize, maxSize int, nameSpace, role, service string) *Options {
+	return &Options{Encoding: encoding, MinSize: minSize, MaxSize: maxSize, NameSpace: nameSpace, Role: role, Service: service}
+}
+
+// 是否开启压缩
+func (o *Options) Enabled() bool {
+	return nil != o && "" != o.Encoding && nil != Get(o.Encoding)
+}
+
+// 声明可以接收的压缩算法，没有开启压缩时为空
+func (o *Options) Accept() string {
+	if !o.Enabled() {
+		return ""
+	}
+
+	return o.Encoding
+}
+
+// 对端声明的 accept 中包含本端的压缩算法时，返回使用的压缩算法
+func (o *Options) Negotiate(accept string) string {
+	if !o.Enabled() || "" == accept {
+		return ""
+	}
+
+	for _, encoding := range strings.Split(accept, ",") {
+		if o.Encoding == strings.TrimSpace(strings.SplitN(encoding, ";", 2)[0]) {
+			return o.Encoding
+		}
+	}
+
+	return ""
+}
+
+// 使用协商的压缩算法压缩数据，encoding 为空或数据小于 MinSize 时不压缩，返回原数据和空的压缩算法
+func (o *Options) Compress(encoding string, data []byte) ([]byte, string, error) {
+
+	if "" == encoding || len(data) < o.MinSize {
+		return data, "", nil
+	}
+
+	out, err := Compress(encoding, data)
+	if nil != err {
+		return nil, "", err
+	}
+
+	o.observe(encoding, len(data), len(out))
+
+	return out, encoding, nil
+}
+
+// 解压对端发送的数据，没有开启压缩时也按 MaxSize 限制解压后的大小
+func (o *Options) Decompress(encoding string, data []byte) ([]byte, error) {
+	return Decompress(encoding, data, o.maxSize())
+}
+
+// 解压对端发送的数据流，读取超过 MaxSize 时返回 ErrTooLarge
+func (o *Options) NewReader(encoding string, r io.Reader) (io.Reader, error) {
+	return NewLimitReader(encoding, r, o.maxSize())
+}
+
+func (o *Options) maxSize() int {
+	if nil == o {
+		return 0
+	}
+
+	return o.MaxSize
+}
+
+// 统计压缩率(压缩后/压缩前)和压缩前后的字节数
+func (o *Options) observe(encoding string, raw, compressed int) {
+
+	if "" == o.NameSpace || !uprometheus.Running || 0 == raw {
+		return
+	}
+
+	labels := prometheus.Labels{"APP": jkos.AppName(), "Role": o.Role, "Service": o.Service, "Encoding": encoding}
+	uhistogram.Observe(o.NameSpace+"_Compression_Ratio", labels, float64(compressed)/float64(raw))
+
+	bytesCounter := ucounter.GetCounterVec(o.NameSpace+"_Compression_Bytes_Total", []string{"APP", "Role", "Service", "Encoding", "Stage"})
+	labels["Stage"] = "raw"
+	bytesCounter.With(labels).Add(float64(raw))
+	labels["Stage"] = "compressed"
+	bytesCounter.With(labels).Add(float64(compressed))
+}
+
+func Compress(encoding string, data []byte) ([]byte, error) {
+
+	c := Get(encoding)
+	if nil == c {
+		return nil, ErrNotRegistered
+	}
+
+	var buf bytes.Buffer
+	w, err := c.Compress(&buf)
+	if nil != err {
+		return nil, err
+	}
+
+	if _, err = w.Write(data); nil != err {
+		w.Close()
+		return nil, err
+	}
+	if err = w.Close(); nil != err {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// 解压数据，解压后超过 maxSize 时返回 ErrTooLarge，maxSize<=0 时使用 DEFAULT_MAX_SIZE
+func Decompress(encoding string, data []byte, maxSize int) ([]byte, error) {
+
+	r, err := NewReader(encoding, bytes.NewReader(data))
+	if nil != err {
+		return nil, err
+	}
+
+	if maxSize <= 0 {
+		maxSize = DEFAULT_MAX_SIZE
+	}
+
+	out, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if nil != err {
+		return nil, err
+	}
+	if len(out) > maxSize {
+		return nil, ErrTooLarge
+	}
+
+	return out, nil
+}
+
+func NewReader(encoding string, r io.Reader) (io.Reader, error) {
+
+	c := Get(encoding)
+	if nil == c {
+		return nil, ErrNotRegistered
+	}
+
+	return c.Decompress(r)
+}
+
+// 解压数据流，读取超过 maxSize 时返回 ErrTooLarge，maxSize<=0 时使用 DEFAULT_MAX_SIZE
+func NewLimitReader(encoding string, r io.Reader, maxSize int) (io.Reader, error) {
+
+	r, err := NewReader(encoding, r)
+	if nil != err {
+		return nil, err
+	}
+
+	if maxSize <= 0 {
+		maxSize = DEFAULT_MAX_SIZE
+	}
+
+	return &limitReader{r: r, n: int64(maxSize)}, nil
+}
+
+// 和 io.LimitReader 不同，超过限制时返回 ErrTooLarge 而不是 io.EOF，避免截断的数据被当成完整数据
+type limitReader struct {
+	r io.Reader
+	n int64 // 剩余可以读取的字节数
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+
+	// 多读一个字节判断是否超过限制
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		n, l.n = int(l.n), 0
+		return n, ErrTooLarge
+	}
+	l.n -= int64(n)
+
+	return n, err
+}
+
+type gzipCompressor struct {
+	writers sync.Pool
+}
+
+func (c *gzipCompressor) Name() string {
+	return GZIP
+}
+
+func (c *gzipCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+
+	gw, ok := c.writers.Get().(*gzip.Writer)
+	if !ok {
+		gw = gzip.NewWriter(w)
+	} else {
+		gw.Reset(w)
+	}
+
+	return &gzipWriter{Writer: gw, pool: &c.writers}, nil
+}
+
+func (c *gzipCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+// 关闭后放回pool复用
+type gzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (w *gzipWriter) Close() error {
+	err := w.Writer.Close()
+	w.pool.Put(w.Writer)
+	return err
+}
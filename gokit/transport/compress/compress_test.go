@@ -0,0 +1,80 @@
+package compress_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
+)
+
+func TestCompress(t *testing.T) {
+
+	data := bytes.Repeat([]byte("jkfr"), 1024)
+
+	out, err := jkcompress.Compress(jkcompress.GZIP, data)
+	if nil != err || len(out) >= len(data) {
+		t.Fatalf("compress len: %d, err: %v", len(out), err)
+	}
+
+	raw, err := jkcompress.Decompress(jkcompress.GZIP, out, 0)
+	if nil != err || !bytes.Equal(raw, data) {
+		t.Fatalf("decompress err: %v", err)
+	}
+
+	if _, err = jkcompress.Compress("unknown", data); jkcompress.ErrNotRegistered != err {
+		t.Fatalf("unknown encoding err: %v", err)
+	}
+}
+
+func TestOptions(t *testing.T) {
+
+	var disabled *jkcompress.Options
+	if disabled.Enabled() || "" != disabled.Accept() || "" != disabled.Negotiate(jkcompress.GZIP) {
+		t.Fatal("nil options should not compress")
+	}
+
+	o := jkcompress.NewOptions(jkcompress.GZIP, 100, 0, "", "client", "test")
+	if "" != o.Negotiate("") || "" != o.Negotiate("br") {
+		t.Fatal("peer not accept gzip")
+	}
+	if jkcompress.GZIP != o.Negotiate("br, gzip;q=0.5") {
+		t.Fatal("peer accept gzip")
+	}
+
+	small := []byte("jkfr")
+	if out, encoding, err := o.Compress(jkcompress.GZIP, small); nil != err || "" != encoding || !bytes.Equal(out, small) {
+		t.Fatalf("small data should not compress, encoding: %s, err: %v", encoding, err)
+	}
+
+	data := bytes.Repeat([]byte("jkfr"), 100)
+	if _, encoding, err := o.Compress(jkcompress.GZIP, data); nil != err || jkcompress.GZIP != encoding {
+		t.Fatalf("encoding: %s, err: %v", encoding, err)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+
+	// 很小的压缩数据解压后超过限制
+	data := make([]byte, 1<<20)
+	out, err := jkcompress.Compress(jkcompress.GZIP, data)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if _, err = jkcompress.Decompress(jkcompress.GZIP, out, len(data)-1); jkcompress.ErrTooLarge != err {
+		t.Fatalf("decompress err: %v", err)
+	}
+	if raw, err := jkcompress.Decompress(jkcompress.GZIP, out, len(data)); nil != err || len(data) != len(raw) {
+		t.Fatalf("decompress len: %d, err: %v", len(raw), err)
+	}
+
+	o := jkcompress.NewOptions("", 0, len(data)-1, "", "server", "test")
+	r, err := o.NewReader(jkcompress.GZIP, bytes.NewReader(out))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadAll(r); jkcompress.ErrTooLarge != err {
+		t.Fatalf("read err: %v", err)
+	}
+}
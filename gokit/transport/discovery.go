@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	uprometheus "github.com/jkprj/jkfr/gokit/prometheus"
+	jksd "github.com/jkprj/jkfr/gokit/sd"
+	jkos "github.com/jkprj/jkfr/os"
+	ucounter "github.com/jkprj/jkfr/prometheus/counter"
+	"github.com/jkprj/jkfr/prometheus/gauge"
+	putils "github.com/jkprj/jkfr/prometheus/utils"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 客户端服务发现选项，服务发现出错后仍使用出错前的服务实例，或使用快照中的服务实例时为过期
+// Parameters :
+// invalidateOnError 服务发现出错后多少秒清空服务实例，<0 时一直使用出错前的服务实例
+// nameSpace         prometheus 指标名称前缀，不为空时过期状态导出到 nameSpace_Discovery_Stale，1为过期
+func EndpointerOptions(invalidateOnError int, nameSpace, role, service string) []jksd.EndpointerOption {
+
+	ops := []jksd.EndpointerOption{}
+
+	if invalidateOnError >= 0 {
+		ops = append(ops, jksd.InvalidateOnError(time.Duration(invalidateOnError)*time.Second))
+	}
+
+	if "" != nameSpace {
+		labels := map[string]string{"APP": jkos.AppName(), "Role": role, "Service": service}
+		gaugeVec := gauge.GetGaugeVec(nameSpace+"_Discovery_Stale", putils.GetLabels(labels))
+		gaugeVec.With(prometheus.Labels(labels)).Set(0)
+
+		ops = append(ops, jksd.StaleHandler(func(stale bool) {
+			if stale {
+				gaugeVec.With(prometheus.Labels(labels)).Set(1)
+			} else {
+				gaugeVec.With(prometheus.Labels(labels)).Set(0)
+			}
+		}))
+	}
+
+	return ops
+}
+
+// 跨数据中心请求计数，instancer 实现了 jksd.DatacenterInstancer 并且服务实例在远程数据中心(故障转移)时，
+// 请求数导出到 nameSpace_Cross_DC_Requests_Total，其他情况不做处理
+func CrossDCMiddleware(instancer sd.Instancer, nameSpace, role, service, instance string) endpoint.Middleware {
+
+	di, ok := instancer.(jksd.DatacenterInstancer)
+	if !ok || "" == nameSpace {
+		return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+	}
+
+	datacenter, remote := di.Remote(instance)
+	if !remote {
+		return func(next endpoint.Endpoint) endpoint.Endpoint { return next }
+	}
+
+	counter := ucounter.GetCounterVec(nameSpace+"_Cross_DC_Requests_Total", []string{"APP", "Role", "Service", "Datacenter"})
+	labels := prometheus.Labels{"APP": jkos.AppName(), "Role": role, "Service": service, "Datacenter": datacenter}
+
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+			if uprometheus.Running {
+				counter.With(labels).Inc()
+			}
+			return next(ctx, request)
+		}
+	}
+}
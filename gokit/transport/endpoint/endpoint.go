@@ -3,9 +3,11 @@ package endpoint
 import (
 	"context"
 	"math"
+	"sync"
 	"time"
 
 	uprometheus "github.com/jkprj/jkfr/gokit/prometheus"
+	"github.com/jkprj/jkfr/gokit/transport/breaker"
 	jklog "github.com/jkprj/jkfr/log"
 	jkos "github.com/jkprj/jkfr/os"
 	ucounter "github.com/jkprj/jkfr/prometheus/counter"
@@ -179,3 +181,28 @@ func MakePrometheusTotalRequestErrorMiddleware(nameSpace, role string) ActionMid
 	}
 
 }
+
+// 按action熔断，同一个action的请求失败率过高时直接返回 breaker.ErrOpen
+func MakeBreakerMiddleware(nameSpace, role, service string, cfg breaker.Config) ActionMiddleware {
+
+	a2b := map[string]*breaker.Breaker{}
+	mt := sync.Mutex{}
+
+	return func(action string, next endpoint.Endpoint) endpoint.Endpoint {
+
+		if action == "" {
+			return next
+		}
+
+		mt.Lock()
+		b, ok := a2b[action]
+		if !ok {
+			labels := map[string]string{"APP": jkos.AppName(), "Role": role, "Service": service, "Action": action}
+			b = breaker.New(cfg, nameSpace+"_Breaker_Action_State", labels)
+			a2b[action] = b
+		}
+		mt.Unlock()
+
+		return b.Middleware()(next)
+	}
+}
@@ -12,6 +12,8 @@ import (
 	jktrans "github.com/jkprj/jkfr/gokit/transport"
 
 	kitlog "github.com/jkprj/jkfr/gokit/log"
+	jksd "github.com/jkprj/jkfr/gokit/sd"
+	"github.com/jkprj/jkfr/gokit/transport/breaker"
 	jkendpoint "github.com/jkprj/jkfr/gokit/transport/endpoint"
 	jkpool "github.com/jkprj/jkfr/gokit/transport/pool"
 	grpc_pools "github.com/jkprj/jkfr/gokit/transport/pool/grpc"
@@ -21,8 +23,9 @@ import (
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/sd"
-	kitconsul "github.com/go-kit/kit/sd/consul"
 	"github.com/go-kit/kit/sd/lb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var name2client map[string]*GRPCClient = make(map[string]*GRPCClient)
@@ -42,6 +45,19 @@ func Call(name, action string, req interface{}) (rsp interface{}, err error) {
 	return client.Call(action, req)
 }
 
+func CallContext(ctx context.Context, name, action string, req interface{}) (rsp interface{}, err error) {
+
+	mtClient.RLock()
+	client, ok := name2client[name]
+	mtClient.RUnlock()
+
+	if !ok {
+		return nil, errors.New("client not found, name:" + name)
+	}
+
+	return client.CallContext(ctx, action, req)
+}
+
 func GoCall(name, action string, req interface{}) *UCall {
 	mtClient.RLock()
 	client, ok := name2client[name]
@@ -117,8 +133,9 @@ func GetClient(name string) *GRPCClient {
 }
 
 type reuquestParam struct {
-	action  string
-	request interface{}
+	action     string
+	request    interface{}
+	streamType grpc_pools.StreamType // 不为0时打开流
 }
 
 type GRPCClient struct {
@@ -127,12 +144,12 @@ type GRPCClient struct {
 	name         string
 	clientFatory grpc_pools.ClientFatory
 
-	cfg          *ClientConfig
-	consulClient kitconsul.Client
+	cfg        *ClientConfig
+	regBackend jkregistry.Backend
 
-	consulInstancer  *kitconsul.Instancer
-	consulEndpointer *sd.DefaultEndpointer
-	reqEndPoint      endpoint.Endpoint
+	instancer   sd.Instancer
+	endpointer  *jksd.DefaultEndpointer
+	reqEndPoint endpoint.Endpoint
 
 	pools *grpc_pools.GRPCPools
 
@@ -151,9 +168,9 @@ func NewClient(name string, clientFatory grpc_pools.ClientFatory, ops ...ClientO
 	client.cfg = newClientConfig(name, ops...)
 	client.Done = client.cfg.AsyncCallChan
 
-	client.consulClient, err = jkregistry.NewConsulClient(client.name, client.cfg.RegOps...)
+	client.regBackend, err = jkregistry.NewBackend(client.name, client.cfg.RegOps...)
 	if nil != err {
-		jklog.Errorw("jkregistry.NewConsulClient fail", "name", client.name, "cfg", *client.cfg, "err", err.Error())
+		jklog.Errorw("jkregistry.NewBackend fail", "name", client.name, "cfg", *client.cfg, "err", err.Error())
 		return nil, err
 	}
 
@@ -180,11 +197,55 @@ func (client *GRPCClient) GetUCall() chan *UCall {
 }
 
 func (client *GRPCClient) Call(action string, req interface{}) (rsp interface{}, err error) {
+	return client.CallContext(context.Background(), action, req)
+}
+
+// 一致性哈希策略(hash)下相同key的调用发送到同一个服务实例，其他策略下key不生效
+func (client *GRPCClient) CallWithKey(key, action string, req interface{}) (rsp interface{}, err error) {
+	return client.CallContext(jklb.WithHashKey(context.Background(), key), action, req)
+}
+
+// 调用服务，ctx的截止时间作用于包括重试在内的整个调用过程，ctx取消后立即返回
+// 哈希key也可以通过 jklb.WithHashKey 设置在ctx中
+func (client *GRPCClient) CallContext(ctx context.Context, action string, req interface{}) (rsp interface{}, err error) {
+	return client.request(ctx, reuquestParam{action: action, request: req})
+}
+
+// 打开服务端流，收到第一个响应(或流正常结束)后返回，在此之前失败时按重试策略换服务实例重试，
+// ctx作用于整个流，TimeOut 只作用于收到第一个响应之前，使用完需要调用 Stream.Close
+func (client *GRPCClient) Stream(ctx context.Context, action string, req interface{}) (*grpc_pools.Stream, error) {
+	return client.openStream(ctx, grpc_pools.SERVER_STREAM, action, req)
+}
+
+// 打开客户端流，只在建立流失败时重试，发送请求后不再重试
+func (client *GRPCClient) ClientStream(ctx context.Context, action string) (*grpc_pools.Stream, error) {
+	return client.openStream(ctx, grpc_pools.CLIENT_STREAM, action, nil)
+}
+
+// 打开双向流，只在建立流失败时重试，发送请求后不再重试
+func (client *GRPCClient) BidiStream(ctx context.Context, action string) (*grpc_pools.Stream, error) {
+	return client.openStream(ctx, grpc_pools.BIDI_STREAM, action, nil)
+}
+
+// 流和普通调用一样经过服务发现、负载均衡、重试和指标统计，统计的耗时为建立流的耗时
+func (client *GRPCClient) openStream(ctx context.Context, st grpc_pools.StreamType, action string, req interface{}) (*grpc_pools.Stream, error) {
+
+	rsp, err := client.request(ctx, reuquestParam{action: action, request: req, streamType: st})
+	if nil != err {
+		return nil, err
+	}
+
+	return rsp.(*grpc_pools.Stream), nil
+}
+
+func (client *GRPCClient) request(ctx context.Context, reqParam reuquestParam) (rsp interface{}, err error) {
 
 	if client.isClose {
 		return nil, jkpool.ErrClosed
 	}
 
+	action := reqParam.action
+
 	client.mtAction.RLock()
 	repEndPoint, ok := client.actionEndPoint[action]
 	client.mtAction.RUnlock()
@@ -192,9 +253,7 @@ func (client *GRPCClient) Call(action string, req interface{}) (rsp interface{},
 		repEndPoint = jkendpoint.Chain(client.reqEndPoint, action, client.cfg.ActionMiddlewares...)
 	}
 
-	reqParam := reuquestParam{action: action, request: req}
-
-	rsp, err = repEndPoint(context.Background(), reqParam)
+	rsp, err = repEndPoint(jktrans.WithAction(ctx, action), reqParam)
 	if nil != err {
 		return nil, err
 	}
@@ -238,53 +297,112 @@ func (client *GRPCClient) Close() {
 
 	client.pools.Close()
 
-	if nil != client.consulEndpointer {
-		client.consulEndpointer.Close()
+	if nil != client.endpointer {
+		client.endpointer.Close()
 	}
 
-	if nil != client.consulInstancer {
-		client.consulInstancer.Stop()
+	if nil != client.instancer {
+		client.instancer.Stop()
 	}
 }
 
 func (client *GRPCClient) makeRequestFactory() sd.Factory {
-	return func(instance string) (endpoint endpoint.Endpoint, closer io.Closer, err_ error) {
-		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		reqEndpoint := func(ctx context.Context, request interface{}) (response interface{}, err error) {
 
 			reqParam, ok := request.(reuquestParam)
 			if !ok {
 				return nil, errors.New("the request is not reuquestParam, request_type:" + reflect.TypeOf(request).String())
 			}
 
-			return client.pools.CallWithAddrEx(instance, reqParam.action, reqParam.request, time.Duration(client.cfg.TimeOut)*time.Second)
+			timeout := time.Duration(client.cfg.TimeOut) * time.Second
+
+			if 0 != reqParam.streamType {
+				stream, err := client.pools.StreamWithAddrContext(ctx, instance, reqParam.streamType, reqParam.action, reqParam.request, timeout)
+				if nil != err {
+					return nil, err
+				}
+				return stream, nil
+			}
+
+			return client.pools.CallWithAddrContext(ctx, instance, reqParam.action, reqParam.request, timeout)
+		}
+
+		// 故障转移到远程数据中心时统计跨数据中心请求
+		reqEndpoint = jktrans.CrossDCMiddleware(client.instancer, client.cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, client.name, instance)(reqEndpoint)
 
-		}, nil, nil
+		if !client.cfg.Breaker.Enable {
+			return reqEndpoint, nil, nil
+		}
+
+		// 实例从注册中心移除时会关闭熔断器
+		b := breaker.NewInstanceBreaker(client.cfg.Breaker, client.cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, client.name, instance)
+		return b.Middleware()(reqEndpoint), b, nil
 	}
 }
 
+func (client *GRPCClient) retryPolicy() jktrans.RetryPolicy {
+	return jktrans.RetryPolicy{
+		Max:                 client.cfg.Retry,
+		IntervalMS:          client.cfg.RetryIntervalMS,
+		MaxIntervalMS:       client.cfg.RetryMaxIntervalMS,
+		Budget:              client.cfg.RetryBudget,
+		Retryable:           client.cfg.RetryClassifier,
+		NonRetryableActions: client.cfg.NonRetryableActions,
+		PrometheusNameSpace: client.cfg.PrometheusNameSpace,
+		Role:                jkutils.ROLE_CLIENT,
+		Service:             client.name,
+	}
+}
+
+// 重试的默认判断，只有服务不可用时重试，服务端返回的其他状态码属于业务错误
+func isRetryable(action string, err error) bool {
+	st, ok := status.FromError(err)
+	if !ok {
+		return jktrans.DefaultRetryClassifier(action, err)
+	}
+
+	return codes.Unavailable == st.Code()
+}
+
+// 熔断的默认失败判断，只有服务不可用和超时计为失败，服务端返回的其他状态码属于业务错误
+func isBreakerFailure(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok {
+		return breaker.DefaultClassifier(err)
+	}
+
+	switch st.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+
+	return false
+}
+
 func (client *GRPCClient) makeRuquestEndpoint() endpoint.Endpoint {
 
-	client.consulInstancer = kitconsul.NewInstancer(
-		client.consulClient,
-		kitlog.InfowLogger,
-		client.name,
-		client.cfg.ConsulTags,
-		client.cfg.PassingOnly,
-	)
+	client.instancer = client.regBackend.NewInstancer(client.name, client.cfg.ConsulTags, client.cfg.PassingOnly)
 
-	client.consulEndpointer = sd.NewEndpointer(client.consulInstancer, client.makeRequestFactory(), kitlog.ErrorwLogger)
+	client.endpointer = jksd.NewEndpointer(client.instancer, client.makeRequestFactory(), kitlog.ErrorwLogger,
+		jktrans.EndpointerOptions(client.cfg.InvalidateOnError, client.cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, client.name)...)
 
 	var balancer lb.Balancer
 	{
 		if jkutils.STRATEGY_ROUND == client.cfg.Strategy {
-			balancer = lb.NewRoundRobin(client.consulEndpointer)
+			balancer = lb.NewRoundRobin(client.endpointer)
 		} else if jkutils.STRATEGY_RANDOM == client.cfg.Strategy {
-			balancer = jklb.NewRandom(client.consulEndpointer, time.Now().UnixNano())
+			balancer = jklb.NewRandom(client.endpointer, time.Now().UnixNano())
+		} else if jkutils.STRATEGY_P2C_EWMA == client.cfg.Strategy {
+			balancer = jklb.NewP2CEWMABalancer(client.endpointer, breaker.BalancerClassifier(client.cfg.Breaker.IsFailure))
+		} else if jkutils.STRATEGY_CONSISTENT_HASH == client.cfg.Strategy {
+			balancer = jklb.NewConsistentHashBalancer(client.endpointer, breaker.BalancerClassifier(client.cfg.Breaker.IsFailure))
+		} else if jkutils.STRATEGY_WEIGHTED == client.cfg.Strategy {
+			balancer = jklb.NewWeightedBalancer(client.endpointer)
 		} else {
-			balancer = jklb.NewLeastBalancer(client.consulEndpointer)
+			balancer = jklb.NewLeastBalancer(client.endpointer)
 		}
 	}
 
-	// return lb.Retry(client.cfg.Retry, time.Duration(client.cfg.TimeOut)*time.Second, balancer)
-	return jktrans.Retry(client.cfg.Retry, client.cfg.RetryIntervalMS, balancer)
+	return jktrans.RetryWithPolicy(balancer, client.retryPolicy())
 }
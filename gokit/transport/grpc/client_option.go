@@ -11,6 +11,8 @@ import (
 	"google.golang.org/grpc"
 
 	jkregistry "github.com/jkprj/jkfr/gokit/registry"
+	jktrans "github.com/jkprj/jkfr/gokit/transport"
+	"github.com/jkprj/jkfr/gokit/transport/breaker"
 	jkendpoint "github.com/jkprj/jkfr/gokit/transport/endpoint"
 	jkutils "github.com/jkprj/jkfr/gokit/utils"
 	jkos "github.com/jkprj/jkfr/os"
@@ -38,6 +40,8 @@ type ClientConfig struct {
 	RegOps            []jkregistry.RegOption        `json:"-" toml:"-"`
 	GRPCDialOps       []grpc.DialOption             `json:"-" toml:"-"`
 	ActionMiddlewares []jkendpoint.ActionMiddleware `json:"-" toml:"-"`
+	RetryBudget       *jktrans.RetryBudget          `json:"-" toml:"-"`
+	RetryClassifier   jktrans.RetryClassifier       `json:"-" toml:"-"`
 	AsyncCallChan     chan *UCall                   `json:"-" toml:"-"`
 	ConfigPath        string
 
@@ -46,13 +50,20 @@ type ClientConfig struct {
 	PrometheusNameSpace string     `json:"PrometheusNameSpace" toml:"PrometheusNameSpace"`
 	Retry               int        `json:"Retry" toml:"Retry"`
 	RetryIntervalMS     int        `json:"RetryIntervalMS" toml:"RetryIntervalMS"`
+	RetryMaxIntervalMS  int        `json:"RetryMaxIntervalMS" toml:"RetryMaxIntervalMS"`
+	NonRetryableActions []string   `json:"NonRetryableActions" toml:"NonRetryableActions"`
 	RateLimit           rate.Limit `json:"RateLimit" toml:"RateLimit"`
 	TimeOut             int        `json:"TimeOut" toml:"TimeOut"`
 	PoolCap             int        `json:"PoolCap" toml:"PoolCap"`
 	MaxCap              int        `json:"MaxCap" toml:"MaxCap"`
 	PassingOnly         bool       `json:"PassingOnly" toml:"PassingOnly"`
+	InvalidateOnError   int        `json:"InvalidateOnError" toml:"InvalidateOnError"`
+	Filter              string     `json:"Filter" toml:"Filter"`
+	FailoverDatacenters []string   `json:"FailoverDatacenters" toml:"FailoverDatacenters"`
 	KeepAlive           bool       `json:"KeepAlive" toml:"KeepAlive"`
 
+	Breaker breaker.Config `json:"Breaker" toml:"Breaker"` // 熔断配置
+
 	tmpActionMiddlewares []jkendpoint.ActionMiddleware
 }
 
@@ -94,11 +105,17 @@ func defaultClientConfig(name string) *ClientConfig {
 	cfg.PrometheusNameSpace = jkos.GetEnvString("C_PROMETHEUS_NAME_SPACE", name)
 	cfg.Retry = jkos.GetEnvInt("C_RETRY", 3)
 	cfg.RetryIntervalMS = jkos.GetEnvInt("C_RETRY_INTERVAL_MS", 1000)
+	cfg.RetryMaxIntervalMS = jkos.GetEnvInt("C_RETRY_MAX_INTERVAL_MS", 10000)
+	cfg.NonRetryableActions = jkos.GetEnvStrings("C_NON_RETRYABLE_ACTIONS", ",", nil)
+	cfg.RetryBudget = jktrans.DefaultRetryBudget
 	cfg.RateLimit = rate.Limit(jkos.GetEnvInt("C_RATE_LIMIT", 0))
 	cfg.TimeOut = jkos.GetEnvInt("C_TIME_OUT", 60)
 	cfg.PoolCap = jkos.GetEnvInt("C_POOL_CAP", 2)
 	cfg.MaxCap = jkos.GetEnvInt("C_MAX_CAP", 32)
 	cfg.PassingOnly = jkos.GetEnvBool("C_PASSING_ONLY", true)
+	cfg.InvalidateOnError = jkos.GetEnvInt("C_INVALIDATE_ON_ERROR", -1)
+	cfg.Filter = jkos.GetEnvString("C_FILTER", "")
+	cfg.FailoverDatacenters = jkos.GetEnvStrings("C_FAILOVER_DATACENTERS", ",", nil)
 	cfg.KeepAlive = jkos.GetEnvBool("C_KEEP_ALIVE", true)
 
 	tmpCfg := clientConfig{}
@@ -118,6 +135,7 @@ func defaultClientConfig(name string) *ClientConfig {
 	tmpCfg.KPCfg.Timeout = jkos.GetEnvInt("C_KEEPALIVE_TIMEOUT", 0)
 
 	appendGRPCConfig(cfg, &tmpCfg)
+	cfg.Breaker = breaker.DefaultConfig()
 
 	cfg.ConfigPath = jkos.GetEnvString("C_CONFIG_PATH", "")
 	if jkos.IsFileExists(cfg.ConfigPath) {
@@ -213,12 +231,31 @@ func newClientConfig(name string, ops ...ClientOption) *ClientConfig {
 		op(cfg)
 	}
 
+	// 客户端指定的过滤表达式和故障转移数据中心优先于注册配置
+	if "" != cfg.Filter {
+		cfg.RegOps = append(cfg.RegOps, jkregistry.WithFilter(cfg.Filter))
+	}
+	if 0 < len(cfg.FailoverDatacenters) {
+		cfg.RegOps = append(cfg.RegOps, jkregistry.WithFailoverDatacenters(cfg.FailoverDatacenters...))
+	}
+
 	cfg.ActionMiddlewares = jkendpoint.DefaultMiddleware(cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, cfg.RateLimit)
+	if nil == cfg.RetryClassifier {
+		cfg.RetryClassifier = isRetryable
+	}
+	if nil == cfg.Breaker.IsFailure {
+		cfg.Breaker.IsFailure = isBreakerFailure
+	}
 
 	if 0 < len(cfg.tmpActionMiddlewares) {
 		cfg.ActionMiddlewares = cfg.tmpActionMiddlewares
 	}
 
+	// 自定义中间件时也需要按方法熔断
+	if cfg.Breaker.PerAction {
+		cfg.ActionMiddlewares = append(cfg.ActionMiddlewares, jkendpoint.MakeBreakerMiddleware(cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, name, cfg.Breaker))
+	}
+
 	return cfg
 }
 
@@ -276,6 +313,28 @@ func ClientPassingOnly(passingOnly bool) ClientOption {
 	}
 }
 
+// 服务发现出错后多少秒清空服务实例，<0 时一直使用出错前的服务实例
+func ClientInvalidateOnError(seconds int) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.InvalidateOnError = seconds
+	}
+}
+
+// 服务发现的consul过滤表达式，如 Service.Meta.version == "v2" or "canary" in Service.Tags，
+// 本地过滤函数通过 ClientRegOption(jkregistry.WithInstanceFilter(...)) 指定
+func ClientFilter(expr string) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.Filter = expr
+	}
+}
+
+// 故障转移的远程数据中心，本地数据中心健康的服务实例少于阈值(jkregistry.WithFailoverThreshold)时按顺序使用
+func ClientFailoverDatacenters(datacenters ...string) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.FailoverDatacenters = datacenters
+	}
+}
+
 func ClientKeepAlive(keepAlive bool) ClientOption {
 	return func(cfg *ClientConfig) {
 		cfg.KeepAlive = keepAlive
@@ -320,6 +379,50 @@ func ClientAsyncCallChan(asyncCallChan chan *UCall) ClientOption {
 	}
 }
 
+func ClientRetryMaxIntervalMS(retryMaxIntervalMS int) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.RetryMaxIntervalMS = retryMaxIntervalMS
+	}
+}
+
+// 不允许重试的action，如非幂等的接口
+func ClientNonRetryableActions(actions ...string) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.NonRetryableActions = append(cfg.NonRetryableActions, actions...)
+	}
+}
+
+// 重试预算，默认使用全局共享的 jktrans.DefaultRetryBudget，为nil时不限制
+func ClientRetryBudget(budget *jktrans.RetryBudget) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.RetryBudget = budget
+	}
+}
+
+// 判断失败的调用是否可以重试
+func ClientRetryClassifier(classifier jktrans.RetryClassifier) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.RetryClassifier = classifier
+	}
+}
+
+// 熔断配置，见 breaker.Config
+func ClientBreaker(breakerCfg breaker.Config) ClientOption {
+	return func(cfg *ClientConfig) {
+		if nil == breakerCfg.IsFailure {
+			breakerCfg.IsFailure = cfg.Breaker.IsFailure
+		}
+		cfg.Breaker = breakerCfg
+	}
+}
+
+// 熔断的失败判断，不设置时使用客户端默认的判断(业务错误不计为失败)
+func ClientBreakerClassifier(isFailure breaker.Classifier) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.Breaker.IsFailure = isFailure
+	}
+}
+
 func ClientConfigFile(cfgPath string) ClientOption {
 	return func(cfg *ClientConfig) {
 		cfg.ConfigPath = cfgPath
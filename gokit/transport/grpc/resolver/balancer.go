@@ -0,0 +1,163 @@
+package resolver
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jkutils "github.com/jkprj/jkfr/gokit/utils"
+	jkrand "github.com/jkprj/jkfr/gokit/utils/rand"
+	jklog "github.com/jkprj/jkfr/log"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+// 注册到grpc的负载均衡名称，也可以通过 grpc.WithDefaultServiceConfig 和其他解析器一起使用
+const (
+	BALANCER_LEAST  = "jkfr_least"
+	BALANCER_RANDOM = "jkfr_random"
+	BALANCER_ROUND  = "jkfr_round"
+)
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(BALANCER_LEAST, &pickerBuilder{strategy: jkutils.STRATEGY_LEAST}, base.Config{HealthCheck: true}))
+	balancer.Register(base.NewBalancerBuilder(BALANCER_RANDOM, &pickerBuilder{strategy: jkutils.STRATEGY_RANDOM}, base.Config{HealthCheck: true}))
+	balancer.Register(base.NewBalancerBuilder(BALANCER_ROUND, &pickerBuilder{strategy: jkutils.STRATEGY_ROUND}, base.Config{HealthCheck: true}))
+}
+
+// 负载均衡策略对应的负载均衡名称，不支持的策略使用least
+func BalancerName(strategy string) string {
+
+	switch strategy {
+	case jkutils.STRATEGY_LEAST:
+		return BALANCER_LEAST
+	case jkutils.STRATEGY_RANDOM:
+		return BALANCER_RANDOM
+	case jkutils.STRATEGY_ROUND:
+		return BALANCER_ROUND
+	}
+
+	jklog.Warnw("jkfr balancer not support strategy, use least", "strategy", strategy)
+
+	return BALANCER_LEAST
+}
+
+type pickerBuilder struct {
+	strategy string
+}
+
+// 连接的状态变化时重新创建picker，只包含就绪的连接
+func (pb *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+
+	if 0 == len(info.ReadySCs) {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	scs := make([]balancer.SubConn, 0, len(info.ReadySCs))
+	for sc := range info.ReadySCs {
+		scs = append(scs, sc)
+	}
+
+	random := &lockedRand{r: rand.New(jkrand.NewSource(time.Now().UnixNano()))}
+
+	switch pb.strategy {
+	case jkutils.STRATEGY_RANDOM:
+		return &randomPicker{scs: scs, random: random}
+	case jkutils.STRATEGY_ROUND:
+		// 从随机位置开始，避免所有客户端都从第一个服务实例开始
+		return &roundPicker{scs: scs, next: uint32(random.Intn(len(scs)))}
+	}
+
+	return &leastPicker{scs: scs, calls: make([]int64, len(scs)), random: random}
+}
+
+// grpc在多个goroutine中并发调用Pick，jkrand的source没有加锁
+type lockedRand struct {
+	mt sync.Mutex
+	r  *rand.Rand
+}
+
+func (lr *lockedRand) Intn(n int) int {
+	lr.mt.Lock()
+	defer lr.mt.Unlock()
+
+	return lr.r.Intn(n)
+}
+
+type randomPicker struct {
+	scs    []balancer.SubConn
+	random *lockedRand
+}
+
+func (p *randomPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	return balancer.PickResult{SubConn: p.scs[p.random.Intn(len(p.scs))]}, nil
+}
+
+type roundPicker struct {
+	scs  []balancer.SubConn
+	next uint32
+}
+
+func (p *roundPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	index := atomic.AddUint32(&p.next, 1) % uint32(len(p.scs))
+	return balancer.PickResult{SubConn: p.scs[index]}, nil
+}
+
+// 选择正在处理请求数最少的连接，请求数在picker重新创建时重新统计
+type leastPicker struct {
+	scs    []balancer.SubConn
+	calls  []int64
+	random *lockedRand
+}
+
+func (p *leastPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+
+	index := p.least()
+	atomic.AddInt64(&p.calls[index], 1)
+
+	return balancer.PickResult{
+		SubConn: p.scs[index],
+		Done: func(balancer.DoneInfo) {
+			atomic.AddInt64(&p.calls[index], -1)
+		},
+	}, nil
+}
+
+// 和连接池的least策略一样，实例较少时从随机位置开始遍历，实例较多时随机抽取LEAST_RAND_COUNT个
+func (p *leastPicker) least() (index int) {
+
+	var min int64 = math.MaxInt64
+	nlen := len(p.scs)
+
+	if nlen <= jkutils.LEAST_ROUND_MAX {
+		bgIndex := p.random.Intn(nlen)
+		for i := 0; i < nlen; i++ {
+			cur := (bgIndex + i) % nlen
+			if calls := atomic.LoadInt64(&p.calls[cur]); min > calls {
+				min = calls
+				index = cur
+			}
+			if 0 == min {
+				break
+			}
+		}
+
+		return index
+	}
+
+	for i := 0; i < jkutils.LEAST_RAND_COUNT; i++ {
+		cur := p.random.Intn(nlen)
+		if calls := atomic.LoadInt64(&p.calls[cur]); min > calls {
+			min = calls
+			index = cur
+		}
+		if 0 == min {
+			break
+		}
+	}
+
+	return index
+}
@@ -0,0 +1,104 @@
+package resolver
+
+import (
+	"sync"
+	"testing"
+
+	jkutils "github.com/jkprj/jkfr/gokit/utils"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+type testSubConn struct {
+	balancer.SubConn
+	id int
+}
+
+func buildPicker(strategy string, n int) balancer.Picker {
+
+	info := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{}}
+	for i := 0; i < n; i++ {
+		info.ReadySCs[&testSubConn{id: i}] = base.SubConnInfo{}
+	}
+
+	return (&pickerBuilder{strategy: strategy}).Build(info)
+}
+
+// grpc在多个goroutine中并发调用Pick，需要用 -race 运行
+func TestPickerConcurrent(t *testing.T) {
+
+	const goroutines, picks, conns = 8, 1000, 4
+
+	for _, strategy := range []string{jkutils.STRATEGY_LEAST, jkutils.STRATEGY_RANDOM, jkutils.STRATEGY_ROUND} {
+
+		picker := buildPicker(strategy, conns)
+
+		// 每个goroutine单独统计，测试本身不引入同步，避免掩盖Pick中的数据竞争
+		counts := make([][conns]int, goroutines)
+
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < picks; i++ {
+					res, err := picker.Pick(balancer.PickInfo{})
+					if nil != err {
+						t.Error(err)
+						return
+					}
+
+					counts[g][res.SubConn.(*testSubConn).id]++
+
+					if nil != res.Done {
+						res.Done(balancer.DoneInfo{})
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		total := [conns]int{}
+		for g := range counts {
+			for id, count := range counts[g] {
+				total[id] += count
+			}
+		}
+
+		for id, count := range total {
+			if 0 == count {
+				t.Fatalf("strategy: %s, conn %d never picked, total: %v", strategy, id, total)
+			}
+			if jkutils.STRATEGY_ROUND == strategy && goroutines*picks/conns != count {
+				t.Fatalf("round not balanced, id: %d, count: %d", id, count)
+			}
+		}
+
+		if lp, ok := picker.(*leastPicker); ok {
+			for i := range lp.calls {
+				if 0 != lp.calls[i] {
+					t.Fatalf("least calls not released: %v", lp.calls)
+				}
+			}
+		}
+	}
+}
+
+func TestLeastPickerPreferIdle(t *testing.T) {
+
+	picker := buildPicker(jkutils.STRATEGY_LEAST, 3).(*leastPicker)
+
+	// 占用两个连接后，新请求应该选择空闲的连接
+	first, _ := picker.Pick(balancer.PickInfo{})
+	second, _ := picker.Pick(balancer.PickInfo{})
+	third, _ := picker.Pick(balancer.PickInfo{})
+
+	ids := map[int]bool{}
+	for _, res := range []balancer.PickResult{first, second, third} {
+		ids[res.SubConn.(*testSubConn).id] = true
+	}
+	if 3 != len(ids) {
+		t.Fatalf("least picker should spread in-flight requests, ids: %v", ids)
+	}
+}
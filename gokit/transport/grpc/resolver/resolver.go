@@ -0,0 +1,149 @@
+// Package resolver grpc原生的服务发现：注册 jkfr:///服务名称 的解析器和 least、random、round 负载均衡，
+// 直接使用 grpc.Dial 和 protoc 生成的客户端(包括流式调用)也可以使用jkfr注册中心。
+//
+//	conn, err := grpc.Dial("jkfr:///hello?tags=v1&strategy=round", grpc.WithTransportCredentials(insecure.NewCredentials()))
+//	client := pb.NewHelloClient(conn)
+//
+// 目标地址的参数：tags 服务发现的tags(逗号分隔)，passing_only 是否只使用健康的服务实例，strategy 负载均衡策略，
+// 没有指定时使用环境变量 C_CONSUL_TAGS、C_PASSING_ONLY、C_STRATEGY，注册中心地址等使用注册配置
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	jkregistry "github.com/jkprj/jkfr/gokit/registry"
+	jkutils "github.com/jkprj/jkfr/gokit/utils"
+	jklog "github.com/jkprj/jkfr/log"
+	jkos "github.com/jkprj/jkfr/os"
+
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+const SCHEME = "jkfr"
+
+func init() {
+	resolver.Register(NewBuilder())
+}
+
+// 服务名称对应的目标地址
+func Target(name string) string {
+	return SCHEME + ":///" + name
+}
+
+type builder struct {
+	ops []jkregistry.RegOption
+}
+
+// 创建解析器，ops 为服务发现选项(注册中心地址、WithFilter等)，
+// 通过 grpc.WithResolvers 使用时可以为不同的连接指定不同的注册配置，默认注册的解析器没有选项
+func NewBuilder(ops ...jkregistry.RegOption) resolver.Builder {
+	return &builder{ops: ops}
+}
+
+func (b *builder) Scheme() string {
+	return SCHEME
+}
+
+func (b *builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+
+	name := strings.TrimPrefix(target.URL.Path, "/")
+	if "" == name {
+		return nil, errors.New("jkfr resolver: service name is empty, target:" + target.URL.String())
+	}
+
+	query := target.URL.Query()
+
+	strategy := jkos.GetEnvString("C_STRATEGY", jkutils.STRATEGY_LEAST)
+	if query.Has("strategy") {
+		strategy = query.Get("strategy")
+	}
+
+	ops, err := b.options(query)
+	if nil != err {
+		return nil, err
+	}
+
+	r := &jkfrResolver{cc: cc, name: name}
+
+	r.serviceConfig = cc.ParseServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, BalancerName(strategy)))
+	if nil != r.serviceConfig.Err {
+		return nil, r.serviceConfig.Err
+	}
+
+	r.watcher, err = jkregistry.WatchFunc(name, r.update, ops...)
+	if nil != err {
+		jklog.Errorw("jkregistry.WatchFunc fail", "name", name, "err", err)
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// 客户端的tags和PassingOnly，目标地址的参数优先于选项
+func (b *builder) options(query url.Values) ([]jkregistry.RegOption, error) {
+
+	ops := []jkregistry.RegOption{
+		jkregistry.WithTags(jkos.GetEnvStrings("C_CONSUL_TAGS", ",", nil)...),
+		jkregistry.WithPassingOnly(jkos.GetEnvBool("C_PASSING_ONLY", true)),
+	}
+	ops = append(ops, b.ops...)
+
+	if query.Has("tags") {
+		var tags []string
+		if "" != query.Get("tags") {
+			tags = strings.Split(query.Get("tags"), ",")
+		}
+		ops = append(ops, jkregistry.WithTags(tags...))
+	}
+
+	if query.Has("passing_only") {
+		passingOnly, err := strconv.ParseBool(query.Get("passing_only"))
+		if nil != err {
+			return nil, fmt.Errorf("jkfr resolver: invalid passing_only:%s", query.Get("passing_only"))
+		}
+		ops = append(ops, jkregistry.WithPassingOnly(passingOnly))
+	}
+
+	return ops, nil
+}
+
+type jkfrResolver struct {
+	cc            resolver.ClientConn
+	name          string
+	serviceConfig *serviceconfig.ParseResult
+	watcher       *jkregistry.Watcher
+}
+
+// 服务实例变化时更新连接的地址，服务发现出错时继续使用出错前的服务实例
+func (r *jkfrResolver) update(event jkregistry.WatchEvent) {
+
+	if nil != event.Err {
+		jklog.Errorw("jkfr resolver watch fail", "name", r.name, "err", event.Err)
+		if 0 == len(event.Instances) {
+			r.cc.ReportError(event.Err)
+		}
+		return
+	}
+
+	addrs := make([]resolver.Address, 0, len(event.Instances))
+	for _, ins := range event.Instances {
+		addrs = append(addrs, resolver.Address{Addr: ins.Addr})
+	}
+
+	err := r.cc.UpdateState(resolver.State{Addresses: addrs, ServiceConfig: r.serviceConfig})
+	if nil != err {
+		jklog.Warnw("jkfr resolver update state fail", "name", r.name, "instances", len(addrs), "err", err)
+	}
+}
+
+// 服务实例由注册中心推送，不需要主动解析
+func (r *jkfrResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (r *jkfrResolver) Close() {
+	r.watcher.Stop()
+}
@@ -18,6 +18,11 @@ type EndpointsWrapInterface interface {
 }
 
 type RegisterServerFunc func(grpcServer *grpc.Server, serverEndpoints interface{})
+type CreateListenerFunc func(cfg *ServerConfig) (net.Listener, error)
+
+func TCPListenerFatory(cfg *ServerConfig) (net.Listener, error) {
+	return net.Listen("tcp", cfg.BindAddr)
+}
 
 func RunServer(name string, serverEndpoints interface{}, registerServerFunc RegisterServerFunc, ops ...ServerOption) error {
 
@@ -36,9 +41,9 @@ func RunServer(name string, serverEndpoints interface{}, registerServerFunc Regi
 	}
 	defer registry.Deregister()
 
-	ln, err := net.Listen("tcp", cfg.BindAddr)
+	ln, err := cfg.ListenerFatory(cfg)
 	if err != nil {
-		jklog.Errorw("net.Listen fail", "BindAddr", cfg.BindAddr, "err", err)
+		jklog.Errorw("create listener fail", "BindAddr", cfg.BindAddr, "err", err)
 		return err
 	}
 	defer ln.Close()
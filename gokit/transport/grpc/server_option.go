@@ -28,6 +28,7 @@ type ServerConfig struct {
 	RegOps            []jkregistry.RegOption        `json:"-" toml:"-"`
 	GRPCSvrOps        []grpc.ServerOption           `json:"-" toml:"-"`
 	ActionMiddlewares []jkendpoint.ActionMiddleware `json:"-" toml:"-"`
+	ListenerFatory    CreateListenerFunc            `json:"-" toml:"-"`
 	ConfigPath        string
 
 	tmpActionMiddlewares []jkendpoint.ActionMiddleware
@@ -67,6 +68,7 @@ func defaultServerConfig(serverName string) *ServerConfig {
 	cfg := new(ServerConfig)
 	cfg.RegOps = []jkregistry.RegOption{}
 	cfg.GRPCSvrOps = []grpc.ServerOption{}
+	cfg.ListenerFatory = TCPListenerFatory
 
 	cfg.ServerAddr = jkos.GetEnvString("S_SERVER_ADDR", "")
 	cfg.BindAddr = jkos.GetEnvString("S_BIND_ADDR", "")
@@ -246,6 +248,13 @@ func ServerGRPCSvrOp(grpcSvrOps ...grpc.ServerOption) ServerOption {
 	}
 }
 
+// 创建服务监听，默认监听tcp BindAddr
+func ServerListenerFatory(fatory CreateListenerFunc) ServerOption {
+	return func(cfg *ServerConfig) {
+		cfg.ListenerFatory = fatory
+	}
+}
+
 func ServerActionMiddlewares(actionMiddlewares ...jkendpoint.ActionMiddleware) ServerOption {
 	return func(cfg *ServerConfig) {
 		cfg.tmpActionMiddlewares = append(cfg.tmpActionMiddlewares, actionMiddlewares...)
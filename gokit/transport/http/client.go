@@ -15,6 +15,10 @@ import (
 
 	kitlog "github.com/jkprj/jkfr/gokit/log"
 	jkregistry "github.com/jkprj/jkfr/gokit/registry"
+	jksd "github.com/jkprj/jkfr/gokit/sd"
+	jktrans "github.com/jkprj/jkfr/gokit/transport"
+	"github.com/jkprj/jkfr/gokit/transport/breaker"
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
 	jkendpoint "github.com/jkprj/jkfr/gokit/transport/endpoint"
 	jkutils "github.com/jkprj/jkfr/gokit/utils"
 	jklb "github.com/jkprj/jkfr/gokit/utils/lb"
@@ -22,7 +26,6 @@ import (
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/sd"
-	kitconsul "github.com/go-kit/kit/sd/consul"
 	"github.com/go-kit/kit/sd/lb"
 	kithttp "github.com/go-kit/kit/transport/http"
 )
@@ -51,6 +54,24 @@ func Post(name, uri string, body []byte) (data []byte, err error) {
 	return client.Post(uri, body)
 }
 
+func GetContext(ctx context.Context, name, uri string) (data []byte, err error) {
+	client, err := GetClient(name)
+	if nil != err {
+		return nil, err
+	}
+
+	return client.GetContext(ctx, uri)
+}
+
+func PostContext(ctx context.Context, name, uri string, body []byte) (data []byte, err error) {
+	client, err := GetClient(name)
+	if nil != err {
+		return nil, err
+	}
+
+	return client.PostContext(ctx, uri, body)
+}
+
 func JSGet(name, uri string, rsp interface{}) (data []byte, err error) {
 	client, err := GetClient(name)
 	if nil != err {
@@ -158,14 +179,15 @@ type HttpClient struct {
 	name string
 	cfg  *ClientConfig
 
-	consulInstancer  *kitconsul.Instancer
-	consulEndpointer *sd.DefaultEndpointer
-	reqEndPoint      endpoint.Endpoint
+	instancer   sd.Instancer
+	endpointer  *jksd.DefaultEndpointer
+	reqEndPoint endpoint.Endpoint
 
 	actionEndPoint map[string]endpoint.Endpoint
 	mtAction       sync.RWMutex
 
-	consulClient kitconsul.Client
+	regBackend jkregistry.Backend
+	compress   *jkcompress.Options
 }
 
 func NewClient(name string, ops ...ClientOption) (client *HttpClient, err error) {
@@ -173,10 +195,11 @@ func NewClient(name string, ops ...ClientOption) (client *HttpClient, err error)
 	client.name = name
 	client.actionEndPoint = map[string]endpoint.Endpoint{}
 	client.cfg = newClientConfig(name, ops...)
+	client.compress = jkcompress.NewOptions(client.cfg.Compress, client.cfg.CompressMinSize, client.cfg.CompressMaxSize, client.cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, name)
 
-	client.consulClient, err = jkregistry.NewConsulClient(client.name, client.cfg.RegOps...)
+	client.regBackend, err = jkregistry.NewBackend(client.name, client.cfg.RegOps...)
 	if nil != err {
-		jklog.Errorw("jkregistry.NewConsulClient fail", "name:", client.name, "cfg", *client.cfg, "err", err.Error())
+		jklog.Errorw("jkregistry.NewBackend fail", "name:", client.name, "cfg", *client.cfg, "err", err.Error())
 		return nil, err
 	}
 
@@ -186,33 +209,51 @@ func NewClient(name string, ops ...ClientOption) (client *HttpClient, err error)
 }
 
 func (client *HttpClient) Get(uri string) (data []byte, err error) {
-	return client.httpRequest(uri, "Get", nil, makeEncodeRequest)
+	return client.GetContext(context.Background(), uri)
 }
 
 func (client *HttpClient) Post(uri string, body []byte) (data []byte, err error) {
-	return client.httpRequest(uri, "POST", body, makeEncodeRequest)
+	return client.PostContext(context.Background(), uri, body)
 }
 
 func (client *HttpClient) JSGet(uri string, rsp interface{}) (data []byte, err error) {
-	return client.jsHttpRequest(uri, "Get", nil, rsp, makeEncodeRequest)
+	return client.JSGetContext(context.Background(), uri, rsp)
 }
 
 func (client *HttpClient) JSPost(uri string, req, rsp interface{}) (data []byte, err error) {
-	return client.jsHttpRequest(uri, "POST", req, rsp, makeJSEncodeRequest)
+	return client.JSPostContext(context.Background(), uri, req, rsp)
+}
+
+// ctx的截止时间作用于包括重试在内的整个请求过程，ctx取消后立即返回
+// 一致性哈希策略(hash)下通过 jklb.WithHashKey 在ctx中设置哈希key，相同key的请求发送到同一个服务实例
+func (client *HttpClient) GetContext(ctx context.Context, uri string) (data []byte, err error) {
+	return client.httpRequest(ctx, uri, "Get", nil, makeEncodeRequest)
+}
+
+func (client *HttpClient) PostContext(ctx context.Context, uri string, body []byte) (data []byte, err error) {
+	return client.httpRequest(ctx, uri, "POST", body, makeEncodeRequest)
+}
+
+func (client *HttpClient) JSGetContext(ctx context.Context, uri string, rsp interface{}) (data []byte, err error) {
+	return client.jsHttpRequest(ctx, uri, "Get", nil, rsp, makeEncodeRequest)
+}
+
+func (client *HttpClient) JSPostContext(ctx context.Context, uri string, req, rsp interface{}) (data []byte, err error) {
+	return client.jsHttpRequest(ctx, uri, "POST", req, rsp, makeJSEncodeRequest)
 }
 
 func (client *HttpClient) Close() {
 
-	if nil != client.consulEndpointer {
-		client.consulEndpointer.Close()
+	if nil != client.endpointer {
+		client.endpointer.Close()
 	}
 
-	if nil != client.consulInstancer {
-		client.consulInstancer.Stop()
+	if nil != client.instancer {
+		client.instancer.Stop()
 	}
 }
 
-func (client *HttpClient) httpRequest(uri, method string, req interface{}, makeEnc MakeEncodeRequestFunc) (data []byte, err error) {
+func (client *HttpClient) httpRequest(ctx context.Context, uri, method string, req interface{}, makeEnc MakeEncodeRequestFunc) (data []byte, err error) {
 
 	action := client.cfg.GetAction(uri)
 
@@ -225,7 +266,7 @@ func (client *HttpClient) httpRequest(uri, method string, req interface{}, makeE
 
 	reqParam := reuquestParam{uri: uri, method: method, request: req, enc: makeEnc(client.cfg), dec: DecodeReponse}
 
-	resp, err := reqEndPoint(context.Background(), reqParam)
+	resp, err := reqEndPoint(jktrans.WithAction(ctx, action), reqParam)
 	if nil != err {
 		return nil, err
 	}
@@ -239,8 +280,8 @@ func (client *HttpClient) httpRequest(uri, method string, req interface{}, makeE
 	return resp.([]byte), nil
 }
 
-func (client *HttpClient) jsHttpRequest(uri, method string, req, rsp interface{}, makeEnc MakeEncodeRequestFunc) (data []byte, err error) {
-	data, err = client.httpRequest(uri, method, req, makeEnc)
+func (client *HttpClient) jsHttpRequest(ctx context.Context, uri, method string, req, rsp interface{}, makeEnc MakeEncodeRequestFunc) (data []byte, err error) {
+	data, err = client.httpRequest(ctx, uri, method, req, makeEnc)
 	if nil != err {
 		jklog.Errorw("httpRequest fail", "name", client.name, "uri", uri, "method", method, "req", req, "err", err.Error())
 		return data, err
@@ -256,8 +297,11 @@ func (client *HttpClient) jsHttpRequest(uri, method string, req, rsp interface{}
 }
 
 func (client *HttpClient) makeRequestFactory() sd.Factory {
-	return func(instance string) (endpoint endpoint.Endpoint, closer io.Closer, err error) {
-		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		// 按服务实例协商压缩
+		ic := &instanceCompress{opts: client.compress}
+
+		reqEndpoint := func(ctx context.Context, request interface{}) (response interface{}, err error) {
 			reqParam, ok := request.(reuquestParam)
 			if !ok {
 				return nil, errors.New("the request is not reuquestParam")
@@ -284,29 +328,64 @@ func (client *HttpClient) makeRequestFactory() sd.Factory {
 			// tgt.Path = reqParam.uri
 			jklog.Debugw("URL info", "tgt", tgt)
 
-			return kithttp.NewClient(reqParam.method, tgt, reqParam.enc, reqParam.dec).Endpoint()(ctx, reqParam.request)
-		}, nil, nil
+			return kithttp.NewClient(reqParam.method, tgt, ic.encodeRequest(reqParam.enc), ic.decodeResponse(reqParam.dec), client.cfg.HttpClientOps...).Endpoint()(ctx, reqParam.request)
+		}
+
+		// 故障转移到远程数据中心时统计跨数据中心请求
+		reqEndpoint = jktrans.CrossDCMiddleware(client.instancer, client.cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, client.name, instance)(reqEndpoint)
 
+		if !client.cfg.Breaker.Enable {
+			return reqEndpoint, nil, nil
+		}
+
+		// 实例从注册中心移除时会关闭熔断器
+		b := breaker.NewInstanceBreaker(client.cfg.Breaker, client.cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, client.name, instance)
+		return b.Middleware()(reqEndpoint), b, nil
 	}
 }
 
 func (client *HttpClient) makeRuquestEndpoint() endpoint.Endpoint {
 
-	client.consulInstancer = kitconsul.NewInstancer(client.consulClient, kitlog.InfowLogger, client.name, client.cfg.ConsulTags, client.cfg.PassingOnly)
-	client.consulEndpointer = sd.NewEndpointer(client.consulInstancer, client.makeRequestFactory(), kitlog.ErrorwLogger)
+	client.instancer = client.regBackend.NewInstancer(client.name, client.cfg.ConsulTags, client.cfg.PassingOnly)
+	client.endpointer = jksd.NewEndpointer(client.instancer, client.makeRequestFactory(), kitlog.ErrorwLogger,
+		jktrans.EndpointerOptions(client.cfg.InvalidateOnError, client.cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, client.name)...)
 
 	var balancer lb.Balancer
 	{
 		if jkutils.STRATEGY_ROUND == client.cfg.Strategy {
-			balancer = lb.NewRoundRobin(client.consulEndpointer)
+			balancer = lb.NewRoundRobin(client.endpointer)
 		} else if jkutils.STRATEGY_RANDOM == client.cfg.Strategy {
-			balancer = jklb.NewRandom(client.consulEndpointer, time.Now().UnixNano())
+			balancer = jklb.NewRandom(client.endpointer, time.Now().UnixNano())
+		} else if jkutils.STRATEGY_P2C_EWMA == client.cfg.Strategy {
+			balancer = jklb.NewP2CEWMABalancer(client.endpointer, breaker.BalancerClassifier(client.cfg.Breaker.IsFailure))
+		} else if jkutils.STRATEGY_CONSISTENT_HASH == client.cfg.Strategy {
+			balancer = jklb.NewConsistentHashBalancer(client.endpointer, breaker.BalancerClassifier(client.cfg.Breaker.IsFailure))
+		} else if jkutils.STRATEGY_WEIGHTED == client.cfg.Strategy {
+			balancer = jklb.NewWeightedBalancer(client.endpointer)
 		} else {
-			balancer = jklb.NewLeastBalancer(client.consulEndpointer)
+			balancer = jklb.NewLeastBalancer(client.endpointer)
 		}
 	}
 
-	return lb.Retry(client.cfg.Retry, time.Duration(client.cfg.TimeOut)*time.Second, balancer)
+	retry := jktrans.RetryWithPolicy(balancer, jktrans.RetryPolicy{
+		Max:                 client.cfg.Retry,
+		IntervalMS:          client.cfg.RetryIntervalMS,
+		MaxIntervalMS:       client.cfg.RetryMaxIntervalMS,
+		Budget:              client.cfg.RetryBudget,
+		Retryable:           client.cfg.RetryClassifier,
+		NonRetryableActions: client.cfg.NonRetryableActions,
+		PrometheusNameSpace: client.cfg.PrometheusNameSpace,
+		Role:                jkutils.ROLE_CLIENT,
+		Service:             client.name,
+	})
+
+	// TimeOut 作用于包括重试在内的整个请求过程
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		ctx, cancel := context.WithTimeout(ctx, time.Duration(client.cfg.TimeOut)*time.Second)
+		defer cancel()
+
+		return retry(ctx, request)
+	}
 }
 
 func makeEncodeRequest(cfg *ClientConfig) kithttp.EncodeRequestFunc {
@@ -5,6 +5,9 @@ import (
 	"strings"
 
 	jkregistry "github.com/jkprj/jkfr/gokit/registry"
+	jktrans "github.com/jkprj/jkfr/gokit/transport"
+	"github.com/jkprj/jkfr/gokit/transport/breaker"
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
 	jkendpoint "github.com/jkprj/jkfr/gokit/transport/endpoint"
 	jkutils "github.com/jkprj/jkfr/gokit/utils"
 	jkos "github.com/jkprj/jkfr/os"
@@ -28,6 +31,8 @@ type ClientConfig struct {
 	HttpClientOps     []kithttp.ClientOption        `json:"-" toml:"-"`
 	RegOps            []jkregistry.RegOption        `json:"-" toml:"-"`
 	ActionMiddlewares []jkendpoint.ActionMiddleware `json:"-" toml:"-"`
+	RetryBudget       *jktrans.RetryBudget          `json:"-" toml:"-"`
+	RetryClassifier   jktrans.RetryClassifier       `json:"-" toml:"-"`
 	Header            http.Header
 	ConfigPath        string
 
@@ -40,9 +45,20 @@ type ClientConfig struct {
 	PrometheusNameSpace string     `json:"PrometheusNameSpace" toml:"PrometheusNameSpace"`
 	Scheme              string     `json:"Scheme" toml:"Scheme"`
 	Retry               int        `json:"Retry" toml:"Retry"`
+	RetryIntervalMS     int        `json:"RetryIntervalMS" toml:"RetryIntervalMS"`
+	RetryMaxIntervalMS  int        `json:"RetryMaxIntervalMS" toml:"RetryMaxIntervalMS"`
+	NonRetryableActions []string   `json:"NonRetryableActions" toml:"NonRetryableActions"`
 	RateLimit           rate.Limit `json:"RateLimit" toml:"RateLimit"`
 	TimeOut             int        `json:"TimeOut" toml:"TimeOut"`
 	PassingOnly         bool       `json:"PassingOnly" toml:"PassingOnly"`
+	InvalidateOnError   int        `json:"InvalidateOnError" toml:"InvalidateOnError"`
+	Filter              string     `json:"Filter" toml:"Filter"`
+	FailoverDatacenters []string   `json:"FailoverDatacenters" toml:"FailoverDatacenters"`
+	Compress            string     `json:"Compress" toml:"Compress"`
+	CompressMinSize     int        `json:"CompressMinSize" toml:"CompressMinSize"`
+	CompressMaxSize     int        `json:"CompressMaxSize" toml:"CompressMaxSize"`
+
+	Breaker breaker.Config `json:"Breaker" toml:"Breaker"` // 熔断配置
 }
 
 type clientConfig struct {
@@ -80,9 +96,20 @@ func defaultClientConfig(name string) *ClientConfig {
 	cfg.PrometheusNameSpace = jkos.GetEnvString("C_PROMETHEUS_NAME_SPACE", name)
 	cfg.Scheme = jkos.GetEnvString("C_SCHEME", jkutils.HTTP)
 	cfg.Retry = jkos.GetEnvInt("C_RETRY", 3)
+	cfg.RetryIntervalMS = jkos.GetEnvInt("C_RETRY_INTERVAL_MS", 1000)
+	cfg.RetryMaxIntervalMS = jkos.GetEnvInt("C_RETRY_MAX_INTERVAL_MS", 10000)
+	cfg.NonRetryableActions = jkos.GetEnvStrings("C_NON_RETRYABLE_ACTIONS", ",", nil)
+	cfg.RetryBudget = jktrans.DefaultRetryBudget
 	cfg.RateLimit = rate.Limit(jkos.GetEnvInt("C_RATE_LIMIT", 0))
 	cfg.TimeOut = jkos.GetEnvInt("C_TIME_OUT", 60)
 	cfg.PassingOnly = jkos.GetEnvBool("C_PASSING_ONLY", true)
+	cfg.InvalidateOnError = jkos.GetEnvInt("C_INVALIDATE_ON_ERROR", -1)
+	cfg.Filter = jkos.GetEnvString("C_FILTER", "")
+	cfg.FailoverDatacenters = jkos.GetEnvStrings("C_FAILOVER_DATACENTERS", ",", nil)
+	cfg.Compress = jkos.GetEnvString("C_COMPRESS", "")
+	cfg.CompressMinSize = jkos.GetEnvInt("C_COMPRESS_MIN_SIZE", jkcompress.DEFAULT_MIN_SIZE)
+	cfg.CompressMaxSize = jkos.GetEnvInt("C_COMPRESS_MAX_SIZE", jkcompress.DEFAULT_MAX_SIZE)
+	cfg.Breaker = breaker.DefaultConfig()
 
 	cfg.ConfigPath = jkos.GetEnvString("C_CONFIG_PATH", "")
 	if jkos.IsFileExists(cfg.ConfigPath) {
@@ -114,12 +141,25 @@ func newClientConfig(name string, ops ...ClientOption) *ClientConfig {
 		op(cfg)
 	}
 
+	// 客户端指定的过滤表达式和故障转移数据中心优先于注册配置
+	if "" != cfg.Filter {
+		cfg.RegOps = append(cfg.RegOps, jkregistry.WithFilter(cfg.Filter))
+	}
+	if 0 < len(cfg.FailoverDatacenters) {
+		cfg.RegOps = append(cfg.RegOps, jkregistry.WithFailoverDatacenters(cfg.FailoverDatacenters...))
+	}
+
 	cfg.ActionMiddlewares = jkendpoint.DefaultMiddleware(cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, cfg.RateLimit)
 
 	if 0 < len(cfg.tmpActionMiddlewares) {
 		cfg.ActionMiddlewares = cfg.tmpActionMiddlewares
 	}
 
+	// 自定义中间件时也需要按方法熔断
+	if cfg.Breaker.PerAction {
+		cfg.ActionMiddlewares = append(cfg.ActionMiddlewares, jkendpoint.MakeBreakerMiddleware(cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, name, cfg.Breaker))
+	}
+
 	return cfg
 }
 
@@ -204,12 +244,104 @@ func ClientPassingOnly(passingOnly bool) ClientOption {
 	}
 }
 
+// 服务发现出错后多少秒清空服务实例，<0 时一直使用出错前的服务实例
+func ClientInvalidateOnError(seconds int) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.InvalidateOnError = seconds
+	}
+}
+
+// 服务发现的consul过滤表达式，如 Service.Meta.version == "v2" or "canary" in Service.Tags，
+// 本地过滤函数通过 ClientRegOption(jkregistry.WithInstanceFilter(...)) 指定
+func ClientFilter(expr string) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.Filter = expr
+	}
+}
+
+// 故障转移的远程数据中心，本地数据中心健康的服务实例少于阈值(jkregistry.WithFailoverThreshold)时按顺序使用
+func ClientFailoverDatacenters(datacenters ...string) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.FailoverDatacenters = datacenters
+	}
+}
+
+// 请求体的压缩算法(gzip)，服务实例在响应头 Accept-Encoding 中声明支持后才压缩
+func ClientCompress(compress string) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.Compress = compress
+	}
+}
+
+func ClientCompressMinSize(size int) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.CompressMinSize = size
+	}
+}
+
+// 响应体解压后的最大大小(字节)，超过时读取响应体返回 compress.ErrTooLarge
+func ClientCompressMaxSize(size int) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.CompressMaxSize = size
+	}
+}
+
 func ClientActionMiddlewares(actionMiddlewares ...jkendpoint.ActionMiddleware) ClientOption {
 	return func(cfg *ClientConfig) {
 		cfg.tmpActionMiddlewares = append(cfg.tmpActionMiddlewares, actionMiddlewares...)
 	}
 }
 
+func ClientRetryIntervalMS(retryIntervalMS int) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.RetryIntervalMS = retryIntervalMS
+	}
+}
+
+func ClientRetryMaxIntervalMS(retryMaxIntervalMS int) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.RetryMaxIntervalMS = retryMaxIntervalMS
+	}
+}
+
+// 不允许重试的action，如非幂等的接口
+func ClientNonRetryableActions(actions ...string) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.NonRetryableActions = append(cfg.NonRetryableActions, actions...)
+	}
+}
+
+// 重试预算，默认使用全局共享的 jktrans.DefaultRetryBudget，为nil时不限制
+func ClientRetryBudget(budget *jktrans.RetryBudget) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.RetryBudget = budget
+	}
+}
+
+// 判断失败的调用是否可以重试
+func ClientRetryClassifier(classifier jktrans.RetryClassifier) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.RetryClassifier = classifier
+	}
+}
+
+// 熔断配置，见 breaker.Config
+func ClientBreaker(breakerCfg breaker.Config) ClientOption {
+	return func(cfg *ClientConfig) {
+		if nil == breakerCfg.IsFailure {
+			breakerCfg.IsFailure = cfg.Breaker.IsFailure
+		}
+		cfg.Breaker = breakerCfg
+	}
+}
+
+// 熔断的失败判断，不设置时使用客户端默认的判断(业务错误不计为失败)
+func ClientBreakerClassifier(isFailure breaker.Classifier) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.Breaker.IsFailure = isFailure
+	}
+}
+
 func ClientConfigFile(cfgPath string) ClientOption {
 	return func(cfg *ClientConfig) {
 
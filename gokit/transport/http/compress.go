@@ -0,0 +1,128 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
+
+	kithttp "github.com/go-kit/kit/transport/http"
+)
+
+const (
+	headerAcceptEncoding  = "Accept-Encoding"
+	headerContentEncoding = "Content-Encoding"
+)
+
+// 服务实例的压缩协商状态：请求头声明客户端可以接收的压缩算法，
+// 实例在响应头 Accept-Encoding 中声明支持后才压缩请求体，不支持压缩的实例不会收到压缩数据
+type instanceCompress struct {
+	opts     *jkcompress.Options
+	encoding atomic.Value
+}
+
+func (ic *instanceCompress) negotiated() string {
+	encoding, _ := ic.encoding.Load().(string)
+	return encoding
+}
+
+func (ic *instanceCompress) encodeRequest(enc kithttp.EncodeRequestFunc) kithttp.EncodeRequestFunc {
+	return func(ctx context.Context, req *http.Request, request interface{}) error {
+
+		if err := enc(ctx, req, request); nil != err {
+			return err
+		}
+
+		if !ic.opts.Enabled() {
+			return nil
+		}
+
+		// 设置了 Accept-Encoding 后 http.Transport 不会自动解压响应，由 decodeResponse 解压
+		req.Header.Set(headerAcceptEncoding, ic.opts.Accept())
+
+		encoding := ic.negotiated()
+		if "" == encoding || nil == req.Body || "" != req.Header.Get(headerContentEncoding) {
+			return nil
+		}
+
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if nil != err {
+			return err
+		}
+
+		body, encoding, err = ic.opts.Compress(encoding, body)
+		if nil != err {
+			return err
+		}
+
+		if "" != encoding {
+			req.Header.Set(headerContentEncoding, encoding)
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+
+		return nil
+	}
+}
+
+func (ic *instanceCompress) decodeResponse(dec kithttp.DecodeResponseFunc) kithttp.DecodeResponseFunc {
+	return func(ctx context.Context, resp *http.Response) (interface{}, error) {
+
+		if !ic.opts.Enabled() {
+			return dec(ctx, resp)
+		}
+
+		if encoding := ic.opts.Negotiate(resp.Header.Get(headerAcceptEncoding)); encoding != ic.negotiated() {
+			ic.encoding.Store(encoding)
+		}
+
+		if encoding := resp.Header.Get(headerContentEncoding); "" != encoding && nil != jkcompress.Get(encoding) {
+			r, err := ic.opts.NewReader(encoding, resp.Body)
+			if nil != err {
+				resp.Body.Close()
+				return nil, err
+			}
+
+			resp.Body = readCloser{Reader: r, Closer: resp.Body}
+			resp.Header.Del(headerContentEncoding)
+			resp.ContentLength = -1
+		}
+
+		return dec(ctx, resp)
+	}
+}
+
+// 服务端声明可以接收的压缩算法，并解压请求体，解压后超过 MaxSize 时读取请求体返回 ErrTooLarge
+func decompressRequest(opts *jkcompress.Options, rspw http.ResponseWriter, req *http.Request) error {
+
+	if !opts.Enabled() {
+		return nil
+	}
+
+	rspw.Header().Set(headerAcceptEncoding, opts.Accept())
+
+	encoding := req.Header.Get(headerContentEncoding)
+	if "" == encoding || nil == jkcompress.Get(encoding) {
+		return nil
+	}
+
+	r, err := opts.NewReader(encoding, req.Body)
+	if nil != err {
+		return err
+	}
+
+	req.Body = readCloser{Reader: r, Closer: req.Body}
+	req.Header.Del(headerContentEncoding)
+	req.ContentLength = -1
+
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
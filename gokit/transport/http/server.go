@@ -2,23 +2,38 @@ package http
 
 import (
 	"context"
-
+	"net"
 	"net/http"
 
 	jkregistry "github.com/jkprj/jkfr/gokit/registry"
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
 	jkendpoint "github.com/jkprj/jkfr/gokit/transport/endpoint"
+	jkutils "github.com/jkprj/jkfr/gokit/utils"
 	jklog "github.com/jkprj/jkfr/log"
 
 	"github.com/go-kit/kit/endpoint"
 )
 
+type CreateListenerFunc func(cfg *ServerConfig) (net.Listener, error)
+
+func TCPListenerFatory(cfg *ServerConfig) (net.Listener, error) {
+	return net.Listen("tcp", cfg.BindAddr)
+}
+
 type UHandler struct {
-	handler http.Handler
-	cfg     *ServerConfig
+	handler  http.Handler
+	cfg      *ServerConfig
+	compress *jkcompress.Options
 }
 
 func (uh *UHandler) ServeHTTP(rspw http.ResponseWriter, req *http.Request) {
 
+	if err := decompressRequest(uh.compress, rspw, req); nil != err {
+		jklog.Errorw("decompress request fail", "encoding", req.Header.Get(headerContentEncoding), "err", err)
+		http.Error(rspw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	action := uh.cfg.GetAction(req)
 
 	serverHttpEndpoint := makeServerHttpEndpoint(rspw, req, uh.handler)
@@ -31,6 +46,7 @@ func RunServer(name string, handler http.Handler, ops ...ServerOption) error {
 
 	uhandler := UHandler{handler: handler}
 	uhandler.cfg = newServerConfig(name, ops...)
+	uhandler.compress = jkcompress.NewOptions(uhandler.cfg.Compress, 0, uhandler.cfg.CompressMaxSize, uhandler.cfg.PrometheusNameSpace, jkutils.ROLE_SERVER, name)
 
 	registry, err := jkregistry.RegistryServerWithServerAddr(name, uhandler.cfg.ServerAddr, uhandler.cfg.RegOps...)
 	if nil != err {
@@ -39,7 +55,13 @@ func RunServer(name string, handler http.Handler, ops ...ServerOption) error {
 	}
 	defer registry.Deregister()
 
-	err = http.ListenAndServe(uhandler.cfg.BindAddr, &uhandler)
+	ln, err := uhandler.cfg.ListenerFatory(uhandler.cfg)
+	if nil != err {
+		jklog.Errorw("create listener fail", "BindAddr", uhandler.cfg.BindAddr, "err", err)
+		return err
+	}
+
+	err = http.Serve(ln, &uhandler)
 	if nil != err {
 		jklog.Errorw("http server return error", "BindAddr", uhandler.cfg.BindAddr, "err", err)
 	} else {
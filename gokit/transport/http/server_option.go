@@ -4,6 +4,7 @@ import (
 	"net/http"
 
 	jkregistry "github.com/jkprj/jkfr/gokit/registry"
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
 	jkendpoint "github.com/jkprj/jkfr/gokit/transport/endpoint"
 	jkutils "github.com/jkprj/jkfr/gokit/utils"
 	jklog "github.com/jkprj/jkfr/log"
@@ -20,10 +21,13 @@ type ServerConfig struct {
 	BindAddr            string     `json:"BindAddr" toml:"BindAddr"`
 	RateLimit           rate.Limit `json:"RateLimit" toml:"RateLimit"`
 	PrometheusNameSpace string     `json:"PrometheusNameSpace" toml:"PrometheusNameSpace"`
+	Compress            string     `json:"Compress" toml:"Compress"`
+	CompressMaxSize     int        `json:"CompressMaxSize" toml:"CompressMaxSize"`
 
 	GetAction         GetActionFunc                 `json:"-" toml:"-"`
 	RegOps            []jkregistry.RegOption        `json:"-" toml:"-"`
 	ActionMiddlewares []jkendpoint.ActionMiddleware `json:"-" toml:"-"`
+	ListenerFatory    CreateListenerFunc            `json:"-" toml:"-"`
 	ConfigPath        string
 
 	tmpActionMiddlewares []jkendpoint.ActionMiddleware
@@ -37,11 +41,14 @@ func defaultServerConfig(serverName string) *ServerConfig {
 	cfg := new(ServerConfig)
 	cfg.GetAction = defaultServerGetAction
 	cfg.RegOps = []jkregistry.RegOption{}
+	cfg.ListenerFatory = TCPListenerFatory
 
 	cfg.ServerAddr = jkos.GetEnvString("S_SERVER_ADDR", "")
 	cfg.BindAddr = jkos.GetEnvString("S_BIND_ADDR", "")
 	cfg.PrometheusNameSpace = jkos.GetEnvString("S_PROMETHEUS_NAME_SPACE", serverName)
 	cfg.RateLimit = rate.Limit(jkos.GetEnvInt("S_RATE_LIMIT", 0))
+	cfg.Compress = jkos.GetEnvString("S_COMPRESS", "")
+	cfg.CompressMaxSize = jkos.GetEnvInt("S_COMPRESS_MAX_SIZE", jkcompress.DEFAULT_MAX_SIZE)
 
 	cfg.ConfigPath = jkos.GetEnvString("S_CONFIG_PATH", "")
 	if jkos.IsFileExists(cfg.ConfigPath) {
@@ -136,6 +143,27 @@ func ServerGetAction(getActionFunc GetActionFunc) ServerOption {
 	}
 }
 
+// 创建服务监听，默认监听tcp BindAddr
+func ServerListenerFatory(fatory CreateListenerFunc) ServerOption {
+	return func(cfg *ServerConfig) {
+		cfg.ListenerFatory = fatory
+	}
+}
+
+// 声明可以接收的请求体压缩算法(gzip)，并解压客户端压缩的请求体
+func ServerCompress(compress string) ServerOption {
+	return func(cfg *ServerConfig) {
+		cfg.Compress = compress
+	}
+}
+
+// 请求体解压后的最大大小(字节)，超过时读取请求体返回 compress.ErrTooLarge
+func ServerCompressMaxSize(size int) ServerOption {
+	return func(cfg *ServerConfig) {
+		cfg.CompressMaxSize = size
+	}
+}
+
 func ServerActionMiddlewares(actionMiddlewares ...jkendpoint.ActionMiddleware) ClientOption {
 	return func(cfg *ClientConfig) {
 		cfg.tmpActionMiddlewares = append(cfg.tmpActionMiddlewares, actionMiddlewares...)
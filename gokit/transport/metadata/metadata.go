@@ -0,0 +1,123 @@
+package metadata
+
+import (
+	"context"
+	"strings"
+)
+
+const (
+	KEY_REQUEST_ID = "x-request-id" // 请求ID
+	KEY_CALLER     = "x-caller"     // 调用方
+)
+
+// 请求元数据，key统一为小写
+type MD map[string]string
+
+type outgoingKey struct{}
+type incomingKey struct{}
+
+// 根据键值对创建元数据，kv个数为奇数时最后一个key的值为空
+func Pairs(kv ...string) MD {
+	md := MD{}
+	for i := 0; i < len(kv); i += 2 {
+		if i+1 < len(kv) {
+			md.Set(kv[i], kv[i+1])
+		} else {
+			md.Set(kv[i], "")
+		}
+	}
+
+	return md
+}
+
+func (md MD) Get(key string) string {
+	return md[strings.ToLower(key)]
+}
+
+func (md MD) Set(key, value string) {
+	md[strings.ToLower(key)] = value
+}
+
+func (md MD) Copy() MD {
+	cp := make(MD, len(md))
+	for k, v := range md {
+		cp[k] = v
+	}
+
+	return cp
+}
+
+// 客户端：设置要发送给服务端的元数据，会替换ctx中已有的元数据
+func NewOutgoingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, outgoingKey{}, md)
+}
+
+// 客户端：在ctx已有元数据的基础上追加键值对
+func AppendToOutgoingContext(ctx context.Context, kv ...string) context.Context {
+	md, ok := FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = MD{}
+	}
+
+	for k, v := range Pairs(kv...) {
+		md[k] = v
+	}
+
+	return NewOutgoingContext(ctx, md)
+}
+
+// 客户端：获取要发送给服务端的元数据
+func FromOutgoingContext(ctx context.Context) (md MD, ok bool) {
+	md, ok = ctx.Value(outgoingKey{}).(MD)
+	return
+}
+
+// 服务端：设置收到的元数据
+func NewIncomingContext(ctx context.Context, md MD) context.Context {
+	return context.WithValue(ctx, incomingKey{}, md)
+}
+
+// 服务端：获取客户端发送的元数据
+func FromIncomingContext(ctx context.Context) (md MD, ok bool) {
+	md, ok = ctx.Value(incomingKey{}).(MD)
+	return
+}
+
+// 嵌入到rpc请求参数中，服务端解码请求后会把元数据和截止时间设置到 Context() 中，例如：
+//
+//	type URequest struct {
+//		metadata.Carrier
+//		Name string
+//	}
+//
+//	func (e *Hello) Hello(request URequest, response *URespone) error {
+//		resp, err := e.helloEndpoint(request.Context(), request)
+//		...
+//	}
+type Carrier struct {
+	Meta MD `json:"-" toml:"-"` // 服务端收到的元数据，客户端不需要设置
+
+	ctx context.Context
+}
+
+// 服务端编解码调用，设置请求的ctx
+func (c *Carrier) SetContext(ctx context.Context) {
+	c.ctx = ctx
+	c.Meta, _ = FromIncomingContext(ctx)
+}
+
+// 请求的ctx，包含客户端发送的元数据和剩余的截止时间
+func (c Carrier) Context() context.Context {
+	if nil == c.ctx {
+		return context.Background()
+	}
+
+	return c.ctx
+}
+
+// 服务端编解码通过该接口设置请求的ctx
+type ContextSetter interface {
+	SetContext(ctx context.Context)
+}
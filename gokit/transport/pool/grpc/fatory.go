@@ -92,6 +92,36 @@ func (client *ClientHandle) call(ctx context.Context, action string, request int
 	return nil, errors.New("client not found action")
 }
 
+// 打开流，服务端流的方法参数为(ctx, req)，客户端流和双向流的方法参数为(ctx)
+func (client *ClientHandle) stream(ctx context.Context, st StreamType, action string, request interface{}) (*Stream, error) {
+
+	callfunc, ok := client.action2func[action]
+	if !ok {
+		jklog.Errorw("Stream fail, action not found", "action", action)
+		return nil, fmt.Errorf("Stream fail, action[%s] not found", action)
+	}
+
+	if err := checkStreamFunc(action, callfunc.Type(), st); nil != err {
+		return nil, err
+	}
+
+	args := []reflect.Value{reflect.ValueOf(ctx)}
+	if SERVER_STREAM == st {
+		if nil == request || !reflect.TypeOf(request).AssignableTo(callfunc.Type().In(1)) {
+			return nil, fmt.Errorf("Stream request type invalid, action:%s, type:%T", action, request)
+		}
+		args = append(args, reflect.ValueOf(request))
+	}
+
+	tmpRes := callfunc.Call(args)
+
+	if err, _ := tmpRes[1].Interface().(error); nil != err {
+		return nil, err
+	}
+
+	return newStream(tmpRes[0].Interface().(grpc.ClientStream)), nil
+}
+
 type ClientFatory func(conn *grpc.ClientConn) (server interface{}, err error)
 
 func GRPCConn(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
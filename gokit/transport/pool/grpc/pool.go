@@ -42,23 +42,76 @@ func (rp *GRPCPool) CallWithContext(ctx context.Context, action string, request
 	}
 
 	resp, err := client.call(ctx, action, request)
+	rp.pool.Put(c, connGood(err))
 	if nil != err {
-		st, ok := status.FromError(err)
-		if ok && (codes.OK == st.Code() ||
-			codes.Unknown == st.Code() ||
-			codes.Unimplemented == st.Code()) {
-
-			rp.pool.Put(c, jkpool.GOOD) // 非网络原因导致的失败不回收
-		} else {
-			rp.pool.Put(c, jkpool.BAD)
-		}
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// 打开流，流结束前一直占用连接，服务端流在收到第一个响应(或流正常结束)后返回
+func (rp *GRPCPool) StreamWithContext(ctx context.Context, st StreamType, action string, request interface{}) (*Stream, error) {
+	return rp.stream(ctx, st, action, request, nil)
+}
+
+// onFinish 在连接放回连接池后调用，需要在预先接收第一个响应前添加，服务端流可能在第一个响应前就结束
+func (rp *GRPCPool) stream(ctx context.Context, st StreamType, action string, request interface{}, onFinish func(err error)) (*Stream, error) {
 
+	c, err := rp.pool.Get()
+	if nil != err {
 		return nil, err
 	}
 
-	rp.pool.Put(c, jkpool.GOOD)
+	client, ok := c.Client.(*ClientHandle)
+	if !ok {
+		rp.pool.Put(c, jkpool.GOOD)
+		return nil, errors.New("tranfer to ClientHandle fail")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
 
-	return resp, nil
+	stream, err := client.stream(ctx, st, action, request)
+	if nil != err {
+		cancel()
+		rp.pool.Put(c, connGood(err))
+		return nil, err
+	}
+
+	stream.cancel = cancel
+	stream.touch = c.Touch
+	stream.onFinish(func(err error) {
+		rp.pool.Put(c, connGood(streamError(err)))
+	})
+	if nil != onFinish {
+		stream.onFinish(onFinish)
+	}
+
+	if SERVER_STREAM == st {
+		if err = stream.prefetch(); nil != err {
+			return nil, err
+		}
+	}
+
+	go stream.watch(ctx)
+
+	return stream, nil
+}
+
+// 非网络原因导致的失败不回收连接
+func connGood(err error) bool {
+	if nil == err {
+		return jkpool.GOOD
+	}
+
+	st, ok := status.FromError(err)
+	if ok && (codes.OK == st.Code() ||
+		codes.Unknown == st.Code() ||
+		codes.Unimplemented == st.Code()) {
+		return jkpool.GOOD
+	}
+
+	return jkpool.BAD
 }
 
 func (rp *GRPCPool) Call(action string, req interface{}) (rsp interface{}, err error) {
@@ -12,9 +12,12 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	jkpool "github.com/jkprj/jkfr/gokit/transport/pool"
 	jkutils "github.com/jkprj/jkfr/gokit/utils"
+	jklb "github.com/jkprj/jkfr/gokit/utils/lb"
 	jkrand "github.com/jkprj/jkfr/gokit/utils/rand"
 	jklog "github.com/jkprj/jkfr/log"
 )
@@ -31,6 +34,8 @@ type stpool struct {
 	last   time.Time
 	call   int64
 	static bool // 静态创建的pool不能超时关闭，只有动态创建的pool才能超时关闭
+
+	stat jklb.EWMAStat // p2c_ewma 策略的负载统计
 }
 
 type GRPCPools struct {
@@ -111,12 +116,14 @@ func (pls *GRPCPools) call(ctx context.Context, serviceMethod string, args inter
 	}
 
 	atomic.AddInt64(&pl.call, 1)
+	bg := pl.stat.Start()
 
 	resp, err = pl.pl.CallWithContext(ctx, serviceMethod, args)
 	// if nil != err {
 	// 	log.Errorw("Call fail", "method", serviceMethod, "error", err)
 	// }
 
+	pl.stat.Done(bg, isFailure(err))
 	atomic.AddInt64(&pl.call, -1)
 	pl.last = time.Now()
 
@@ -221,6 +228,12 @@ func (pls *GRPCPools) CallWithAddr(addr string, serviceMethod string, args inter
 
 func (pls *GRPCPools) CallWithAddrEx(addr string, serviceMethod string, args interface{}, timeout time.Duration) (resp interface{}, err error) {
 
+	return pls.CallWithAddrContext(context.Background(), addr, serviceMethod, args, timeout)
+}
+
+// 指定服务地址调用，ctx的截止时间和timeout哪个先到以哪个为准
+func (pls *GRPCPools) CallWithAddrContext(ctx context.Context, addr string, serviceMethod string, args interface{}, timeout time.Duration) (resp interface{}, err error) {
+
 	return pls.call_with_func(func() (resp interface{}, err error) {
 
 		pl, err := pls.getex(addr)
@@ -231,9 +244,9 @@ func (pls *GRPCPools) CallWithAddrEx(addr string, serviceMethod string, args int
 
 		atomic.AddInt64(&pl.call, 1)
 
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
 
-		resp, err = pl.pl.CallWithContext(ctx, serviceMethod, args)
+		resp, err = pl.pl.CallWithContext(callCtx, serviceMethod, args)
 
 		cancel()
 
@@ -244,6 +257,84 @@ func (pls *GRPCPools) CallWithAddrEx(addr string, serviceMethod string, args int
 	})
 }
 
+// 按负载均衡策略选择服务打开流，服务端流在收到第一个响应前失败时重试，
+// 客户端流和双向流只在建立流失败时重试，使用完需要调用 Stream.Close
+func (pls *GRPCPools) StreamWithContext(ctx context.Context, st StreamType, serviceMethod string, args interface{}) (*Stream, error) {
+
+	resp, err := pls.call_with_func(func() (resp interface{}, err error) {
+
+		pl := pls.get_pool()
+		if nil == pl {
+			jklog.Errorw("not found server")
+			return nil, errors.New("not found server")
+		}
+
+		return pls.stream(ctx, pl, st, serviceMethod, args, 0)
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	return resp.(*Stream), nil
+}
+
+// 指定服务地址打开流，timeout 只作用于建立流(服务端流为收到第一个响应)之前，ctx作用于整个流
+func (pls *GRPCPools) StreamWithAddrContext(ctx context.Context, addr string, st StreamType, serviceMethod string, args interface{}, timeout time.Duration) (*Stream, error) {
+
+	resp, err := pls.call_with_func(func() (resp interface{}, err error) {
+
+		pl, err := pls.getex(addr)
+		if nil != err {
+			jklog.Errorw("getex client fail", "addr", addr, "method", serviceMethod, "error", err)
+			return nil, err
+		}
+
+		return pls.stream(ctx, pl, st, serviceMethod, args, timeout)
+	})
+	if nil != err {
+		return nil, err
+	}
+
+	return resp.(*Stream), nil
+}
+
+// 流结束前计入连接池正在处理的请求数，timeout<=0 时不限制建立流的时间
+func (pls *GRPCPools) stream(ctx context.Context, pl *stpool, st StreamType, serviceMethod string, args interface{}, timeout time.Duration) (interface{}, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	// 流可能在返回前就已经结束(如服务端流没有响应)，done只执行一次
+	var once sync.Once
+	atomic.AddInt64(&pl.call, 1)
+	done := func(error) {
+		once.Do(func() {
+			cancel()
+			pl.last = time.Now()
+			atomic.AddInt64(&pl.call, -1)
+		})
+	}
+
+	var timer *time.Timer
+	if 0 < timeout {
+		timer = time.AfterFunc(timeout, cancel)
+	}
+
+	stream, err := pl.pl.stream(ctx, st, serviceMethod, args, done)
+	if nil != timer && !timer.Stop() {
+		if nil == err {
+			stream.Close()
+		}
+		err = status.Error(codes.DeadlineExceeded, "grpc stream open timeout, method:"+serviceMethod)
+	}
+
+	if nil != err {
+		done(err)
+		return nil, err
+	}
+
+	return stream, nil
+}
+
 func (pls *GRPCPools) Close() {
 	pls.mtNew.Lock()
 	defer pls.mtNew.Unlock()
@@ -328,6 +419,10 @@ func (pls *GRPCPools) SetStrategy(strategy string) {
 		pls.get_pool = func() *stpool {
 			return pls.roll_get()
 		}
+	} else if jkutils.STRATEGY_P2C_EWMA == strategy {
+		pls.get_pool = func() *stpool {
+			return pls.p2c_get()
+		}
 	} else {
 		pls.strategy = jkutils.STRATEGY_LEAST
 		pls.get_pool = func() *stpool {
@@ -430,6 +525,26 @@ func (pls *GRPCPools) random_get() *stpool {
 	return pls.get_index_ex(pls.index)
 }
 
+// 随机选两个连接池，选 峰值EWMA延迟*正在处理请求数 较小的
+func (pls *GRPCPools) p2c_get() *stpool {
+
+	pls.mtPool.RLock()
+
+	nlen := len(pls.pools)
+	if nlen == 0 {
+		pls.mtPool.RUnlock()
+		return nil
+	}
+
+	index := jklb.P2CPick(nlen, func(i int) float64 {
+		return pls.pools[i].stat.Score()
+	})
+
+	pls.mtPool.RUnlock()
+
+	return pls.get_index_ex(uint32(index))
+}
+
 func (pls *GRPCPools) least_get() *stpool {
 
 	pls.mtPool.RLock()
@@ -636,3 +751,17 @@ func (pls *GRPCPools) remove_idle_time_out() {
 		i++
 	}
 }
+
+// p2c_ewma 策略的失败判断，只有服务不可用、超时和连接类错误算失败，其他状态码属于业务错误
+func isFailure(err error) bool {
+	if nil == err || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	st, ok := status.FromError(err)
+	if !ok {
+		return true
+	}
+
+	return codes.Unavailable == st.Code() || codes.DeadlineExceeded == st.Code()
+}
@@ -0,0 +1,61 @@
+package grpc
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	testpb "google.golang.org/grpc/interop/grpc_testing"
+)
+
+type emptyStreamServer struct {
+	testpb.UnimplementedTestServiceServer
+}
+
+// 服务端流不返回任何响应
+func (s *emptyStreamServer) StreamingOutputCall(*testpb.StreamingOutputCallRequest, testpb.TestService_StreamingOutputCallServer) error {
+	return nil
+}
+
+func TestStreamEmptyServerStream(t *testing.T) {
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	svr := grpc.NewServer()
+	testpb.RegisterTestServiceServer(svr, &emptyStreamServer{})
+	go svr.Serve(lis)
+	defer svr.Stop()
+
+	addr := lis.Addr().String()
+	pls, err := NewDefaultGRPCPoolsWithAddr([]string{addr}, func(conn *grpc.ClientConn) (interface{}, error) {
+		return testpb.NewTestServiceClient(conn), nil
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer pls.Close()
+
+	for _, timeout := range []time.Duration{0, time.Second} {
+		stream, err := pls.StreamWithAddrContext(context.Background(), addr, SERVER_STREAM, "StreamingOutputCall", &testpb.StreamingOutputCallRequest{}, timeout)
+		if nil != err {
+			t.Fatal(err)
+		}
+
+		if _, err = stream.Recv(); io.EOF != err {
+			t.Fatalf("Recv err:%v, want io.EOF", err)
+		}
+		stream.Close()
+
+		// 流在返回前已经结束，正在处理的请求数也需要减少
+		if call := atomic.LoadInt64(&pls.get(addr).call); 0 != call {
+			t.Fatalf("pool call:%d, want 0", call)
+		}
+	}
+}
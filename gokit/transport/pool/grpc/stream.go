@@ -0,0 +1,219 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type StreamType int
+
+const (
+	SERVER_STREAM StreamType = iota + 1 // 服务端流：发送一个请求，接收多个响应
+	CLIENT_STREAM                       // 客户端流：发送多个请求，接收一个响应
+	BIDI_STREAM                         // 双向流
+)
+
+var ErrStreamNotSupport = errors.New("grpc stream not support the operation")
+
+var clientStreamType = reflect.TypeOf((*grpc.ClientStream)(nil)).Elem()
+
+// 流式调用，包装生成代码中的流客户端(如 Greeter_SayHelloClient)，
+// 流结束(Recv返回错误或io.EOF、CloseAndRecv返回)、ctx取消或调用 Close 后连接放回连接池
+//
+// 和grpc一样，Send 和 Recv 可以分别在两个goroutine中调用
+type Stream struct {
+	stream       grpc.ClientStream
+	send         reflect.Value
+	recv         reflect.Value
+	closeAndRecv reflect.Value
+
+	// 服务端流预先接收的第一个响应
+	prefetched bool
+	first      interface{}
+	firstErr   error
+
+	cancel   context.CancelFunc
+	touch    func()
+	finishes []func(err error)
+	once     sync.Once
+}
+
+func newStream(cs grpc.ClientStream) *Stream {
+	s := &Stream{stream: cs, touch: func() {}}
+
+	v := reflect.ValueOf(cs)
+	s.send = v.MethodByName("Send")
+	s.recv = v.MethodByName("Recv")
+	s.closeAndRecv = v.MethodByName("CloseAndRecv")
+
+	return s
+}
+
+// 原始的grpc流，用于获取 Header、Trailer 等
+func (s *Stream) ClientStream() grpc.ClientStream {
+	return s.stream
+}
+
+func (s *Stream) Send(msg interface{}) error {
+
+	if !s.send.IsValid() {
+		return ErrStreamNotSupport
+	}
+
+	if nil == msg || !reflect.TypeOf(msg).AssignableTo(s.send.Type().In(0)) {
+		return fmt.Errorf("grpc stream send message type invalid, type:%T", msg)
+	}
+
+	err, _ := s.send.Call([]reflect.Value{reflect.ValueOf(msg)})[0].Interface().(error)
+	if nil != err {
+		// 返回io.EOF时流已被服务端结束，错误需要通过 Recv 或 CloseAndRecv 获取
+		if io.EOF != err {
+			s.finish(err)
+		}
+		return err
+	}
+
+	s.touch()
+
+	return nil
+}
+
+// 接收响应，流正常结束时返回io.EOF
+func (s *Stream) Recv() (interface{}, error) {
+
+	if s.prefetched {
+		resp, err := s.first, s.firstErr
+		s.prefetched, s.first, s.firstErr = false, nil, nil
+		return resp, err
+	}
+
+	if !s.recv.IsValid() {
+		return nil, ErrStreamNotSupport
+	}
+
+	return s.result(s.recv.Call(nil))
+}
+
+func (s *Stream) CloseSend() error {
+	return s.stream.CloseSend()
+}
+
+// 客户端流结束发送并接收响应
+func (s *Stream) CloseAndRecv() (interface{}, error) {
+
+	if !s.closeAndRecv.IsValid() {
+		return nil, ErrStreamNotSupport
+	}
+
+	resp, err := s.result(s.closeAndRecv.Call(nil))
+	if nil == err {
+		s.finish(nil)
+	}
+
+	return resp, err
+}
+
+// 结束流并释放连接，可以重复调用
+func (s *Stream) Close() {
+	s.finish(nil)
+}
+
+func (s *Stream) result(res []reflect.Value) (interface{}, error) {
+
+	err, _ := res[1].Interface().(error)
+	if nil != err {
+		s.finish(err)
+		return nil, err
+	}
+
+	s.touch()
+
+	return res[0].Interface(), nil
+}
+
+// 预先接收第一个响应，流在收到第一个响应前失败时返回错误，可以换服务实例重试
+func (s *Stream) prefetch() error {
+
+	resp, err := s.Recv()
+	if nil != err && io.EOF != err {
+		return err
+	}
+
+	s.prefetched, s.first, s.firstErr = true, resp, err
+
+	return nil
+}
+
+// 流结束时调用，按添加的顺序执行
+func (s *Stream) onFinish(f func(err error)) {
+	s.finishes = append(s.finishes, f)
+}
+
+func (s *Stream) finish(err error) {
+	s.once.Do(func() {
+		if nil != s.cancel {
+			s.cancel()
+		}
+
+		for _, f := range s.finishes {
+			f(err)
+		}
+	})
+}
+
+// ctx取消时结束流
+func (s *Stream) watch(ctx context.Context) {
+	<-ctx.Done()
+	s.finish(ctx.Err())
+}
+
+// 流正常结束或被取消不算连接出错
+func streamError(err error) error {
+	if io.EOF == err || errors.Is(err, context.Canceled) || codes.Canceled == status.Code(err) {
+		return nil
+	}
+
+	return err
+}
+
+// 检查 action 是否为指定类型的流方法
+func checkStreamFunc(action string, fn reflect.Type, st StreamType) error {
+
+	in := fn.NumIn()
+	if fn.IsVariadic() {
+		in--
+	}
+
+	if 2 != fn.NumOut() || !fn.Out(0).Implements(clientStreamType) {
+		return fmt.Errorf("action[%s] is not grpc stream", action)
+	}
+
+	out := fn.Out(0)
+	_, hasSend := out.MethodByName("Send")
+	_, hasRecv := out.MethodByName("Recv")
+	_, hasCloseAndRecv := out.MethodByName("CloseAndRecv")
+
+	ok := false
+	switch st {
+	case SERVER_STREAM:
+		ok = 2 == in && hasRecv && !hasSend
+	case CLIENT_STREAM:
+		ok = 1 == in && hasSend && hasCloseAndRecv
+	case BIDI_STREAM:
+		ok = 1 == in && hasSend && hasRecv
+	}
+
+	if !ok {
+		return fmt.Errorf("action[%s] stream type not match, type:%d", action, st)
+	}
+
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"time"
 
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
 	jkutils "github.com/jkprj/jkfr/gokit/utils"
 )
 
@@ -39,6 +40,8 @@ type Options struct {
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 
+	Compress *jkcompress.Options `json:"-"` // 负载压缩，为nil时不压缩
+
 	Factory ClientFatory `json:"-"`
 }
 
@@ -110,6 +110,12 @@ func (c *client) Connect() (bNewConn bool, err error) {
 
 	return true, nil
 }
+
+// 长时间占用的连接(如grpc流)定期刷新请求时间，避免被当作空闲连接回收
+func (c *client) Touch() {
+	c.reqTM = time.Now()
+}
+
 func (c *client) AddRef(delta int64) {
 	atomic.AddInt64(&c.ref, delta)
 }
@@ -19,6 +19,9 @@ type codec struct {
 	Decoder      *gob.Decoder
 	Encoder      *gob.Encoder
 	EncBuf       *bufio.Writer
+
+	compress     codecCompress
+	respEncoding string // 当前响应参数的压缩算法
 }
 
 func NewClientCodec(conn io.ReadWriteCloser, o *jkpool.Options) rpc.ClientCodec {
@@ -33,6 +36,7 @@ func NewClientCodec(conn io.ReadWriteCloser, o *jkpool.Options) rpc.ClientCodec
 		ReadTimeout:  o.ReadTimeout,
 		WriteTimeout: o.WriteTimeout,
 	}
+	c.compress.setCompress(o.Compress)
 
 	return c
 
@@ -66,7 +70,24 @@ func (c *codec) WriteRequest(r *rpc.Request, body interface{}) (err error) {
 
 func (c *codec) writeRequest(r *rpc.Request, body interface{}) (err error) {
 
-	if err = c.Encoder.Encode(r); err != nil {
+	req := metaRequest{ServiceMethod: r.ServiceMethod, Seq: r.Seq, AcceptEncoding: c.compress.accept()}
+	if ma, ok := body.(*metaArgs); ok {
+		req.Meta = ma.meta
+		req.Timeout = ma.timeout()
+		body = ma.args
+	}
+
+	// 压缩后的参数按[]byte编码
+	data, encoding, err := c.compress.compress(body, gobMarshal)
+	if nil != err {
+		return
+	}
+	if "" != encoding {
+		req.Encoding = encoding
+		body = data
+	}
+
+	if err = c.Encoder.Encode(&req); err != nil {
 		return
 	}
 	if err = c.Encoder.Encode(body); err != nil {
@@ -77,7 +98,19 @@ func (c *codec) writeRequest(r *rpc.Request, body interface{}) (err error) {
 
 //ReadResponseHeader ...
 func (c *codec) ReadResponseHeader(r *rpc.Response) (err error) {
-	return c.Decoder.Decode(r)
+
+	var resp metaResponse
+	if err = c.Decoder.Decode(&resp); err != nil {
+		return
+	}
+
+	r.ServiceMethod = resp.ServiceMethod
+	r.Seq = resp.Seq
+	r.Error = resp.Error
+	c.respEncoding = resp.Encoding
+	c.compress.negotiate(resp.AcceptEncoding)
+
+	return
 }
 
 //ReadResponseBody ...
@@ -85,7 +118,19 @@ func (c *codec) ReadResponseBody(body interface{}) (err error) {
 
 	utils.ZeroStruct(body)
 
-	return c.Decoder.Decode(body)
+	if "" == c.respEncoding {
+		return c.Decoder.Decode(body)
+	}
+
+	var data []byte
+	if err = c.Decoder.Decode(&data); err != nil || nil == body {
+		return
+	}
+	if data, err = c.compress.decompress(c.respEncoding, data); err != nil {
+		return
+	}
+
+	return gobUnmarshal(data, body)
 }
 
 //Close ...
@@ -0,0 +1,88 @@
+package rpc
+
+import (
+	"io"
+	"net/rpc"
+	"sync"
+
+	jkpool "github.com/jkprj/jkfr/gokit/transport/pool"
+	jkutils "github.com/jkprj/jkfr/gokit/utils"
+	jklog "github.com/jkprj/jkfr/log"
+)
+
+// 创建客户端编解码，o 为连接池的配置(读写超时等)
+type ClientCodecFunc func(conn io.ReadWriteCloser, o *jkpool.Options) rpc.ClientCodec
+
+// 创建服务端编解码
+type ServerCodecFunc func(conn io.ReadWriteCloser) rpc.ServerCodec
+
+type codecEntry struct {
+	client ClientCodecFunc
+	server ServerCodecFunc
+}
+
+var codecs map[string]codecEntry = map[string]codecEntry{}
+var mtCodec sync.RWMutex
+
+func init() {
+	registerCodec(jkutils.CODEC_GOB, NewClientCodec, NewGobServerCodec)
+	registerCodec(jkutils.CODEC_JSON, func(conn io.ReadWriteCloser, o *jkpool.Options) rpc.ClientCodec {
+		c := NewJsonClientCodec(conn)
+		c.(*jsonClientCodec).compress.setCompress(o.Compress)
+		return c
+	}, NewJsonServerCodec)
+	registerCodec(jkutils.CODEC_PROTOBUF, NewProtoClientCodec, NewProtoServerCodec)
+}
+
+// 注册编解码，客户端和服务端的 Codec 配置为 name 时使用，相同名称后注册的覆盖先注册的，
+// 自定义的编解码收到的是原始的请求参数，不会携带ctx中的元数据和截止时间
+func RegisterCodec(name string, clientCodec ClientCodecFunc, serverCodec ServerCodecFunc) {
+	registerCodec(name, func(conn io.ReadWriteCloser, o *jkpool.Options) rpc.ClientCodec {
+		return &plainClientCodec{ClientCodec: clientCodec(conn, o)}
+	}, serverCodec)
+}
+
+func registerCodec(name string, clientCodec ClientCodecFunc, serverCodec ServerCodecFunc) {
+	mtCodec.Lock()
+	defer mtCodec.Unlock()
+
+	codecs[name] = codecEntry{client: clientCodec, server: serverCodec}
+}
+
+// 是否注册了该编解码
+func HasCodec(name string) bool {
+	mtCodec.RLock()
+	defer mtCodec.RUnlock()
+
+	_, ok := codecs[name]
+	return ok
+}
+
+// 获取编解码，没有注册时使用gob
+func getCodec(name string) codecEntry {
+	mtCodec.RLock()
+	entry, ok := codecs[name]
+	if !ok {
+		entry = codecs[jkutils.CODEC_GOB]
+	}
+	mtCodec.RUnlock()
+
+	if !ok {
+		jklog.Warnw("rpc codec not registered, use gob", "codec", name)
+	}
+
+	return entry
+}
+
+// 拆开元数据信封，只把请求参数交给自定义的编解码
+type plainClientCodec struct {
+	rpc.ClientCodec
+}
+
+func (c *plainClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	if ma, ok := body.(*metaArgs); ok {
+		body = ma.args
+	}
+
+	return c.ClientCodec.WriteRequest(r, body)
+}
@@ -0,0 +1,113 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+	"sync/atomic"
+
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
+)
+
+// 连接的压缩协商状态：本端开启压缩时在请求/响应头中声明可以接收的压缩算法，
+// 收到对端的声明后才压缩发送的参数，对端是旧版本时不会压缩
+type codecCompress struct {
+	opts     *jkcompress.Options
+	encoding atomic.Value // 与对端协商的压缩算法，空为不压缩
+}
+
+// 支持压缩的服务端编解码
+type compressSetter interface {
+	setCompress(opts *jkcompress.Options)
+}
+
+// 根据codec选择注册的服务端编解码，内置的编解码(gob、json、protobuf)按 compress 协商压缩
+func NewServerCodecCompress(conn io.ReadWriteCloser, codec string, compress *jkcompress.Options) rpc.ServerCodec {
+
+	serverCodec := NewServerCodecEx(conn, codec)
+	if cs, ok := serverCodec.(compressSetter); ok {
+		cs.setCompress(compress)
+	}
+
+	return serverCodec
+}
+
+func (cc *codecCompress) setCompress(opts *jkcompress.Options) {
+	cc.opts = opts
+}
+
+// 本端声明可以接收的压缩算法
+func (cc *codecCompress) accept() string {
+	return cc.opts.Accept()
+}
+
+// 收到对端声明的压缩算法
+func (cc *codecCompress) negotiate(peerAccept string) {
+	if !cc.opts.Enabled() {
+		return
+	}
+
+	encoding := cc.opts.Negotiate(peerAccept)
+	if encoding != cc.negotiated() {
+		cc.encoding.Store(encoding)
+	}
+}
+
+// 解压对端发送的参数，解压后的大小受 MaxSize 限制
+func (cc *codecCompress) decompress(encoding string, data []byte) ([]byte, error) {
+	return cc.opts.Decompress(encoding, data)
+}
+
+func (cc *codecCompress) negotiated() string {
+	encoding, _ := cc.encoding.Load().(string)
+	return encoding
+}
+
+// 已协商压缩时，用 marshal 编码参数后压缩，返回压缩后的数据和压缩算法；
+// 没有协商或数据小于最小压缩大小时返回空的压缩算法，参数按原方式发送
+func (cc *codecCompress) compress(body interface{}, marshal func(v interface{}) ([]byte, error)) ([]byte, string, error) {
+
+	encoding := cc.negotiated()
+	if "" == encoding {
+		return nil, "", nil
+	}
+
+	data, err := marshal(body)
+	if nil != err {
+		return nil, "", err
+	}
+
+	data, encoding, err = cc.opts.Compress(encoding, data)
+	if nil != err || "" == encoding {
+		return nil, "", err
+	}
+
+	return data, encoding, nil
+}
+
+// 已协商压缩时压缩编码后的参数，没有压缩时返回原数据和空的压缩算法
+func (cc *codecCompress) compressData(data []byte) ([]byte, string, error) {
+
+	encoding := cc.negotiated()
+	if "" == encoding {
+		return data, "", nil
+	}
+
+	return cc.opts.Compress(encoding, data)
+}
+
+// 编码单独的gob数据(包含类型信息)，用于压缩
+func gobMarshal(v interface{}) ([]byte, error) {
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); nil != err {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func gobUnmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
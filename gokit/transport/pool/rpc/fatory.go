@@ -6,7 +6,6 @@ import (
 	"io"
 	"net"
 	"net/http"
-	"net/rpc"
 
 	jkpool "github.com/jkprj/jkfr/gokit/transport/pool"
 	jktls "github.com/jkprj/jkfr/gokit/utils/tls"
@@ -34,8 +33,9 @@ func DefaultRpcTLSHttpFatory(clientpem, clientkey []byte, path string) jkpool.Cl
 	return RpcTLSHttpFatory(DefaultNewRpcClient, clientpem, clientkey, path)
 }
 
+// 默认的rpc客户端，支持把ctx中的元数据和截止时间发送给服务端
 func DefaultNewRpcClient(conn net.Conn, o *jkpool.Options) (p jkpool.PoolClient, err error) {
-	return rpc.NewClientWithCodec(NewTimeoutCodecEx(conn, o)), nil
+	return NewMetadataClient(NewTimeoutCodecEx(conn, o)), nil
 }
 
 func TcpConn(o *jkpool.Options) (net.Conn, error) {
@@ -0,0 +1,303 @@
+package rpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync"
+
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
+)
+
+// 与 net/rpc/jsonrpc 兼容的json编解码，请求中增加 meta 和 timeout 字段携带元数据，
+// 标准的 jsonrpc 服务端会忽略这两个字段
+
+type jsonClientRequest struct {
+	Method  string            `json:"method"`
+	Params  [1]interface{}    `json:"params"`
+	Id      uint64            `json:"id"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Timeout int64             `json:"timeout,omitempty"`
+
+	Encoding       string `json:"encoding,omitempty"` // 参数压缩后按base64编码
+	AcceptEncoding string `json:"accept_encoding,omitempty"`
+}
+
+type jsonClientResponse struct {
+	Id     uint64           `json:"id"`
+	Result *json.RawMessage `json:"result"`
+	Error  interface{}      `json:"error"`
+
+	Encoding       string `json:"encoding"`
+	AcceptEncoding string `json:"accept_encoding"`
+}
+
+func (r *jsonClientResponse) reset() {
+	r.Id = 0
+	r.Result = nil
+	r.Error = nil
+	r.Encoding = ""
+	r.AcceptEncoding = ""
+}
+
+type jsonClientCodec struct {
+	dec *json.Decoder
+	enc *json.Encoder
+	c   io.Closer
+
+	req  jsonClientRequest
+	resp jsonClientResponse
+
+	mutex   sync.Mutex
+	pending map[uint64]string
+
+	compress codecCompress
+}
+
+func NewJsonClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return &jsonClientCodec{
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+		c:       conn,
+		pending: make(map[uint64]string),
+	}
+}
+
+func (c *jsonClientCodec) WriteRequest(r *rpc.Request, param interface{}) error {
+	c.mutex.Lock()
+	c.pending[r.Seq] = r.ServiceMethod
+	c.mutex.Unlock()
+
+	c.req.Method = r.ServiceMethod
+	c.req.Id = r.Seq
+	c.req.Meta = nil
+	c.req.Timeout = 0
+	c.req.Encoding = ""
+	c.req.AcceptEncoding = c.compress.accept()
+
+	if ma, ok := param.(*metaArgs); ok {
+		c.req.Meta = ma.meta
+		c.req.Timeout = ma.timeout()
+		param = ma.args
+	}
+
+	data, encoding, err := c.compress.compress(param, json.Marshal)
+	if nil != err {
+		return err
+	}
+	if "" != encoding {
+		c.req.Encoding = encoding
+		param = data
+	}
+	c.req.Params[0] = param
+
+	return c.enc.Encode(&c.req)
+}
+
+func (c *jsonClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	c.resp.reset()
+	if err := c.dec.Decode(&c.resp); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	r.ServiceMethod = c.pending[c.resp.Id]
+	delete(c.pending, c.resp.Id)
+	c.mutex.Unlock()
+
+	r.Error = ""
+	r.Seq = c.resp.Id
+	c.compress.negotiate(c.resp.AcceptEncoding)
+	if c.resp.Error != nil || c.resp.Result == nil {
+		x, ok := c.resp.Error.(string)
+		if !ok {
+			return fmt.Errorf("invalid error %v", c.resp.Error)
+		}
+		if x == "" {
+			x = "unspecified error"
+		}
+		r.Error = x
+	}
+
+	return nil
+}
+
+func (c *jsonClientCodec) ReadResponseBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+
+	if "" != c.resp.Encoding {
+		return jsonDecompress(&c.compress, *c.resp.Result, c.resp.Encoding, x)
+	}
+
+	return json.Unmarshal(*c.resp.Result, x)
+}
+
+func (c *jsonClientCodec) Close() error {
+	return c.c.Close()
+}
+
+type jsonServerRequest struct {
+	Method  string            `json:"method"`
+	Params  *json.RawMessage  `json:"params"`
+	Id      *json.RawMessage  `json:"id"`
+	Meta    map[string]string `json:"meta"`
+	Timeout int64             `json:"timeout"`
+
+	Encoding       string `json:"encoding"`
+	AcceptEncoding string `json:"accept_encoding"`
+}
+
+func (r *jsonServerRequest) reset() {
+	r.Method = ""
+	r.Params = nil
+	r.Id = nil
+	r.Meta = nil
+	r.Timeout = 0
+	r.Encoding = ""
+	r.AcceptEncoding = ""
+}
+
+type jsonServerResponse struct {
+	Id     *json.RawMessage `json:"id"`
+	Result interface{}      `json:"result"`
+	Error  interface{}      `json:"error"`
+
+	Encoding       string `json:"encoding,omitempty"` // 结果压缩后按base64编码
+	AcceptEncoding string `json:"accept_encoding,omitempty"`
+}
+
+type jsonServerCodec struct {
+	dec *json.Decoder
+	enc *json.Encoder
+	c   io.Closer
+
+	req      jsonServerRequest
+	meta     *serverMeta
+	compress codecCompress
+
+	mutex   sync.Mutex
+	seq     uint64
+	pending map[uint64]*json.RawMessage
+}
+
+var errMissingParams = errors.New("jsonrpc: request body missing params")
+var jsonNull = json.RawMessage([]byte("null"))
+
+func NewJsonServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &jsonServerCodec{
+		dec:     json.NewDecoder(conn),
+		enc:     json.NewEncoder(conn),
+		c:       conn,
+		meta:    newServerMeta(),
+		pending: make(map[uint64]*json.RawMessage),
+	}
+}
+
+func (c *jsonServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.req.reset()
+	if err := c.dec.Decode(&c.req); err != nil {
+		return err
+	}
+	r.ServiceMethod = c.req.Method
+
+	c.mutex.Lock()
+	c.seq++
+	c.pending[c.seq] = c.req.Id
+	c.req.Id = nil
+	r.Seq = c.seq
+	c.mutex.Unlock()
+
+	c.meta.setHeader(r.Seq, c.req.Meta, c.req.Timeout)
+	c.compress.negotiate(c.req.AcceptEncoding)
+
+	return nil
+}
+
+func (c *jsonServerCodec) ReadRequestBody(x interface{}) error {
+	if x == nil {
+		return nil
+	}
+	if c.req.Params == nil {
+		return errMissingParams
+	}
+
+	if "" != c.req.Encoding {
+		var params [1]json.RawMessage
+		if err := json.Unmarshal(*c.req.Params, &params); err != nil {
+			return err
+		}
+		if err := jsonDecompress(&c.compress, params[0], c.req.Encoding, x); err != nil {
+			return err
+		}
+	} else {
+		var params [1]interface{}
+		params[0] = x
+		if err := json.Unmarshal(*c.req.Params, &params); err != nil {
+			return err
+		}
+	}
+
+	c.meta.bind(x)
+
+	return nil
+}
+
+func (c *jsonServerCodec) WriteResponse(r *rpc.Response, x interface{}) error {
+	c.meta.done(r.Seq)
+
+	c.mutex.Lock()
+	b, ok := c.pending[r.Seq]
+	if !ok {
+		c.mutex.Unlock()
+		return errors.New("invalid sequence number in response")
+	}
+	delete(c.pending, r.Seq)
+	c.mutex.Unlock()
+
+	if b == nil {
+		b = &jsonNull
+	}
+
+	resp := jsonServerResponse{Id: b, AcceptEncoding: c.compress.accept()}
+	if r.Error == "" {
+		resp.Result = x
+
+		data, encoding, err := c.compress.compress(x, json.Marshal)
+		if nil == err && "" != encoding {
+			resp.Result = data
+			resp.Encoding = encoding
+		}
+	} else {
+		resp.Error = r.Error
+	}
+
+	return c.enc.Encode(resp)
+}
+
+func (c *jsonServerCodec) setCompress(opts *jkcompress.Options) {
+	c.compress.setCompress(opts)
+}
+
+func (c *jsonServerCodec) Close() error {
+	return c.c.Close()
+}
+
+// 压缩的数据按base64字符串编码，解码后解压再解码到x
+func jsonDecompress(cc *codecCompress, raw json.RawMessage, encoding string, x interface{}) error {
+
+	var data []byte
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return err
+	}
+
+	data, err := cc.decompress(encoding, data)
+	if nil != err {
+		return err
+	}
+
+	return json.Unmarshal(data, x)
+}
@@ -0,0 +1,147 @@
+package rpc
+
+import (
+	"context"
+	"net/rpc"
+	"sync"
+	"time"
+
+	jkmd "github.com/jkprj/jkfr/gokit/transport/metadata"
+	jkos "github.com/jkprj/jkfr/os"
+)
+
+// 带元数据的请求头，字段兼容 rpc.Request，只支持 rpc.Request 的对端会忽略多出的字段
+type metaRequest struct {
+	ServiceMethod string
+	Seq           uint64
+	Meta          map[string]string // 请求元数据
+	Timeout       int64             // 剩余的截止时间(毫秒)，0表示没有截止时间
+
+	Encoding       string // 请求参数的压缩算法，空为没有压缩
+	AcceptEncoding string // 客户端可以接收的压缩算法
+}
+
+// 带压缩协商的响应头，字段兼容 rpc.Response
+type metaResponse struct {
+	ServiceMethod string
+	Seq           uint64
+	Error         string
+
+	Encoding       string // 响应参数的压缩算法，空为没有压缩
+	AcceptEncoding string // 服务端可以接收的压缩算法
+}
+
+// 请求参数的信封，携带元数据，编解码写请求时拆开
+type metaArgs struct {
+	meta     jkmd.MD
+	deadline time.Time
+	args     interface{}
+}
+
+func newMetaArgs(ctx context.Context, args interface{}) *metaArgs {
+
+	ma := &metaArgs{args: args}
+
+	if nil == ctx {
+		ctx = context.Background()
+	}
+
+	md, ok := jkmd.FromOutgoingContext(ctx)
+	if ok {
+		ma.meta = md.Copy()
+	} else {
+		ma.meta = jkmd.MD{}
+	}
+
+	if "" == ma.meta.Get(jkmd.KEY_CALLER) {
+		ma.meta.Set(jkmd.KEY_CALLER, jkos.AppName())
+	}
+
+	ma.deadline, _ = ctx.Deadline()
+
+	return ma
+}
+
+// 剩余的截止时间(毫秒)
+func (ma *metaArgs) timeout() int64 {
+	if ma.deadline.IsZero() {
+		return 0
+	}
+
+	timeout := time.Until(ma.deadline).Milliseconds()
+	if timeout <= 0 {
+		timeout = 1 // 已经超时，服务端收到后ctx立即超时
+	}
+
+	return timeout
+}
+
+// 支持元数据的rpc客户端，编解码需要能处理 metaArgs(如 NewTimeoutCodecEx)，
+// RpcPool 调用时会把ctx中的元数据和截止时间带给服务端
+type MetadataClient struct {
+	*rpc.Client
+}
+
+func NewMetadataClient(codec rpc.ClientCodec) *MetadataClient {
+	return &MetadataClient{Client: rpc.NewClientWithCodec(codec)}
+}
+
+// 服务端记录当前请求的元数据，解码请求参数后设置到参数的ctx中
+type serverMeta struct {
+	seq     uint64
+	meta    jkmd.MD
+	timeout int64
+
+	cancels map[uint64]context.CancelFunc
+	mt      sync.Mutex
+}
+
+func newServerMeta() *serverMeta {
+	return &serverMeta{cancels: map[uint64]context.CancelFunc{}}
+}
+
+// 读取请求头后调用
+func (sm *serverMeta) setHeader(seq uint64, meta map[string]string, timeout int64) {
+	sm.seq = seq
+	sm.meta = jkmd.MD(meta)
+	sm.timeout = timeout
+}
+
+// 读取请求参数后调用，参数实现了 metadata.ContextSetter 时设置请求的ctx
+func (sm *serverMeta) bind(body interface{}) {
+
+	setter, ok := body.(jkmd.ContextSetter)
+	if !ok {
+		return
+	}
+
+	md := sm.meta
+	if nil == md {
+		md = jkmd.MD{}
+	}
+
+	ctx := jkmd.NewIncomingContext(context.Background(), md)
+
+	if 0 < sm.timeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(sm.timeout)*time.Millisecond)
+
+		sm.mt.Lock()
+		sm.cancels[sm.seq] = cancel
+		sm.mt.Unlock()
+	}
+
+	setter.SetContext(ctx)
+}
+
+// 写响应后调用，释放请求的ctx
+func (sm *serverMeta) done(seq uint64) {
+	sm.mt.Lock()
+	cancel, ok := sm.cancels[seq]
+	delete(sm.cancels, seq)
+	sm.mt.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
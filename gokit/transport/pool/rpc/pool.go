@@ -44,8 +44,14 @@ func (rp *RpcPool) call(ctx context.Context, serviceMethod string, args interfac
 		return err
 	}
 
-	client, ok := c.Client.(*rpc.Client)
-	if !ok {
+	var client *rpc.Client
+	switch cli := c.Client.(type) {
+	case *MetadataClient:
+		client = cli.Client
+		args = newMetaArgs(ctx, args)
+	case *rpc.Client:
+		client = cli
+	default:
 		jklog.Errorw("transfer *rpc.Client fail")
 		return errors.New("tranfer to rpc.Client fail")
 	}
@@ -62,7 +68,11 @@ func (rp *RpcPool) call(ctx context.Context, serviceMethod string, args interfac
 	case <-rpcCall.Done:
 		err = rpcCall.Error
 	case <-timeoutCtx.Done():
-		err = errors.New("ReadTimeout addr:" + rp.addr + ", method:" + serviceMethod)
+		if context.Canceled == timeoutCtx.Err() {
+			err = timeoutCtx.Err() // 调用方取消
+		} else {
+			err = errors.New("ReadTimeout addr:" + rp.addr + ", method:" + serviceMethod)
+		}
 	}
 
 	if nil != cancel {
@@ -71,10 +81,10 @@ func (rp *RpcPool) call(ctx context.Context, serviceMethod string, args interfac
 
 	if nil != err {
 		_, ok := err.(rpc.ServerError)
-		if !ok {
+		if !ok && context.Canceled != err {
 			rp.pool.Put(c, jkpool.BAD)
 		} else {
-			rp.pool.Put(c, jkpool.GOOD) // 服务端返回的错误说明连接还是正常的，不需要尝试释放连接
+			rp.pool.Put(c, jkpool.GOOD) // 服务端返回的错误或调用方取消说明连接还是正常的，不需要尝试释放连接
 			// log.Infow("ServerError", "err", err)
 		}
 
@@ -14,6 +14,7 @@ import (
 
 	jkpool "github.com/jkprj/jkfr/gokit/transport/pool"
 	jkutils "github.com/jkprj/jkfr/gokit/utils"
+	jklb "github.com/jkprj/jkfr/gokit/utils/lb"
 	jkrand "github.com/jkprj/jkfr/gokit/utils/rand"
 	"github.com/jkprj/jkfr/log"
 )
@@ -25,6 +26,8 @@ type stpool struct {
 	last   time.Time
 	call   int64
 	static bool // 静态创建的pool不能超时关闭，只有动态创建的pool才能超时关闭
+
+	stat jklb.EWMAStat // p2c_ewma 策略的负载统计
 }
 
 type RpcPools struct {
@@ -42,6 +45,10 @@ type RpcPools struct {
 	index  uint32
 	random *rand.Rand
 
+	ring        *jklb.HashRing // 一致性哈希环，pools变化后在下次按key调用时重建
+	ringVersion uint64
+	version     uint64 // pools每次变化加1
+
 	mtPool sync.RWMutex
 	mtNew  sync.RWMutex
 
@@ -112,7 +119,10 @@ func (pls *RpcPools) call(ctx context.Context, serviceMethod string, args interf
 	var pl *stpool
 
 	// retry为0时根据指定策略获取，Retry大于0时获取下一个服务连接池
-	if retry == 0 {
+	// 一致性哈希策略下带哈希key的调用每次都按key获取，失败冷却中的连接池会被跳过
+	if key, ok := jklb.HashKeyFromContext(ctx); ok && jkutils.STRATEGY_CONSISTENT_HASH == pls.strategy {
+		pl = pls.hash_get(key)
+	} else if retry == 0 {
 		pl = pls.get_pool()
 	} else {
 		pl = pls.roll_get()
@@ -124,12 +134,14 @@ func (pls *RpcPools) call(ctx context.Context, serviceMethod string, args interf
 	}
 
 	atomic.AddInt64(&pl.call, 1)
+	bg := pl.stat.Start()
 
 	err = pl.pl.CallWithContext(ctx, serviceMethod, args, reply)
 	// if nil != err {
 	// 	log.Errorw("Call fail", "method", serviceMethod, "error", err)
 	// }
 
+	pl.stat.Done(bg, isFailure(err))
 	atomic.AddInt64(&pl.call, -1)
 	pl.last = time.Now()
 
@@ -170,6 +182,10 @@ func (pls *RpcPools) call_with_func(callFunc func(retry uint) error) (err error)
 		time.Sleep(pls.retryInterval)
 	}
 
+	if 1 == retry {
+		return err // 只调用了一次时返回原始错误，便于调用方判断错误类型(如 rpc.ServerError)
+	}
+
 	return lastErr
 }
 
@@ -198,6 +214,11 @@ func (pls *RpcPools) Call(serviceMethod string, args interface{}, reply interfac
 	return pls.CallWithContext(context.TODO(), serviceMethod, args, reply)
 }
 
+// 一致性哈希策略下相同key的调用发送到同一个服务，其他策略下key不生效
+func (pls *RpcPools) CallWithKey(key string, serviceMethod string, args interface{}, reply interface{}) (err error) {
+	return pls.CallWithContext(jklb.WithHashKey(context.TODO(), key), serviceMethod, args, reply)
+}
+
 func (pls *RpcPools) GoCallWithContext(ctx context.Context, serviceMethod string, args interface{}, reply interface{}, done chan *rpc.Call) *rpc.Call {
 
 	call := new(rpc.Call)
@@ -235,6 +256,12 @@ func (pls *RpcPools) CallWithAddr(addr string, serviceMethod string, args interf
 
 func (pls *RpcPools) CallWithAddrEx(addr string, serviceMethod string, args interface{}, reply interface{}, timeout time.Duration) error {
 
+	return pls.CallWithAddrContext(context.Background(), addr, serviceMethod, args, reply, timeout)
+}
+
+// 指定服务地址调用，ctx的截止时间和timeout哪个先到以哪个为准
+func (pls *RpcPools) CallWithAddrContext(ctx context.Context, addr string, serviceMethod string, args interface{}, reply interface{}, timeout time.Duration) error {
+
 	return pls.call_with_func(func(retry uint) error {
 
 		pl, err := pls.getex(addr)
@@ -245,9 +272,9 @@ func (pls *RpcPools) CallWithAddrEx(addr string, serviceMethod string, args inte
 
 		atomic.AddInt64(&pl.call, 1)
 
-		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		callCtx, cancel := context.WithTimeout(ctx, timeout)
 
-		err = pl.pl.CallWithContext(ctx, serviceMethod, args, reply)
+		err = pl.pl.CallWithContext(callCtx, serviceMethod, args, reply)
 
 		cancel()
 
@@ -299,6 +326,7 @@ func (pls *RpcPools) close() {
 
 	pls.addr2pool = make(map[string]*stpool)
 	pls.pools = make([]*stpool, 0)
+	pls.version++
 }
 
 func (pls *RpcPools) CloseServer(svrAddr string) {
@@ -351,6 +379,14 @@ func (pls *RpcPools) SetStrategy(strategy string) {
 		pls.get_pool = func() *stpool {
 			return pls.roll_get()
 		}
+	} else if jkutils.STRATEGY_P2C_EWMA == pls.strategy {
+		pls.get_pool = func() *stpool {
+			return pls.p2c_get()
+		}
+	} else if jkutils.STRATEGY_CONSISTENT_HASH == pls.strategy {
+		pls.get_pool = func() *stpool {
+			return pls.random_get() // 没有哈希key的调用随机选择
+		}
 	} else {
 		pls.strategy = jkutils.STRATEGY_LEAST
 		pls.get_pool = func() *stpool {
@@ -392,6 +428,7 @@ func (pls *RpcPools) push(addr string, pl *stpool) *stpool {
 
 	pls.addr2pool[addr] = pl
 	pls.pools = append(pls.pools, pl)
+	pls.version++
 
 	return pl
 }
@@ -453,6 +490,67 @@ func (pls *RpcPools) random_get() *stpool {
 	return pls.get_index_ex(pls.index)
 }
 
+// 随机选两个连接池，选 峰值EWMA延迟*正在处理请求数 较小的
+func (pls *RpcPools) p2c_get() *stpool {
+
+	pls.mtPool.RLock()
+
+	nlen := len(pls.pools)
+	if nlen == 0 {
+		pls.mtPool.RUnlock()
+		return nil
+	}
+
+	index := jklb.P2CPick(nlen, func(i int) float64 {
+		return pls.pools[i].stat.Score()
+	})
+
+	pls.mtPool.RUnlock()
+
+	return pls.get_index_ex(uint32(index))
+}
+
+// 按哈希key在一致性哈希环上选择连接池，key所属的连接池断开或失败冷却中时选择环上的下一个
+func (pls *RpcPools) hash_get(key string) *stpool {
+
+	pls.mtPool.RLock()
+
+	if nil == pls.ring || pls.ringVersion != pls.version {
+		pls.mtPool.RUnlock()
+
+		pls.mtPool.Lock()
+		if nil == pls.ring || pls.ringVersion != pls.version {
+			addrs := make([]string, len(pls.pools))
+			for i, pl := range pls.pools {
+				addrs[i] = pl.pl.addr
+			}
+			pls.ring = jklb.NewHashRing(addrs, 0)
+			pls.ringVersion = pls.version
+		}
+		pls.mtPool.Unlock()
+
+		pls.mtPool.RLock()
+	}
+
+	// 重建后pools可能又发生了变化，下标以当前的环为准并检查范围
+	index := pls.ring.Get(key, func(i int) bool {
+		return i < len(pls.pools) && pls.pools[i].pl.IsConnected() && !pls.pools[i].stat.Cooling()
+	})
+
+	var pl *stpool
+	if pls.ringVersion == pls.version && index >= 0 && index < len(pls.pools) {
+		pl = pls.pools[index]
+	}
+
+	pls.mtPool.RUnlock()
+
+	if nil == pl {
+		return pls.random_get()
+	}
+
+	return pl
+}
+
 func (pls *RpcPools) least_get() *stpool {
 
 	pls.mtPool.RLock()
@@ -547,6 +645,7 @@ func (pls *RpcPools) remove_index(i int) {
 	}
 
 	delete(pls.addr2pool, tmp.pl.addr)
+	pls.version++
 
 	log.Infow("RpcPools.remove_pool to close pool")
 
@@ -660,3 +759,12 @@ func (pls *RpcPools) remove_idle_time_out() {
 		i++
 	}
 }
+
+// p2c_ewma 策略的失败判断，服务端返回的业务错误和调用方取消不算失败
+func isFailure(err error) bool {
+	if nil == err || context.Canceled == err {
+		return false
+	}
+
+	return !IsServerError(err)
+}
@@ -0,0 +1,294 @@
+package rpc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
+	jkpool "github.com/jkprj/jkfr/gokit/transport/pool"
+	jklog "github.com/jkprj/jkfr/log"
+
+	"github.com/gogo/protobuf/proto"
+)
+
+// protobuf编解码，请求/响应的头和参数分别编码为一帧：varint长度 + protobuf数据，
+// 参数需要是 gogo/protobuf 的 proto.Message，可以和grpc服务共用消息类型
+
+const maxProtoFrameSize = 64 * 1024 * 1024
+
+var ErrNotProtoMessage = errors.New("rpc: protobuf codec param is not proto.Message")
+
+type protoRequestHeader struct {
+	ServiceMethod string            `protobuf:"bytes,1,opt,name=service_method,proto3"`
+	Seq           uint64            `protobuf:"varint,2,opt,name=seq,proto3"`
+	Meta          map[string]string `protobuf:"bytes,3,rep,name=meta,proto3" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Timeout       int64             `protobuf:"varint,4,opt,name=timeout,proto3"` // 剩余的截止时间(毫秒)
+
+	Encoding       string `protobuf:"bytes,5,opt,name=encoding,proto3"` // 参数帧的压缩算法
+	AcceptEncoding string `protobuf:"bytes,6,opt,name=accept_encoding,proto3"`
+}
+
+func (m *protoRequestHeader) Reset()         { *m = protoRequestHeader{} }
+func (m *protoRequestHeader) String() string { return proto.CompactTextString(m) }
+func (*protoRequestHeader) ProtoMessage()    {}
+
+type protoResponseHeader struct {
+	ServiceMethod string `protobuf:"bytes,1,opt,name=service_method,proto3"`
+	Seq           uint64 `protobuf:"varint,2,opt,name=seq,proto3"`
+	Error         string `protobuf:"bytes,3,opt,name=error,proto3"`
+
+	Encoding       string `protobuf:"bytes,4,opt,name=encoding,proto3"` // 参数帧的压缩算法
+	AcceptEncoding string `protobuf:"bytes,5,opt,name=accept_encoding,proto3"`
+}
+
+func (m *protoResponseHeader) Reset()         { *m = protoResponseHeader{} }
+func (m *protoResponseHeader) String() string { return proto.CompactTextString(m) }
+func (*protoResponseHeader) ProtoMessage()    {}
+
+type protoFrameReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+// 读取一帧，返回的数据在读取下一帧前有效
+func (fr *protoFrameReader) readFrame() ([]byte, error) {
+
+	size, err := binary.ReadUvarint(fr.r)
+	if nil != err {
+		return nil, err
+	}
+	if size > maxProtoFrameSize {
+		return nil, fmt.Errorf("rpc: protobuf frame too large, size:%d", size)
+	}
+
+	if uint64(cap(fr.buf)) < size {
+		fr.buf = make([]byte, size)
+	}
+	buf := fr.buf[:size]
+
+	if _, err = io.ReadFull(fr.r, buf); nil != err {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// 读取一帧并解码到msg，msg为nil时丢弃，encoding 不为空时先用 cc 解压
+func (fr *protoFrameReader) readMessage(msg interface{}, encoding string, cc *codecCompress) error {
+
+	buf, err := fr.readFrame()
+	if nil != err || nil == msg {
+		return err
+	}
+
+	if "" != encoding {
+		if buf, err = cc.decompress(encoding, buf); nil != err {
+			return err
+		}
+	}
+
+	pb, ok := msg.(proto.Message)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+
+	return proto.Unmarshal(buf, pb)
+}
+
+func writeProtoFrame(w *bufio.Writer, data []byte) error {
+
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(data)))
+
+	if _, err := w.Write(size[:n]); nil != err {
+		return err
+	}
+
+	_, err := w.Write(data)
+
+	return err
+}
+
+func marshalProto(msg interface{}) ([]byte, error) {
+
+	pb, ok := msg.(proto.Message)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+
+	return proto.Marshal(pb)
+}
+
+type protoClientCodec struct {
+	rwc io.ReadWriteCloser
+	fr  protoFrameReader
+	w   *bufio.Writer
+
+	resp     protoResponseHeader
+	compress codecCompress
+}
+
+func NewProtoClientCodec(conn io.ReadWriteCloser, o *jkpool.Options) rpc.ClientCodec {
+	c := &protoClientCodec{
+		rwc: conn,
+		fr:  protoFrameReader{r: bufio.NewReader(conn)},
+		w:   bufio.NewWriter(conn),
+	}
+	c.compress.setCompress(o.Compress)
+
+	return c
+}
+
+func (c *protoClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+
+	req := protoRequestHeader{ServiceMethod: r.ServiceMethod, Seq: r.Seq, AcceptEncoding: c.compress.accept()}
+	if ma, ok := body.(*metaArgs); ok {
+		req.Meta = ma.meta
+		req.Timeout = ma.timeout()
+		body = ma.args
+	}
+
+	data, err := marshalProto(body)
+	if nil != err {
+		return err
+	}
+
+	if data, req.Encoding, err = c.compress.compressData(data); nil != err {
+		return err
+	}
+
+	header, err := proto.Marshal(&req)
+	if nil != err {
+		return err
+	}
+
+	if err = writeProtoFrame(c.w, header); nil != err {
+		return err
+	}
+	if err = writeProtoFrame(c.w, data); nil != err {
+		return err
+	}
+
+	return c.w.Flush()
+}
+
+func (c *protoClientCodec) ReadResponseHeader(r *rpc.Response) error {
+
+	c.resp.Reset()
+	if err := c.fr.readMessage(&c.resp, "", nil); nil != err {
+		return err
+	}
+
+	r.ServiceMethod = c.resp.ServiceMethod
+	r.Seq = c.resp.Seq
+	r.Error = c.resp.Error
+	c.compress.negotiate(c.resp.AcceptEncoding)
+
+	return nil
+}
+
+func (c *protoClientCodec) ReadResponseBody(body interface{}) error {
+	return c.fr.readMessage(body, c.resp.Encoding, &c.compress)
+}
+
+func (c *protoClientCodec) Close() error {
+	return c.rwc.Close()
+}
+
+type protoServerCodec struct {
+	rwc    io.ReadWriteCloser
+	fr     protoFrameReader
+	w      *bufio.Writer
+	closed bool
+
+	req      protoRequestHeader
+	meta     *serverMeta
+	compress codecCompress
+}
+
+func NewProtoServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	return &protoServerCodec{
+		rwc:  conn,
+		fr:   protoFrameReader{r: bufio.NewReader(conn)},
+		w:    bufio.NewWriter(conn),
+		meta: newServerMeta(),
+	}
+}
+
+func (c *protoServerCodec) ReadRequestHeader(r *rpc.Request) error {
+
+	c.req.Reset()
+	if err := c.fr.readMessage(&c.req, "", nil); nil != err {
+		return err
+	}
+
+	r.ServiceMethod = c.req.ServiceMethod
+	r.Seq = c.req.Seq
+	c.meta.setHeader(c.req.Seq, c.req.Meta, c.req.Timeout)
+	c.compress.negotiate(c.req.AcceptEncoding)
+
+	return nil
+}
+
+func (c *protoServerCodec) ReadRequestBody(body interface{}) error {
+
+	if err := c.fr.readMessage(body, c.req.Encoding, &c.compress); nil != err {
+		return err
+	}
+
+	if nil != body {
+		c.meta.bind(body)
+	}
+
+	return nil
+}
+
+func (c *protoServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+
+	c.meta.done(r.Seq)
+
+	resp := protoResponseHeader{ServiceMethod: r.ServiceMethod, Seq: r.Seq, Error: r.Error, AcceptEncoding: c.compress.accept()}
+
+	// 出错时 net/rpc 传入的body不是proto.Message，只发送空的参数帧
+	var data []byte
+	if "" == r.Error {
+		if data, err = marshalProto(body); nil != err {
+			resp.Error = err.Error()
+		} else if data, resp.Encoding, err = c.compress.compressData(data); nil != err {
+			resp.Error = err.Error()
+			data = nil
+		}
+	}
+
+	header, err := proto.Marshal(&resp)
+	if nil != err {
+		jklog.Errorw("rpc: protobuf error encoding response", "err", err)
+		c.Close()
+		return err
+	}
+
+	if err = writeProtoFrame(c.w, header); nil != err {
+		return err
+	}
+	if err = writeProtoFrame(c.w, data); nil != err {
+		return err
+	}
+
+	return c.w.Flush()
+}
+
+func (c *protoServerCodec) setCompress(opts *jkcompress.Options) {
+	c.compress.setCompress(opts)
+}
+
+func (c *protoServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
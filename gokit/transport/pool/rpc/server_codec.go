@@ -0,0 +1,129 @@
+package rpc
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"net/rpc"
+
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
+	jklog "github.com/jkprj/jkfr/log"
+)
+
+// gob服务端编解码，兼容 net/rpc 默认的编解码，并支持读取客户端发送的元数据
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+
+	meta        *serverMeta
+	compress    codecCompress
+	reqEncoding string // 当前请求参数的压缩算法
+}
+
+func NewGobServerCodec(conn io.ReadWriteCloser) rpc.ServerCodec {
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:    conn,
+		dec:    gob.NewDecoder(conn),
+		enc:    gob.NewEncoder(buf),
+		encBuf: buf,
+		meta:   newServerMeta(),
+	}
+}
+
+// 根据codec选择注册的服务端编解码
+func NewServerCodecEx(conn io.ReadWriteCloser, codec string) rpc.ServerCodec {
+	return getCodec(codec).server(conn)
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+
+	var req metaRequest
+	if err := c.dec.Decode(&req); err != nil {
+		return err
+	}
+
+	r.ServiceMethod = req.ServiceMethod
+	r.Seq = req.Seq
+	c.meta.setHeader(req.Seq, req.Meta, req.Timeout)
+	c.reqEncoding = req.Encoding
+	c.compress.negotiate(req.AcceptEncoding)
+
+	return nil
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+
+	if "" == c.reqEncoding {
+		if err := c.dec.Decode(body); err != nil {
+			return err
+		}
+	} else {
+		var data []byte
+		if err := c.dec.Decode(&data); err != nil || nil == body {
+			return err
+		}
+
+		data, err := c.compress.decompress(c.reqEncoding, data)
+		if nil != err {
+			return err
+		}
+		if err = gobUnmarshal(data, body); nil != err {
+			return err
+		}
+	}
+
+	c.meta.bind(body)
+
+	return nil
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+
+	c.meta.done(r.Seq)
+
+	resp := metaResponse{ServiceMethod: r.ServiceMethod, Seq: r.Seq, Error: r.Error, AcceptEncoding: c.compress.accept()}
+
+	// 压缩后的参数按[]byte编码，出错的响应不压缩
+	if "" == r.Error {
+		data, encoding, err := c.compress.compress(body, gobMarshal)
+		if nil != err {
+			jklog.Errorw("rpc: gob error compressing body", "err", err)
+		} else if "" != encoding {
+			resp.Encoding = encoding
+			body = data
+		}
+	}
+
+	if err = c.enc.Encode(&resp); err != nil {
+		if c.encBuf.Flush() == nil {
+			// 头部编码失败，关闭连接通知对端
+			jklog.Errorw("rpc: gob error encoding response", "err", err)
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			jklog.Errorw("rpc: gob error encoding body", "err", err)
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) setCompress(opts *jkcompress.Options) {
+	c.compress.setCompress(opts)
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
@@ -6,18 +6,22 @@ import (
 	"math"
 	"net"
 	"net/rpc"
-	"net/rpc/jsonrpc"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	jkpool "github.com/jkprj/jkfr/gokit/transport/pool"
-	jkutils "github.com/jkprj/jkfr/gokit/utils"
 	jklog "github.com/jkprj/jkfr/log"
 )
 
 var ErrTimeout error = errors.New("Timeout")
 
+// 是否为服务端返回的业务错误，读超时会被net/rpc转换成 rpc.ServerError("Timeout")，属于传输失败
+func IsServerError(err error) bool {
+	se, ok := err.(rpc.ServerError)
+	return ok && ErrTimeout.Error() != string(se)
+}
+
 const (
 	UNREAD  = 0
 	READING = 1
@@ -59,13 +63,9 @@ func NewTimeoutCodec(codec rpc.ClientCodec, conn net.Conn, readTimeout, writeTim
 
 }
 
+// 根据 o.Codec 选择注册的编解码，并加上读写超时处理
 func NewTimeoutCodecEx(conn net.Conn, o *jkpool.Options) rpc.ClientCodec {
-
-	if jkutils.CODEC_JSON == o.Codec {
-		return NewTimeoutCodec(jsonrpc.NewClientCodec(conn), conn, o.ReadTimeout, o.WriteTimeout)
-	}
-
-	return NewTimeoutCodec(NewClientCodec(conn, o), conn, o.ReadTimeout, o.WriteTimeout)
+	return NewTimeoutCodec(getCodec(o.Codec).client(conn, o), conn, o.ReadTimeout, o.WriteTimeout)
 }
 
 func (tc *timeoutCodec) WriteRequest(r *rpc.Request, body interface{}) (err error) {
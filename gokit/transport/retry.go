@@ -28,12 +28,17 @@ func (e RetryError) Error() string {
 	return fmt.Sprintf("%v%s", e.Final, suffix)
 }
 
+func (e RetryError) Unwrap() error {
+	return e.Final
+}
+
 type Callback func(n int, received error) (keepTrying bool, replacement error)
 
 func Retry(max int, intervalMS int, b lb.Balancer) endpoint.Endpoint {
 	return RetryWithCallback(b, max, intervalMS)
 }
 
+// 调用失败时重试，ctx的截止时间作用于整个重试过程，ctx取消后不再重试并停止等待重试间隔
 func RetryWithCallback(b lb.Balancer, max, intervalMS int) endpoint.Endpoint {
 	if b == nil {
 		panic("nil Balancer")
@@ -48,14 +53,24 @@ func RetryWithCallback(b lb.Balancer, max, intervalMS int) endpoint.Endpoint {
 
 		for i := 1; ; i++ {
 
+			if err = ctx.Err(); nil != err {
+				final.RawErrors = append(final.RawErrors, err)
+				final.Final = err
+				return nil, final
+			}
+
 			if e, err = b.Endpoint(); err != nil {
 				final.RawErrors = append(final.RawErrors, err)
 				if max > i {
-					time.Sleep(time.Duration(intervalMS) * time.Millisecond)
-					continue
-				} else {
-					return nil, final
+					if sleepContext(ctx, intervalMS) {
+						continue
+					}
+					err = ctx.Err()
+					final.RawErrors = append(final.RawErrors, err)
 				}
+
+				final.Final = err
+				return nil, final
 			}
 
 			response, err := e(ctx, request)
@@ -63,12 +78,15 @@ func RetryWithCallback(b lb.Balancer, max, intervalMS int) endpoint.Endpoint {
 			if err != nil {
 				final.RawErrors = append(final.RawErrors, err)
 				if max > i {
-					time.Sleep(time.Duration(intervalMS) * time.Millisecond)
-					continue
-				} else {
-					final.Final = err
-					return nil, final
+					if sleepContext(ctx, intervalMS) {
+						continue
+					}
+					err = ctx.Err()
+					final.RawErrors = append(final.RawErrors, err)
 				}
+
+				final.Final = err
+				return nil, final
 			} else {
 				return response, nil
 			}
@@ -76,3 +94,21 @@ func RetryWithCallback(b lb.Balancer, max, intervalMS int) endpoint.Endpoint {
 		}
 	}
 }
+
+// 等待重试间隔，ctx取消时提前返回false
+func sleepContext(ctx context.Context, intervalMS int) bool {
+
+	if intervalMS <= 0 {
+		return nil == ctx.Err()
+	}
+
+	timer := time.NewTimer(time.Duration(intervalMS) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
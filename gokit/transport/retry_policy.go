@@ -0,0 +1,236 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	uprometheus "github.com/jkprj/jkfr/gokit/prometheus"
+	jkos "github.com/jkprj/jkfr/os"
+	ucounter "github.com/jkprj/jkfr/prometheus/counter"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 判断调用失败后是否可以重试
+type RetryClassifier func(action string, err error) bool
+
+// 默认重试判断：调用方取消和超时不重试，其他错误都重试
+func DefaultRetryClassifier(action string, err error) bool {
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+type actionKey struct{}
+
+// 在ctx中设置本次调用的action，重试时用于判断action是否可以重试
+func WithAction(ctx context.Context, action string) context.Context {
+	return context.WithValue(ctx, actionKey{}, action)
+}
+
+func ActionFromContext(ctx context.Context) string {
+	action, _ := ctx.Value(actionKey{}).(string)
+	return action
+}
+
+// 重试策略
+type RetryPolicy struct {
+	Max           int // 最大调用次数，包括第一次调用
+	IntervalMS    int // 退避基数(毫秒)，第n次重试前随机等待 [0, min(MaxIntervalMS, IntervalMS*2^(n-1))]
+	MaxIntervalMS int // 退避上限(毫秒)，<=0 时不限制
+
+	Budget              *RetryBudget    // 重试预算，为nil时不限制
+	Retryable           RetryClassifier // 重试判断，为nil时使用 DefaultRetryClassifier
+	Callback            Callback        // 每次失败后调用，返回false时不再重试，replacement不为nil时替换返回的错误
+	NonRetryableActions []string        // 不允许重试的action，如非幂等的接口
+
+	// 指标：nameSpace_Retry_Total，nameSpace_Retry_Budget_Exhausted
+	PrometheusNameSpace string
+	Role                string
+	Service             string
+}
+
+// 按重试策略调用，ctx的截止时间作用于整个重试过程，ctx取消后不再重试并停止等待
+func RetryWithPolicy(b lb.Balancer, policy RetryPolicy) endpoint.Endpoint {
+	if b == nil {
+		panic("nil Balancer")
+	}
+
+	if nil == policy.Retryable {
+		policy.Retryable = DefaultRetryClassifier
+	}
+
+	nonRetryable := map[string]bool{}
+	for _, action := range policy.NonRetryableActions {
+		nonRetryable[action] = true
+	}
+
+	var retryCounter, exhaustedCounter *prometheus.CounterVec
+	if "" != policy.PrometheusNameSpace {
+		labelNames := []string{"APP", "Role", "Service", "Action"}
+		retryCounter = ucounter.GetCounterVec(policy.PrometheusNameSpace+"_Retry_Total", labelNames)
+		exhaustedCounter = ucounter.GetCounterVec(policy.PrometheusNameSpace+"_Retry_Budget_Exhausted", labelNames)
+	}
+
+	incCounter := func(counter *prometheus.CounterVec, action string) {
+		if nil != counter && uprometheus.Running {
+			counter.With(prometheus.Labels{"APP": jkos.AppName(), "Role": policy.Role, "Service": policy.Service, "Action": action}).Inc()
+		}
+	}
+
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+
+		var (
+			final RetryError
+			e     endpoint.Endpoint
+		)
+
+		action := ActionFromContext(ctx)
+
+		if nil != policy.Budget {
+			policy.Budget.request()
+		}
+
+		for i := 1; ; i++ {
+
+			if err = ctx.Err(); nil != err {
+				final.RawErrors = append(final.RawErrors, err)
+				final.Final = err
+				return nil, final
+			}
+
+			if e, err = b.Endpoint(); nil == err {
+				response, err = e(ctx, request)
+				if nil == err {
+					return response, nil
+				}
+			}
+
+			final.RawErrors = append(final.RawErrors, err)
+
+			keepTrying := policy.Max > i && !nonRetryable[action] && policy.Retryable(action, err)
+			if nil != policy.Callback {
+				cbKeepTrying, replacement := policy.Callback(i, err)
+				keepTrying = keepTrying && cbKeepTrying
+				if nil != replacement {
+					err = replacement
+				}
+			}
+
+			if keepTrying && nil != policy.Budget && !policy.Budget.tryRetry() {
+				incCounter(exhaustedCounter, action)
+				keepTrying = false
+			}
+
+			if !keepTrying {
+				final.Final = err
+				return nil, final
+			}
+
+			incCounter(retryCounter, action)
+
+			if !sleepContext(ctx, policy.backoffMS(i)) {
+				err = ctx.Err()
+				final.RawErrors = append(final.RawErrors, err)
+				final.Final = err
+				return nil, final
+			}
+		}
+	}
+}
+
+// 第n次重试前的等待时间，指数退避加全抖动
+func (policy *RetryPolicy) backoffMS(n int) int {
+
+	if policy.IntervalMS <= 0 {
+		return 0
+	}
+
+	ceil := int64(policy.IntervalMS)
+	for i := 1; i < n; i++ {
+		ceil *= 2
+		if 0 < policy.MaxIntervalMS && ceil >= int64(policy.MaxIntervalMS) {
+			break
+		}
+	}
+
+	if 0 < policy.MaxIntervalMS && ceil > int64(policy.MaxIntervalMS) {
+		ceil = int64(policy.MaxIntervalMS)
+	}
+
+	return int(rand.Int63n(ceil + 1))
+}
+
+const budgetWindow = 10 // 重试预算的统计窗口(秒)
+
+type budgetBucket struct {
+	sec      int64
+	requests int
+	retries  int
+}
+
+// 重试预算，统计窗口内允许的重试次数为 minPerSec*窗口秒数 + ratio*请求数，
+// 防止服务异常时重试放大请求量
+type RetryBudget struct {
+	ratio     float64
+	minPerSec int
+	now       func() time.Time // 当前时间，测试时替换
+
+	mt      sync.Mutex
+	buckets [budgetWindow]budgetBucket
+}
+
+// 全局默认的重试预算，所有客户端共享
+var DefaultRetryBudget = NewRetryBudget(jkos.GetEnvFloat("C_RETRY_BUDGET_RATIO", 0.2), jkos.GetEnvInt("C_RETRY_BUDGET_MIN_PER_SEC", 10))
+
+// Parameters :
+// ratio     重试次数占请求数的比例
+// minPerSec 请求量很小时每秒至少允许的重试次数
+func NewRetryBudget(ratio float64, minPerSec int) *RetryBudget {
+	return &RetryBudget{ratio: ratio, minPerSec: minPerSec, now: time.Now}
+}
+
+func (rb *RetryBudget) bucket(now int64) *budgetBucket {
+	bk := &rb.buckets[now%budgetWindow]
+	if bk.sec != now {
+		bk.sec = now
+		bk.requests = 0
+		bk.retries = 0
+	}
+
+	return bk
+}
+
+func (rb *RetryBudget) request() {
+	rb.mt.Lock()
+	defer rb.mt.Unlock()
+
+	rb.bucket(rb.now().Unix()).requests++
+}
+
+// 预算足够时记录一次重试并返回true
+func (rb *RetryBudget) tryRetry() bool {
+	rb.mt.Lock()
+	defer rb.mt.Unlock()
+
+	now := rb.now().Unix()
+
+	requests, retries := 0, 0
+	for i := range rb.buckets {
+		if now-rb.buckets[i].sec < budgetWindow {
+			requests += rb.buckets[i].requests
+			retries += rb.buckets[i].retries
+		}
+	}
+
+	if float64(retries) >= float64(rb.minPerSec*budgetWindow)+rb.ratio*float64(requests) {
+		return false
+	}
+
+	rb.bucket(now).retries++
+
+	return true
+}
@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBudget(ratio float64, minPerSec int) (*RetryBudget, *time.Time) {
+	now := time.Unix(1000, 0)
+	rb := NewRetryBudget(ratio, minPerSec)
+	rb.now = func() time.Time { return now }
+	return rb, &now
+}
+
+// 统计窗口内允许的重试次数
+func allowedRetries(rb *RetryBudget) int {
+	n := 0
+	for rb.tryRetry() {
+		n++
+	}
+	return n
+}
+
+func TestRetryBudgetRatio(t *testing.T) {
+
+	rb, now := newTestBudget(0.2, 0)
+
+	if n := allowedRetries(rb); 0 != n {
+		t.Fatalf("no request, retries: %d, want 0", n)
+	}
+
+	// 请求分布在窗口内的不同秒
+	for i := 0; i < 100; i++ {
+		if 0 < i && 0 == i%10 {
+			*now = now.Add(time.Second)
+		}
+		rb.request()
+	}
+
+	if n := allowedRetries(rb); 20 != n {
+		t.Fatalf("100 requests, retries: %d, want 20", n)
+	}
+}
+
+func TestRetryBudgetMinPerSec(t *testing.T) {
+
+	rb, now := newTestBudget(0.2, 2)
+
+	// 没有请求时每秒至少允许 minPerSec 次重试
+	if n := allowedRetries(rb); 2*budgetWindow != n {
+		t.Fatalf("retries: %d, want %d", n, 2*budgetWindow)
+	}
+
+	for i := 0; i < 50; i++ {
+		rb.request()
+	}
+	if n := allowedRetries(rb); 10 != n {
+		t.Fatalf("50 requests, retries: %d, want 10", n)
+	}
+
+	// 超出统计窗口后预算恢复
+	*now = now.Add(budgetWindow * time.Second)
+	if n := allowedRetries(rb); 2*budgetWindow != n {
+		t.Fatalf("after window, retries: %d, want %d", n, 2*budgetWindow)
+	}
+}
+
+func TestBackoffFullJitter(t *testing.T) {
+
+	cases := []struct {
+		policy RetryPolicy
+		ceils  []int // 第n次重试的等待上限
+	}{
+		{RetryPolicy{IntervalMS: 100, MaxIntervalMS: 1000}, []int{100, 200, 400, 800, 1000, 1000}},
+		{RetryPolicy{IntervalMS: 100, MaxIntervalMS: 300}, []int{100, 200, 300, 300}},
+		{RetryPolicy{IntervalMS: 100}, []int{100, 200, 400, 800, 1600}},
+		{RetryPolicy{IntervalMS: 0, MaxIntervalMS: 1000}, []int{0, 0, 0}},
+	}
+
+	for _, c := range cases {
+		for i, ceil := range c.ceils {
+
+			min, max := ceil, 0
+			for j := 0; j < 1000; j++ {
+				ms := c.policy.backoffMS(i + 1)
+				if ms < 0 || ms > ceil {
+					t.Fatalf("policy: %+v, n: %d, backoff: %d, want [0, %d]", c.policy, i+1, ms, ceil)
+				}
+				if ms < min {
+					min = ms
+				}
+				if ms > max {
+					max = ms
+				}
+			}
+
+			// 全抖动在 [0, ceil] 内均匀分布，而不是集中在上限附近
+			if min > ceil/4 || max < ceil*3/4 {
+				t.Fatalf("policy: %+v, n: %d, backoff range: [%d, %d], want spread over [0, %d]", c.policy, i+1, min, max, ceil)
+			}
+		}
+	}
+}
@@ -12,6 +12,8 @@ import (
 	jkregistry "github.com/jkprj/jkfr/gokit/registry"
 	jksd "github.com/jkprj/jkfr/gokit/sd"
 	jktrans "github.com/jkprj/jkfr/gokit/transport"
+	"github.com/jkprj/jkfr/gokit/transport/breaker"
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
 	jkendpoint "github.com/jkprj/jkfr/gokit/transport/endpoint"
 	jkpool "github.com/jkprj/jkfr/gokit/transport/pool"
 	rpcpool "github.com/jkprj/jkfr/gokit/transport/pool/rpc"
@@ -21,7 +23,6 @@ import (
 
 	"github.com/go-kit/kit/endpoint"
 	kitsd "github.com/go-kit/kit/sd"
-	kitconsul "github.com/go-kit/kit/sd/consul"
 	"github.com/go-kit/kit/sd/lb"
 )
 
@@ -41,6 +42,16 @@ func Call(name, action string, req, resp interface{}) error {
 	return client.Call(action, req, resp)
 }
 
+func CallContext(ctx context.Context, name, action string, req, resp interface{}) error {
+
+	client, err := GetRPCClient(name)
+	if nil != err {
+		return err
+	}
+
+	return client.CallContext(ctx, action, req, resp)
+}
+
 func GoCall(name, action string, req, resp interface{}) *rpc.Call {
 	client, err := GetRPCClient(name)
 	if nil != err {
@@ -144,14 +155,14 @@ type reuquestParam struct {
 type RPCClient struct {
 	name string
 
-	cfg          *ClientConfig
-	consulClient kitconsul.Client
+	cfg        *ClientConfig
+	regBackend jkregistry.Backend
 
 	rpcPool *rpcpool.RpcPools
 
-	consulInstancer  *kitconsul.Instancer
-	consulEndpointer *jksd.DefaultEndpointer
-	reqEndPoint      endpoint.Endpoint
+	instancer   kitsd.Instancer
+	endpointer  *jksd.DefaultEndpointer
+	reqEndPoint endpoint.Endpoint
 
 	actionEndPoint map[string]endpoint.Endpoint
 	mtAction       sync.RWMutex
@@ -163,9 +174,9 @@ func NewClient(name string, ops ...ClientOption) (rpcClient *RPCClient, err erro
 	rpcClient.cfg = newClientConfig(name, ops...)
 	rpcClient.actionEndPoint = map[string]endpoint.Endpoint{}
 
-	rpcClient.consulClient, err = jkregistry.NewConsulClient(rpcClient.name, rpcClient.cfg.RegOps...)
+	rpcClient.regBackend, err = jkregistry.NewBackend(rpcClient.name, rpcClient.cfg.RegOps...)
 	if nil != err {
-		jklog.Errorw("jkregistry.NewConsulClient fail", "name", rpcClient.name, "cfg", *rpcClient.cfg, "err", err.Error())
+		jklog.Errorw("jkregistry.NewBackend fail", "name", rpcClient.name, "cfg", *rpcClient.cfg, "err", err.Error())
 		return nil, err
 	}
 
@@ -186,6 +197,7 @@ func (client *RPCClient) init_pool() {
 	op.WriteTimeout = time.Duration(client.cfg.WriteTimeout) * time.Second
 	op.Factory = client.cfg.Fatory(client.cfg)
 	op.Codec = client.cfg.Codec
+	op.Compress = jkcompress.NewOptions(client.cfg.Compress, client.cfg.CompressMinSize, client.cfg.CompressMaxSize, client.cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, client.name)
 
 	client.rpcPool, _ = rpcpool.NewRpcPools(nil, op)
 	client.rpcPool.SetIdleTimeOut(uint(client.cfg.IdleTimeout))
@@ -194,18 +206,29 @@ func (client *RPCClient) init_pool() {
 
 func (client *RPCClient) Close() {
 
-	if nil != client.consulEndpointer {
-		client.consulEndpointer.Close()
+	if nil != client.endpointer {
+		client.endpointer.Close()
 	}
 
-	if nil != client.consulInstancer {
-		client.consulInstancer.Stop()
+	if nil != client.instancer {
+		client.instancer.Stop()
 	}
 
 	client.rpcPool.Close()
 }
 
 func (client *RPCClient) Call(action string, req, resp interface{}) (err error) {
+	return client.CallContext(context.Background(), action, req, resp)
+}
+
+// 一致性哈希策略(hash)下相同key的调用发送到同一个服务实例，其他策略下key不生效
+func (client *RPCClient) CallWithKey(key, action string, req, resp interface{}) (err error) {
+	return client.CallContext(jklb.WithHashKey(context.Background(), key), action, req, resp)
+}
+
+// 调用服务，ctx的截止时间作用于包括重试在内的整个调用过程，ctx取消后立即返回
+// 哈希key也可以通过 jklb.WithHashKey 设置在ctx中
+func (client *RPCClient) CallContext(ctx context.Context, action string, req, resp interface{}) (err error) {
 
 	client.mtAction.RLock()
 	repEndPoint, ok := client.actionEndPoint[action]
@@ -216,7 +239,7 @@ func (client *RPCClient) Call(action string, req, resp interface{}) (err error)
 
 	reqParam := reuquestParam{action: action, request: req, respone: resp}
 
-	_, err = repEndPoint(context.Background(), reqParam)
+	_, err = repEndPoint(jktrans.WithAction(ctx, action), reqParam)
 	if nil != err {
 		jklog.Errorw("EndPoint Request fail", "name:", client.name, "action", reqParam.action, "req", req, "err", err.Error())
 		return err
@@ -249,40 +272,95 @@ func (client *RPCClient) GoCall(action string, req, resp interface{}) *rpc.Call
 
 func (client *RPCClient) makeRuquestEndpoint() endpoint.Endpoint {
 
-	client.consulInstancer = kitconsul.NewInstancer(client.consulClient, kitlog.InfowLogger, client.name, client.cfg.ConsulTags, client.cfg.PassingOnly)
-	client.consulEndpointer = jksd.NewEndpointer(client.consulInstancer, client.makeRequestFactory(), kitlog.ErrorwLogger)
+	client.instancer = client.regBackend.NewInstancer(client.name, client.cfg.ConsulTags, client.cfg.PassingOnly)
+	client.endpointer = jksd.NewEndpointer(client.instancer, client.makeRequestFactory(), kitlog.ErrorwLogger,
+		jktrans.EndpointerOptions(client.cfg.InvalidateOnError, client.cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, client.name)...)
 
 	var balancer lb.Balancer
 	{
 		if jkutils.STRATEGY_ROUND == client.cfg.Strategy {
-			balancer = lb.NewRoundRobin(client.consulEndpointer)
+			balancer = lb.NewRoundRobin(client.endpointer)
 		} else if jkutils.STRATEGY_RANDOM == client.cfg.Strategy {
-			balancer = jklb.NewRandom(client.consulEndpointer, time.Now().UnixNano())
+			balancer = jklb.NewRandom(client.endpointer, time.Now().UnixNano())
+		} else if jkutils.STRATEGY_P2C_EWMA == client.cfg.Strategy {
+			balancer = jklb.NewP2CEWMABalancer(client.endpointer, breaker.BalancerClassifier(client.cfg.Breaker.IsFailure))
+		} else if jkutils.STRATEGY_CONSISTENT_HASH == client.cfg.Strategy {
+			balancer = jklb.NewConsistentHashBalancer(client.endpointer, breaker.BalancerClassifier(client.cfg.Breaker.IsFailure))
+		} else if jkutils.STRATEGY_WEIGHTED == client.cfg.Strategy {
+			balancer = jklb.NewWeightedBalancer(client.endpointer)
 		} else {
-			balancer = jklb.NewLeastBalancer(client.consulEndpointer)
+			balancer = jklb.NewLeastBalancer(client.endpointer)
 		}
 	}
 
-	// return lb.Retry(client.cfg.Retry, time.Duration(client.cfg.TimeOut)*time.Second, balancer)
-	return jktrans.Retry(client.cfg.Retry, client.cfg.RetryIntervalMS, balancer)
+	if 0 < len(client.cfg.HedgeActions) {
+		balancer = newHedgeBalancer(client, balancer)
+	}
+
+	return jktrans.RetryWithPolicy(balancer, client.retryPolicy())
 }
 
 func (client *RPCClient) makeRequestFactory() kitsd.Factory {
-	return func(instance string) (endpoint endpoint.Endpoint, closer io.Closer, err_ error) {
-		return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+	return func(instance string) (endpoint.Endpoint, io.Closer, error) {
+		var reqEndpoint endpoint.Endpoint = func(ctx context.Context, request interface{}) (response interface{}, err error) {
 
 			reqParam, ok := request.(reuquestParam)
 			if !ok {
 				return nil, errors.New("the request is not reuquestParam")
 			}
 
-			err = client.rpcPool.CallWithAddr(instance, reqParam.action, reqParam.request, reqParam.respone)
+			err = client.rpcPool.CallWithAddrContext(ctx, instance, reqParam.action, reqParam.request, reqParam.respone, time.Duration(client.cfg.TimeOut)*time.Second)
 			if nil != err {
 				// jklog.Errorw("client.rpcPool.CallWithAddr fail", "instance", instance, "action", reqParam.action, "request", reqParam.request, "err", err)
 				return nil, err
 			}
 
 			return nil, nil
-		}, nil, nil
+		}
+
+		// 故障转移到远程数据中心时统计跨数据中心请求
+		reqEndpoint = jktrans.CrossDCMiddleware(client.instancer, client.cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, client.name, instance)(reqEndpoint)
+
+		var closer io.Closer
+		if client.cfg.Breaker.Enable {
+			// 实例从注册中心移除时会关闭熔断器
+			b := breaker.NewInstanceBreaker(client.cfg.Breaker, client.cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, client.name, instance)
+			reqEndpoint = b.Middleware()(reqEndpoint)
+			closer = b
+		}
+
+		return hedgeClaim(instance, reqEndpoint), closer, nil
 	}
 }
+
+func (client *RPCClient) retryPolicy() jktrans.RetryPolicy {
+	return jktrans.RetryPolicy{
+		Max:                 client.cfg.Retry,
+		IntervalMS:          client.cfg.RetryIntervalMS,
+		MaxIntervalMS:       client.cfg.RetryMaxIntervalMS,
+		Budget:              client.cfg.RetryBudget,
+		Retryable:           client.cfg.RetryClassifier,
+		NonRetryableActions: client.cfg.NonRetryableActions,
+		PrometheusNameSpace: client.cfg.PrometheusNameSpace,
+		Role:                jkutils.ROLE_CLIENT,
+		Service:             client.name,
+	}
+}
+
+// 重试的默认判断，服务端返回的业务错误不重试，读超时可以重试
+func isRetryable(action string, err error) bool {
+	if rpcpool.IsServerError(err) {
+		return false
+	}
+
+	return jktrans.DefaultRetryClassifier(action, err)
+}
+
+// 熔断的默认失败判断，服务端返回的业务错误不计为失败，读超时计为失败
+func isBreakerFailure(err error) bool {
+	if rpcpool.IsServerError(err) {
+		return false
+	}
+
+	return breaker.DefaultClassifier(err)
+}
@@ -0,0 +1,259 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	uprometheus "github.com/jkprj/jkfr/gokit/prometheus"
+	jkutils "github.com/jkprj/jkfr/gokit/utils"
+	jkos "github.com/jkprj/jkfr/os"
+	ucounter "github.com/jkprj/jkfr/prometheus/counter"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 对冲请求：请求在延迟时间内没有返回时，向另一个服务实例再发送一次相同的请求，
+// 先返回的结果生效，另一个请求被取消。只适合只读(幂等)的action
+
+const (
+	hedgeMaxPick       = 3   // 选择对冲实例的最大次数，负载均衡选中同一个实例时重新选择
+	hedgeLatencySample = 100 // 统计延迟的样本数
+	hedgeMinSample     = 20  // 按p95对冲时至少需要的样本数
+)
+
+var errHedgeSameInstance = errors.New("hedge request picked the same instance")
+
+type hedgeKey struct{}
+
+// 同一次对冲调用中已经使用的实例
+type hedgeState struct {
+	mt        sync.Mutex
+	instances map[string]bool
+}
+
+func (hs *hedgeState) claim(instance string) bool {
+	hs.mt.Lock()
+	defer hs.mt.Unlock()
+
+	if hs.instances[instance] {
+		return false
+	}
+	hs.instances[instance] = true
+
+	return true
+}
+
+// 对冲调用时保证请求发送到不同的实例
+func hedgeClaim(instance string, next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		if hs, ok := ctx.Value(hedgeKey{}).(*hedgeState); ok && !hs.claim(instance) {
+			return nil, errHedgeSameInstance
+		}
+
+		return next(ctx, request)
+	}
+}
+
+// 统计action最近请求的延迟，用于计算p95
+type hedgeLatency struct {
+	mt      sync.Mutex
+	samples [hedgeLatencySample]time.Duration
+	count   int
+	p95     time.Duration
+}
+
+func (hl *hedgeLatency) observe(d time.Duration) {
+	hl.mt.Lock()
+	defer hl.mt.Unlock()
+
+	hl.samples[hl.count%hedgeLatencySample] = d
+	hl.count++
+
+	if hl.count >= hedgeMinSample && 0 == hl.count%10 {
+		n := hl.count
+		if n > hedgeLatencySample {
+			n = hedgeLatencySample
+		}
+
+		sorted := make([]time.Duration, n)
+		copy(sorted, hl.samples[:n])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		hl.p95 = sorted[n*95/100]
+	}
+}
+
+func (hl *hedgeLatency) getP95() time.Duration {
+	hl.mt.Lock()
+	defer hl.mt.Unlock()
+
+	return hl.p95
+}
+
+type hedgeBalancer struct {
+	lb.Balancer
+	client *RPCClient
+
+	latencies map[string]*hedgeLatency
+
+	sentCounter *prometheus.CounterVec
+	wonCounter  *prometheus.CounterVec
+}
+
+func newHedgeBalancer(client *RPCClient, balancer lb.Balancer) *hedgeBalancer {
+
+	hb := &hedgeBalancer{Balancer: balancer, client: client, latencies: map[string]*hedgeLatency{}}
+	for action := range client.cfg.HedgeActions {
+		hb.latencies[action] = new(hedgeLatency)
+	}
+
+	labelNames := []string{"APP", "Role", "Service", "Action"}
+	hb.sentCounter = ucounter.GetCounterVec(client.cfg.PrometheusNameSpace+"_Hedge_Sent", labelNames)
+	hb.wonCounter = ucounter.GetCounterVec(client.cfg.PrometheusNameSpace+"_Hedge_Won", labelNames)
+
+	return hb
+}
+
+func (hb *hedgeBalancer) Endpoint() (endpoint.Endpoint, error) {
+
+	e, err := hb.Balancer.Endpoint()
+	if nil != err {
+		return nil, err
+	}
+
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+
+		reqParam, ok := request.(reuquestParam)
+		if !ok {
+			return e(ctx, request)
+		}
+
+		latency, ok := hb.latencies[reqParam.action]
+		if !ok {
+			return e(ctx, request)
+		}
+
+		delay := time.Duration(hb.client.cfg.HedgeActions[reqParam.action]) * time.Millisecond
+		if delay <= 0 {
+			delay = latency.getP95()
+		}
+
+		bg := time.Now()
+
+		if delay <= 0 {
+			response, err = e(ctx, request) // 样本不够，暂不对冲
+		} else {
+			response, err = hb.hedge(ctx, e, delay, reqParam)
+		}
+
+		if nil == err {
+			latency.observe(time.Since(bg))
+		}
+
+		return response, err
+	}, nil
+}
+
+type hedgeResult struct {
+	respone interface{}
+	err     error
+	hedged  bool
+}
+
+func (hb *hedgeBalancer) hedge(ctx context.Context, primary endpoint.Endpoint, delay time.Duration, reqParam reuquestParam) (response interface{}, err error) {
+
+	ctx = context.WithValue(ctx, hedgeKey{}, &hedgeState{instances: map[string]bool{}})
+	ctx, cancel := context.WithCancel(ctx) // 返回时取消还没有完成的请求
+	defer cancel()
+
+	results := make(chan hedgeResult, 1+hedgeMaxPick)
+
+	call := func(e endpoint.Endpoint, hedged bool) {
+		param := reqParam
+		param.respone = newReply(reqParam.respone) // 两个请求同时解码，各自使用单独的响应
+		_, err := e(ctx, param)
+
+		if hedged && errHedgeSameInstance != err {
+			hb.incCounter(hb.sentCounter, reqParam.action)
+		}
+
+		results <- hedgeResult{respone: param.respone, err: err, hedged: hedged}
+	}
+
+	go call(primary, false)
+	pending, picks := 1, 0
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var firstErr error
+
+	for {
+		select {
+		case <-timer.C:
+			if picks < hedgeMaxPick {
+				if e, pickErr := hb.Balancer.Endpoint(); nil == pickErr {
+					go call(e, true)
+					pending++
+					picks++
+				}
+			}
+
+		case res := <-results:
+			pending--
+
+			if nil == res.err {
+				if res.hedged {
+					hb.incCounter(hb.wonCounter, reqParam.action)
+				}
+				setReply(reqParam.respone, res.respone)
+				return nil, nil
+			}
+
+			if errHedgeSameInstance == res.err {
+				// 选中了同一个实例，立即重新选择
+				if picks < hedgeMaxPick {
+					timer.Reset(0)
+				}
+			} else if nil == firstErr {
+				firstErr = res.err
+			}
+
+			if 0 == pending && (nil != firstErr || picks >= hedgeMaxPick) {
+				return nil, firstErr
+			}
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (hb *hedgeBalancer) incCounter(counter *prometheus.CounterVec, action string) {
+	if uprometheus.Running {
+		counter.With(prometheus.Labels{"APP": jkos.AppName(), "Role": jkutils.ROLE_CLIENT, "Service": hb.client.name, "Action": action}).Inc()
+	}
+}
+
+func newReply(reply interface{}) interface{} {
+	v := reflect.ValueOf(reply)
+	if reflect.Ptr != v.Kind() || v.IsNil() {
+		return reply
+	}
+
+	return reflect.New(v.Elem().Type()).Interface()
+}
+
+func setReply(dst, src interface{}) {
+	v := reflect.ValueOf(dst)
+	if reflect.Ptr != v.Kind() || v.IsNil() || dst == src {
+		return
+	}
+
+	v.Elem().Set(reflect.ValueOf(src).Elem())
+}
@@ -3,8 +3,13 @@ package rpc
 import (
 	"net/http"
 	"net/rpc"
+	"strconv"
+	"strings"
 
 	jkregistry "github.com/jkprj/jkfr/gokit/registry"
+	jktrans "github.com/jkprj/jkfr/gokit/transport"
+	"github.com/jkprj/jkfr/gokit/transport/breaker"
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
 	jkendpoint "github.com/jkprj/jkfr/gokit/transport/endpoint"
 	jkutils "github.com/jkprj/jkfr/gokit/utils"
 	jkos "github.com/jkprj/jkfr/os"
@@ -26,6 +31,8 @@ func AppendHeader(hDest, hSrc http.Header) {
 type ClientConfig struct {
 	RegOps            []jkregistry.RegOption        `json:"-" toml:"-"`
 	ActionMiddlewares []jkendpoint.ActionMiddleware `json:"-" toml:"-"`
+	RetryBudget       *jktrans.RetryBudget          `json:"-" toml:"-"`
+	RetryClassifier   jktrans.RetryClassifier       `json:"-" toml:"-"`
 	Fatory            ClientFatory                  `json:"-" toml:"-"`
 	AsyncCallChan     chan *rpc.Call                `json:"-" toml:"-"`
 	ClientPem         []byte                        `json:"-" toml:"-"`
@@ -37,9 +44,14 @@ type ClientConfig struct {
 	PrometheusNameSpace string     `json:"PrometheusNameSpace" toml:"PrometheusNameSpace"`
 	Retry               int        `json:"Retry" toml:"Retry"`
 	RetryIntervalMS     int        `json:"RetryIntervalMS" toml:"RetryIntervalMS"`
+	RetryMaxIntervalMS  int        `json:"RetryMaxIntervalMS" toml:"RetryMaxIntervalMS"`
+	NonRetryableActions []string   `json:"NonRetryableActions" toml:"NonRetryableActions"`
 	RateLimit           rate.Limit `json:"RateLimit" toml:"RateLimit"`
 	TimeOut             int        `json:"TimeOut" toml:"TimeOut"`
 	PassingOnly         bool       `json:"PassingOnly" toml:"PassingOnly"`
+	InvalidateOnError   int        `json:"InvalidateOnError" toml:"InvalidateOnError"`
+	Filter              string     `json:"Filter" toml:"Filter"`
+	FailoverDatacenters []string   `json:"FailoverDatacenters" toml:"FailoverDatacenters"`
 	KeepAlive           bool       `json:"KeepAlive" toml:"KeepAlive"`
 	PoolCap             int        `json:"PoolCap" toml:"PoolCap"`
 	MaxCap              int        `json:"MaxCap" toml:"MaxCap"`
@@ -50,6 +62,13 @@ type ClientConfig struct {
 	ClientPemFile       string     `json:"ClientPemFile" toml:"ClientPemFile"`
 	ClientKeyFile       string     `json:"ClientKeyFile" toml:"ClientKeyFile"`
 	Codec               string     `json:"Codec" toml:"Codec"`
+	Compress            string     `json:"Compress" toml:"Compress"`               // 负载压缩算法，为空不压缩，服务端也开启压缩时才会压缩
+	CompressMinSize     int        `json:"CompressMinSize" toml:"CompressMinSize"` // 参数编码后不小于该大小(字节)时才压缩
+	CompressMaxSize     int        `json:"CompressMaxSize" toml:"CompressMaxSize"` // 响应解压后的最大大小(字节)，超过时调用失败
+
+	HedgeActions map[string]int `json:"HedgeActions" toml:"HedgeActions"` // 开启对冲请求的action及对冲延迟(毫秒)，延迟<=0时使用该action最近请求延迟的p95
+
+	Breaker breaker.Config `json:"Breaker" toml:"Breaker"` // 熔断配置
 
 	tmpActionMiddlewares []jkendpoint.ActionMiddleware
 }
@@ -71,11 +90,21 @@ func defaultClientConfig(name string) *ClientConfig {
 	cfg.Strategy = jkos.GetEnvString("C_STRATEGY", jkutils.STRATEGY_LEAST)
 	cfg.PrometheusNameSpace = jkos.GetEnvString("C_PROMETHEUS_NAME_SPACE", name)
 	cfg.Codec = jkos.GetEnvString("C_CODEC", jkutils.CODEC_GOB)
+	cfg.Compress = jkos.GetEnvString("C_COMPRESS", "")
+	cfg.CompressMinSize = jkos.GetEnvInt("C_COMPRESS_MIN_SIZE", jkcompress.DEFAULT_MIN_SIZE)
+	cfg.CompressMaxSize = jkos.GetEnvInt("C_COMPRESS_MAX_SIZE", jkcompress.DEFAULT_MAX_SIZE)
 	cfg.Retry = jkos.GetEnvInt("C_RETRY", 3)
 	cfg.RetryIntervalMS = jkos.GetEnvInt("C_RETRY_INTERVAL_MS", 1000)
+	cfg.RetryMaxIntervalMS = jkos.GetEnvInt("C_RETRY_MAX_INTERVAL_MS", 10000)
+	cfg.NonRetryableActions = jkos.GetEnvStrings("C_NON_RETRYABLE_ACTIONS", ",", nil)
+	cfg.RetryBudget = jktrans.DefaultRetryBudget
+	cfg.HedgeActions = getEnvHedgeActions("C_HEDGE_ACTIONS")
 	cfg.RateLimit = rate.Limit(jkos.GetEnvInt("C_RATE_LIMIT", 0))
 	cfg.TimeOut = jkos.GetEnvInt("C_TIMEOUT", 60)
 	cfg.PassingOnly = jkos.GetEnvBool("C_PASSING_ONLY", true)
+	cfg.InvalidateOnError = jkos.GetEnvInt("C_INVALIDATE_ON_ERROR", -1)
+	cfg.Filter = jkos.GetEnvString("C_FILTER", "")
+	cfg.FailoverDatacenters = jkos.GetEnvStrings("C_FAILOVER_DATACENTERS", ",", nil)
 	cfg.KeepAlive = jkos.GetEnvBool("C_KEEP_ALIVE", true)
 	cfg.PoolCap = jkos.GetEnvInt("C_POOL_CAP", 2)
 	cfg.MaxCap = jkos.GetEnvInt("C_MAX_CAP", 64)
@@ -89,6 +118,7 @@ func defaultClientConfig(name string) *ClientConfig {
 
 	cfg.ClientKeyFile = jkos.GetEnvString("C_KEY_FILE", "")
 	ClientKeyFile(cfg.ClientKeyFile)(cfg)
+	cfg.Breaker = breaker.DefaultConfig()
 
 	cfg.ConfigPath = jkos.GetEnvString("C_CONFIG_PATH", "")
 	if jkos.IsFileExists(cfg.ConfigPath) {
@@ -121,12 +151,31 @@ func newClientConfig(name string, ops ...ClientOption) *ClientConfig {
 		op(cfg)
 	}
 
+	// 客户端指定的过滤表达式和故障转移数据中心优先于注册配置
+	if "" != cfg.Filter {
+		cfg.RegOps = append(cfg.RegOps, jkregistry.WithFilter(cfg.Filter))
+	}
+	if 0 < len(cfg.FailoverDatacenters) {
+		cfg.RegOps = append(cfg.RegOps, jkregistry.WithFailoverDatacenters(cfg.FailoverDatacenters...))
+	}
+
 	cfg.ActionMiddlewares = jkendpoint.DefaultMiddleware(cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, cfg.RateLimit)
+	if nil == cfg.RetryClassifier {
+		cfg.RetryClassifier = isRetryable
+	}
+	if nil == cfg.Breaker.IsFailure {
+		cfg.Breaker.IsFailure = isBreakerFailure
+	}
 
 	if 0 < len(cfg.tmpActionMiddlewares) {
 		cfg.ActionMiddlewares = cfg.tmpActionMiddlewares
 	}
 
+	// 自定义中间件时也需要按方法熔断
+	if cfg.Breaker.PerAction {
+		cfg.ActionMiddlewares = append(cfg.ActionMiddlewares, jkendpoint.MakeBreakerMiddleware(cfg.PrometheusNameSpace, jkutils.ROLE_CLIENT, name, cfg.Breaker))
+	}
+
 	return cfg
 }
 
@@ -148,6 +197,27 @@ func ClientCodec(codec string) ClientOption {
 	}
 }
 
+// 负载压缩算法(如 gzip)，服务端也开启压缩时按连接协商压缩
+func ClientCompress(compress string) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.Compress = compress
+	}
+}
+
+// 参数编码后不小于该大小(字节)时才压缩
+func ClientCompressMinSize(size int) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.CompressMinSize = size
+	}
+}
+
+// 响应解压后的最大大小(字节)，防止对端发送解压后超大的数据
+func ClientCompressMaxSize(size int) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.CompressMaxSize = size
+	}
+}
+
 func ClientRegOption(regOps ...jkregistry.RegOption) ClientOption {
 	return func(cfg *ClientConfig) {
 		cfg.RegOps = append(cfg.RegOps, regOps...)
@@ -232,6 +302,28 @@ func ClientPassingOnly(passingOnly bool) ClientOption {
 	}
 }
 
+// 服务发现出错后多少秒清空服务实例，<0 时一直使用出错前的服务实例
+func ClientInvalidateOnError(seconds int) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.InvalidateOnError = seconds
+	}
+}
+
+// 服务发现的consul过滤表达式，如 Service.Meta.version == "v2" or "canary" in Service.Tags，
+// 本地过滤函数通过 ClientRegOption(jkregistry.WithInstanceFilter(...)) 指定
+func ClientFilter(expr string) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.Filter = expr
+	}
+}
+
+// 故障转移的远程数据中心，本地数据中心健康的服务实例少于阈值(jkregistry.WithFailoverThreshold)时按顺序使用
+func ClientFailoverDatacenters(datacenters ...string) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.FailoverDatacenters = datacenters
+	}
+}
+
 func ClientKeepAlive(keepAlive bool) ClientOption {
 	return func(cfg *ClientConfig) {
 		cfg.KeepAlive = keepAlive
@@ -296,6 +388,61 @@ func ClientKeyFile(clientKeyFile string) ClientOption {
 	}
 }
 
+func ClientRetryMaxIntervalMS(retryMaxIntervalMS int) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.RetryMaxIntervalMS = retryMaxIntervalMS
+	}
+}
+
+// 不允许重试的action，如非幂等的接口
+func ClientNonRetryableActions(actions ...string) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.NonRetryableActions = append(cfg.NonRetryableActions, actions...)
+	}
+}
+
+// 重试预算，默认使用全局共享的 jktrans.DefaultRetryBudget，为nil时不限制
+func ClientRetryBudget(budget *jktrans.RetryBudget) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.RetryBudget = budget
+	}
+}
+
+// 判断失败的调用是否可以重试
+func ClientRetryClassifier(classifier jktrans.RetryClassifier) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.RetryClassifier = classifier
+	}
+}
+
+// 开启action的对冲请求，请求在delayMS毫秒内没有返回时向另一个实例再发送一次，先返回的结果生效，
+// delayMS<=0 时使用该action最近请求延迟的p95；只适合只读(幂等)的action
+func ClientHedgeAction(action string, delayMS int) ClientOption {
+	return func(cfg *ClientConfig) {
+		if nil == cfg.HedgeActions {
+			cfg.HedgeActions = map[string]int{}
+		}
+		cfg.HedgeActions[action] = delayMS
+	}
+}
+
+// 熔断配置，见 breaker.Config
+func ClientBreaker(breakerCfg breaker.Config) ClientOption {
+	return func(cfg *ClientConfig) {
+		if nil == breakerCfg.IsFailure {
+			breakerCfg.IsFailure = cfg.Breaker.IsFailure
+		}
+		cfg.Breaker = breakerCfg
+	}
+}
+
+// 熔断的失败判断，不设置时使用客户端默认的判断(业务错误不计为失败)
+func ClientBreakerClassifier(isFailure breaker.Classifier) ClientOption {
+	return func(cfg *ClientConfig) {
+		cfg.Breaker.IsFailure = isFailure
+	}
+}
+
 func ClientConfigFile(cfgPath string) ClientOption {
 	return func(cfg *ClientConfig) {
 
@@ -304,3 +451,25 @@ func ClientConfigFile(cfgPath string) ClientOption {
 		jkutils.ReadConfigFile(cfg.ConfigPath, &config)
 	}
 }
+
+// 格式：action1:delayMS,action2:delayMS，不设置delayMS时使用p95
+func getEnvHedgeActions(key string) map[string]int {
+
+	hedgeActions := map[string]int{}
+
+	for _, item := range jkos.GetEnvStrings(key, ",", nil) {
+		kv := strings.SplitN(strings.TrimSpace(item), ":", 2)
+		if "" == kv[0] {
+			continue
+		}
+
+		delayMS := 0
+		if 2 == len(kv) {
+			delayMS, _ = strconv.Atoi(strings.TrimSpace(kv[1]))
+		}
+
+		hedgeActions[kv[0]] = delayMS
+	}
+
+	return hedgeActions
+}
@@ -1,15 +1,26 @@
 package rpc
 
 import (
+	"context"
 	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/go-kit/kit/endpoint"
 
 	jkregistry "github.com/jkprj/jkfr/gokit/registry"
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
 	jkendpoint "github.com/jkprj/jkfr/gokit/transport/endpoint"
+	jkutils "github.com/jkprj/jkfr/gokit/utils"
 	jklog "github.com/jkprj/jkfr/log"
 )
 
+var ErrServerClosed = errors.New("rpc: Server closed")
+
 type EndpointsWrapInterface interface {
 	WrapAllLabeledExcept(middleware func(string, endpoint.Endpoint) endpoint.Endpoint, excluded ...string)
 }
@@ -61,37 +72,162 @@ func RunTLSHttpServer(name string, service interface{}, ops ...ServerOption) err
 
 func runServer(name string, service interface{}, ops ...ServerOption) error {
 
+	server, err := NewRPCServer(name, service, ops...)
+	if nil != err {
+		return err
+	}
+
+	return server.Run()
+}
+
+// rpc服务句柄，用于启动和优雅关闭服务
+type RPCServer struct {
+	name string
+	cfg  *ServerConfig
+
+	server   *Server
+	listener net.Listener
+	registry *jkregistry.Registrar
+
+	shutdown     int32
+	shutdownDone chan struct{}
+	shutdownErr  error
+}
+
+// 创建rpc服务，创建监听并注册服务，调用 Serve 或 Run 后开始处理请求
+func NewRPCServer(name string, service interface{}, ops ...ServerOption) (rpcServer *RPCServer, err error) {
+
 	cfg := newServerConfig(name, ops...)
 
-	err := WrapEnpoint(service, cfg.ActionMiddlewares)
+	err = WrapEnpoint(service, cfg.ActionMiddlewares)
 	if nil != err {
-		return err
+		return nil, err
+	}
+
+	server := NewServer(cfg.Codec)
+	server.compress = jkcompress.NewOptions(cfg.Compress, cfg.CompressMinSize, cfg.CompressMaxSize, cfg.PrometheusNameSpace, jkutils.ROLE_SERVER, name)
+	if cfg.RpcName == "" {
+		err = server.Register(service)
+	} else {
+		err = server.RegisterName(cfg.RpcName, service)
+	}
+	if nil != err {
+		return nil, err
 	}
 
 	listener, err := cfg.ListenerFatory(cfg)
 	if nil != err {
-		return err
+		return nil, err
 	}
-	defer listener.Close()
 
 	registry, err := jkregistry.RegistryServerWithServerAddr(name, cfg.ServerAddr, cfg.RegOps...)
 	if nil != err {
 		jklog.Errorw("RegistryServer fail", "ServerAddr", cfg.ServerAddr, "name", name, "err", err)
-		return err
+		listener.Close()
+		return nil, err
 	}
-	defer registry.Deregister()
 
-	server := NewServer(cfg.Codec)
-	if cfg.RpcName == "" {
-		err = server.Register(service)
-	} else {
-		err = server.RegisterName(cfg.RpcName, service)
+	rpcServer = &RPCServer{
+		name:         name,
+		cfg:          cfg,
+		server:       server,
+		listener:     listener,
+		registry:     registry,
+		shutdownDone: make(chan struct{}),
 	}
+
+	return rpcServer, nil
+}
+
+// 服务监听地址
+func (s *RPCServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// 处理请求，直到出错或调用 Shutdown，调用 Shutdown 后返回 ErrServerClosed
+func (s *RPCServer) Serve() error {
+
+	err := s.cfg.ServerRun(s.listener, s.server, s.cfg)
+	if s.isShutdown() {
+		return ErrServerClosed
+	}
+
 	if nil != err {
-		return err
+		s.registry.Deregister()
+		s.listener.Close()
+	}
+
+	return err
+}
+
+// 处理请求，收到SIGINT/SIGTERM时优雅关闭服务，关闭完成后返回
+func (s *RPCServer) Run() error {
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	// Serve出错返回时shutdownDone不会关闭，Run返回时结束信号处理
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case sig := <-sigChan:
+			jklog.Infow("rpc server receive signal, shutdown", "name", s.name, "signal", sig.String())
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.ShutdownTimeOut)*time.Second)
+			defer cancel()
+
+			s.Shutdown(ctx)
+		case <-done:
+		}
+	}()
+
+	err := s.Serve()
+	if ErrServerClosed == err {
+		<-s.shutdownDone
+		return s.shutdownErr
 	}
 
-	return cfg.ServerRun(listener, server, cfg)
+	return err
+}
+
+// 优雅关闭服务，依次：从注册中心注销，等待客户端感知，停止接收新连接，
+// 等待正在处理的请求完成(直到ctx超时)，关闭所有连接
+func (s *RPCServer) Shutdown(ctx context.Context) error {
+
+	if !atomic.CompareAndSwapInt32(&s.shutdown, 0, 1) {
+		<-s.shutdownDone
+		return s.shutdownErr
+	}
+	defer close(s.shutdownDone)
+
+	err := s.registry.Deregister()
+	if nil != err {
+		jklog.Errorw("Deregister fail", "name", s.name, "ServerAddr", s.cfg.ServerAddr, "err", err)
+	}
+
+	// 等待客户端的负载均衡感知服务已注销
+	if 0 < s.cfg.ShutdownWait {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(s.cfg.ShutdownWait) * time.Second):
+		}
+	}
+
+	s.server.beginShutdown()
+	s.listener.Close()
+
+	s.shutdownErr = s.server.Shutdown(ctx)
+
+	jklog.Infow("rpc server shutdown", "name", s.name, "ServerAddr", s.cfg.ServerAddr, "err", s.shutdownErr)
+
+	return s.shutdownErr
+}
+
+func (s *RPCServer) isShutdown() bool {
+	return 1 == atomic.LoadInt32(&s.shutdown)
 }
 
 func WrapEnpoint(service interface{}, actionMiddlewares []jkendpoint.ActionMiddleware) error {
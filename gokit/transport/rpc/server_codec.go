@@ -0,0 +1,37 @@
+package rpc
+
+import (
+	"io"
+	"net/rpc"
+)
+
+// 统计正在处理的请求，服务关闭时不再读取新的请求
+type trackCodec struct {
+	rpc.ServerCodec
+	server *Server
+}
+
+func (tc *trackCodec) ReadRequestHeader(r *rpc.Request) error {
+
+	if tc.server.shuttingDown() {
+		return io.EOF
+	}
+
+	err := tc.ServerCodec.ReadRequestHeader(r)
+	if nil != err {
+		if tc.server.shuttingDown() {
+			return io.EOF
+		}
+		return err
+	}
+
+	// 读取头部成功后，net/rpc 必然会调用一次 WriteResponse
+	tc.server.addInflight(1)
+
+	return nil
+}
+
+func (tc *trackCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	defer tc.server.addInflight(-1)
+	return tc.ServerCodec.WriteResponse(r, body)
+}
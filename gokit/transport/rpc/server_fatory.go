@@ -3,9 +3,7 @@ package rpc
 import (
 	"net"
 	"net/http"
-	"net/rpc/jsonrpc"
 
-	jkutils "github.com/jkprj/jkfr/gokit/utils"
 	jktls "github.com/jkprj/jkfr/gokit/utils/tls"
 	jklog "github.com/jkprj/jkfr/log"
 )
@@ -26,24 +24,20 @@ func RunServerWithTcp(listener net.Listener, server *Server, cfg *ServerConfig)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			jklog.Errorw("rpc.Serve accept fail", "err", err.Error())
+			if !server.shuttingDown() {
+				jklog.Errorw("rpc.Serve accept fail", "err", err.Error())
+			}
 			return err
 		}
 
-		go func() {
-			if jkutils.CODEC_JSON == cfg.Codec {
-				server.ServeCodec(jsonrpc.NewServerCodec(conn))
-			} else {
-				server.ServeConn(conn)
-			}
-		}()
+		go server.ServeConn(conn)
 	}
 }
 
 func RunServerWithHttp(listener net.Listener, server *Server, cfg *ServerConfig) error {
 	server.HandleHTTP(cfg.RpcPath, cfg.RpcDebugPath)
 	err := http.Serve(listener, server)
-	if nil != err {
+	if nil != err && !server.shuttingDown() {
 		jklog.Errorw("RunHttpServer fail", "err", err)
 		return err
 	}
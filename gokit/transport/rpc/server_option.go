@@ -4,6 +4,7 @@ import (
 	"net/rpc"
 
 	jkregistry "github.com/jkprj/jkfr/gokit/registry"
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
 	jkendpoint "github.com/jkprj/jkfr/gokit/transport/endpoint"
 	jkutils "github.com/jkprj/jkfr/gokit/utils"
 	jklog "github.com/jkprj/jkfr/log"
@@ -26,6 +27,11 @@ type ServerConfig struct {
 	RpcDebugPath        string     `json:"RpcDebugPath" toml:"RpcDebugPath"`
 	RpcName             string     `json:"RpcName" toml:"RpcName"`
 	Codec               string     `json:"Codec" toml:"Codec"`
+	Compress            string     `json:"Compress" toml:"Compress"`               // 负载压缩算法，为空不压缩，客户端也开启压缩时才会压缩
+	CompressMinSize     int        `json:"CompressMinSize" toml:"CompressMinSize"` // 参数编码后不小于该大小(字节)时才压缩
+	CompressMaxSize     int        `json:"CompressMaxSize" toml:"CompressMaxSize"` // 请求解压后的最大大小(字节)，超过时返回错误
+	ShutdownWait        int        `json:"ShutdownWait" toml:"ShutdownWait"`       // 关闭服务时，注销后等待客户端感知的时间(秒)
+	ShutdownTimeOut     int        `json:"ShutdownTimeOut" toml:"ShutdownTimeOut"` // 收到退出信号时，等待正在处理的请求完成的超时时间(秒)
 
 	ServerPem []byte `json:"-" toml:"-"`
 	ServerKey []byte `json:"-" toml:"-"`
@@ -57,8 +63,13 @@ func defaultServerConfig(name string) *ServerConfig {
 	cfg.RpcPath = jkos.GetEnvString("S_RPC_PATH", rpc.DefaultRPCPath)
 	cfg.RpcName = jkos.GetEnvString("S_RPC_NAME", "")
 	cfg.Codec = jkos.GetEnvString("S_CODEC", jkutils.CODEC_GOB)
+	cfg.Compress = jkos.GetEnvString("S_COMPRESS", "")
+	cfg.CompressMinSize = jkos.GetEnvInt("S_COMPRESS_MIN_SIZE", jkcompress.DEFAULT_MIN_SIZE)
+	cfg.CompressMaxSize = jkos.GetEnvInt("S_COMPRESS_MAX_SIZE", jkcompress.DEFAULT_MAX_SIZE)
 	cfg.RpcDebugPath = jkos.GetEnvString("S_RPC_DEBUG_PATH", rpc.DefaultDebugPath)
 	cfg.RateLimit = rate.Limit(jkos.GetEnvInt("S_RATE_LIMIT", 0))
+	cfg.ShutdownWait = jkos.GetEnvInt("S_SHUTDOWN_WAIT", 3)
+	cfg.ShutdownTimeOut = jkos.GetEnvInt("S_SHUTDOWN_TIMEOUT", 30)
 
 	cfg.ServerPemFile = jkos.GetEnvString("S_PEM_FILE", "")
 	ServerPemFile(cfg.ServerPemFile)(cfg)
@@ -243,6 +254,41 @@ func ServerCodec(codec string) ServerOption {
 	}
 }
 
+// 负载压缩算法(如 gzip)，客户端也开启压缩时按连接协商压缩
+func ServerCompress(compress string) ServerOption {
+	return func(cfg *ServerConfig) {
+		cfg.Compress = compress
+	}
+}
+
+// 参数编码后不小于该大小(字节)时才压缩
+func ServerCompressMinSize(size int) ServerOption {
+	return func(cfg *ServerConfig) {
+		cfg.CompressMinSize = size
+	}
+}
+
+// 请求解压后的最大大小(字节)，防止对端发送解压后超大的数据
+func ServerCompressMaxSize(size int) ServerOption {
+	return func(cfg *ServerConfig) {
+		cfg.CompressMaxSize = size
+	}
+}
+
+// 关闭服务时，注销后等待客户端感知的时间(秒)
+func ServerShutdownWait(wait int) ServerOption {
+	return func(cfg *ServerConfig) {
+		cfg.ShutdownWait = wait
+	}
+}
+
+// 收到退出信号时，等待正在处理的请求完成的超时时间(秒)
+func ServerShutdownTimeOut(timeout int) ServerOption {
+	return func(cfg *ServerConfig) {
+		cfg.ShutdownTimeOut = timeout
+	}
+}
+
 func ServerConfigFile(cfgPath string) ServerOption {
 	return func(cfg *ServerConfig) {
 		cfg.ConfigPath = cfgPath
@@ -1,28 +1,58 @@
 package rpc
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"net/rpc"
-	"net/rpc/jsonrpc"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	jkutils "github.com/jkprj/jkfr/gokit/utils"
+	jkcompress "github.com/jkprj/jkfr/gokit/transport/compress"
+	rpcpool "github.com/jkprj/jkfr/gokit/transport/pool/rpc"
 	jklog "github.com/jkprj/jkfr/log"
 )
 
 type Server struct {
 	rpc.Server
-	codec string
+	codec    string
+	compress *jkcompress.Options // 负载压缩，为nil时不压缩
+
+	inflight int64 // 正在处理的请求数
+	shutdown int32 // 是否正在关闭
+
+	conns  map[io.ReadWriteCloser]struct{}
+	mtConn sync.Mutex
+}
+
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
 }
 
 func NewServer(codec string) *Server {
 
 	s := new(Server)
 	s.codec = codec
+	s.conns = map[io.ReadWriteCloser]struct{}{}
 
 	return s
 }
 
+// 重写 rpc.Server 的 ServeConn，根据codec选择编解码(支持客户端发送的元数据)，并记录连接和正在处理的请求，用于优雅关闭
+func (s *Server) ServeConn(conn io.ReadWriteCloser) {
+
+	if !s.trackConn(conn, true) {
+		conn.Close()
+		return
+	}
+	defer s.trackConn(conn, false)
+
+	codec := rpcpool.NewServerCodecCompress(conn, s.codec, s.compress)
+
+	s.Server.ServeCodec(&trackCodec{ServerCodec: codec, server: s})
+}
+
 // 重写 rpc.Server 的 ServeHTTP
 func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
@@ -39,9 +69,78 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	io.WriteString(conn, "HTTP/1.0 "+connected+"\n\n")
 
-	if jkutils.CODEC_JSON == s.codec {
-		s.ServeCodec(jsonrpc.NewServerCodec(conn))
+	s.ServeConn(conn)
+}
+
+// 优雅关闭：不再读取新的请求，等待正在处理的请求完成后关闭所有连接，
+// ctx超时则直接关闭所有连接并返回ctx.Err()，监听由调用者关闭
+func (s *Server) Shutdown(ctx context.Context) (err error) {
+
+	s.beginShutdown()
+
+	// 唤醒阻塞在读取请求的连接，使其退出读取
+	s.mtConn.Lock()
+	for conn := range s.conns {
+		if dl, ok := conn.(readDeadliner); ok {
+			dl.SetReadDeadline(time.Now())
+		}
+	}
+	s.mtConn.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for 0 < atomic.LoadInt64(&s.inflight) {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			jklog.Warnw("rpc server shutdown timeout", "inflight", atomic.LoadInt64(&s.inflight), "err", err)
+			s.closeConns()
+			return err
+		case <-ticker.C:
+		}
+	}
+
+	s.closeConns()
+
+	return nil
+}
+
+func (s *Server) beginShutdown() {
+	atomic.StoreInt32(&s.shutdown, 1)
+}
+
+func (s *Server) shuttingDown() bool {
+	return 1 == atomic.LoadInt32(&s.shutdown)
+}
+
+func (s *Server) addInflight(delta int64) {
+	atomic.AddInt64(&s.inflight, delta)
+}
+
+// 添加/删除连接记录，服务正在关闭时添加失败
+func (s *Server) trackConn(conn io.ReadWriteCloser, add bool) bool {
+	s.mtConn.Lock()
+	defer s.mtConn.Unlock()
+
+	if add {
+		if s.shuttingDown() {
+			return false
+		}
+		s.conns[conn] = struct{}{}
 	} else {
-		s.ServeConn(conn)
+		delete(s.conns, conn)
+	}
+
+	return true
+}
+
+func (s *Server) closeConns() {
+	s.mtConn.Lock()
+	defer s.mtConn.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
 	}
 }
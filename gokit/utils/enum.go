@@ -4,6 +4,10 @@ const (
 	STRATEGY_ROUND  = "round"
 	STRATEGY_RANDOM = "random"
 	STRATEGY_LEAST  = "least"
+
+	STRATEGY_P2C_EWMA        = "p2c_ewma" // 随机选两个实例，选 峰值EWMA延迟*正在处理请求数 较小的
+	STRATEGY_CONSISTENT_HASH = "hash"     // 一致性哈希，按调用的哈希key选择实例，没有key时随机选择
+	STRATEGY_WEIGHTED        = "weighted" // 平滑加权轮询，权重来自服务注册时的 Weights
 )
 
 const (
@@ -17,8 +21,9 @@ const (
 )
 
 const (
-	CODEC_GOB  = "gob"
-	CODEC_JSON = "json"
+	CODEC_GOB      = "gob"
+	CODEC_JSON     = "json"
+	CODEC_PROTOBUF = "protobuf" // 请求和响应参数需要是 gogo/protobuf 的 proto.Message
 )
 
 const (
@@ -0,0 +1,214 @@
+package lb
+
+import (
+	"context"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+
+	jksd "github.com/jkprj/jkfr/gokit/sd"
+	jkrand "github.com/jkprj/jkfr/gokit/utils/rand"
+
+	"github.com/go-kit/kit/endpoint"
+	glb "github.com/go-kit/kit/sd/lb"
+)
+
+var HASH_REPLICAS = 160 // 一致性哈希每个实例的虚拟节点数
+
+type hashKey struct{}
+
+// 设置本次调用的哈希key，一致性哈希策略下相同key的请求发送到同一个实例
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKey{}, key)
+}
+
+func HashKeyFromContext(ctx context.Context) (key string, ok bool) {
+	if nil == ctx {
+		return "", false
+	}
+
+	key, ok = ctx.Value(hashKey{}).(string)
+	return
+}
+
+// fnv-1a 加 splitmix64 的混淆，相近的字符串也能均匀分布
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
+
+type ringPoint struct {
+	hash  uint64
+	index int
+}
+
+// 一致性哈希环，节点增减时只有相邻区间的key会迁移
+type HashRing struct {
+	points []ringPoint
+	nodes  int
+}
+
+// Parameters :
+// nodes    节点名称，如服务地址，不同客户端使用相同的节点名称才能得到相同的结果
+// replicas 每个节点的虚拟节点数，<=0 时使用 HASH_REPLICAS
+func NewHashRing(nodes []string, replicas int) *HashRing {
+
+	if replicas <= 0 {
+		replicas = HASH_REPLICAS
+	}
+
+	r := &HashRing{points: make([]ringPoint, 0, len(nodes)*replicas), nodes: len(nodes)}
+	for index, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			r.points = append(r.points, ringPoint{hash: hashString(node + "#" + strconv.Itoa(i)), index: index})
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i].hash < r.points[j].hash
+	})
+
+	return r
+}
+
+// 返回key所属节点的下标，节点不可用时顺时针查找下一个可用节点，都不可用时返回key所属节点；没有节点时返回-1
+// Parameters :
+// key       哈希key
+// available 判断节点是否可用，为nil时都可用
+func (r *HashRing) Get(key string, available func(index int) bool) int {
+
+	if 0 == len(r.points) {
+		return -1
+	}
+
+	hash := hashString(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+
+	owner := r.points[start%len(r.points)].index
+	if nil == available {
+		return owner
+	}
+
+	tried := make(map[int]bool, r.nodes)
+	for i := 0; i < len(r.points) && len(tried) < r.nodes; i++ {
+		index := r.points[(start+i)%len(r.points)].index
+		if tried[index] {
+			continue
+		}
+		tried[index] = true
+
+		if available(index) {
+			return index
+		}
+	}
+
+	return owner
+}
+
+// Parameters :
+// s         服务发现的 Endpointer，需要能获取实例地址(如 jksd.DefaultEndpointer)，保证不同客户端的哈希结果一致
+// isFailure 失败判断，失败的实例冷却期间key会迁移到环上的下一个实例；为nil时除调用方取消外的错误都算失败
+func NewConsistentHashBalancer(s jksd.InstanceEndpointer, isFailure func(err error) bool) glb.Balancer {
+
+	if nil == isFailure {
+		isFailure = defaultFailureClassifier
+	}
+
+	return &consistentHash{s: s, isFailure: isFailure, stats: map[reflect.Value]*EWMAStat{}}
+}
+
+type consistentHash struct {
+	s         jksd.InstanceEndpointer
+	isFailure func(err error) bool
+
+	mt        sync.RWMutex
+	instances []string
+	ring      *HashRing
+	stats     map[reflect.Value]*EWMAStat
+}
+
+func (ch *consistentHash) getRing(instances []string, eps []endpoint.Endpoint) (*HashRing, []*EWMAStat) {
+
+	stats := make([]*EWMAStat, len(eps))
+
+	ch.mt.RLock()
+	if len(ch.instances) == len(instances) && (0 == len(instances) || &ch.instances[0] == &instances[0]) {
+		for i, ep := range eps {
+			stats[i] = ch.stats[reflect.ValueOf(ep)]
+		}
+		ring := ch.ring
+		ch.mt.RUnlock()
+		return ring, stats
+	}
+	ch.mt.RUnlock()
+
+	ch.mt.Lock()
+	defer ch.mt.Unlock()
+
+	newStats := make(map[reflect.Value]*EWMAStat, len(eps))
+	for i, ep := range eps {
+		key := reflect.ValueOf(ep)
+		st, ok := ch.stats[key]
+		if !ok {
+			st = new(EWMAStat)
+		}
+		newStats[key] = st
+		stats[i] = st
+	}
+
+	ch.stats = newStats
+	ch.instances = instances
+	ch.ring = NewHashRing(instances, 0)
+
+	return ch.ring, stats
+}
+
+// 返回的endpoint在调用时根据ctx中的哈希key选择实例，没有key时随机选择
+func (ch *consistentHash) Endpoint() (endpoint.Endpoint, error) {
+
+	instances, endpoints, err := ch.s.InstanceEndpoints()
+	if nil != err {
+		return nil, err
+	}
+
+	if len(endpoints) <= 0 {
+		return nil, glb.ErrNoEndpoints
+	}
+
+	ring, stats := ch.getRing(instances, endpoints)
+
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+
+		var index int
+
+		key, ok := HashKeyFromContext(ctx)
+		if ok {
+			index = ring.Get(key, func(i int) bool {
+				return !stats[i].Cooling()
+			})
+		} else {
+			index = jkrand.Intn(len(endpoints))
+		}
+
+		bg := stats[index].Start()
+
+		response, err = endpoints[index](ctx, request)
+
+		stats[index].Done(bg, nil != err && ch.isFailure(err))
+
+		return response, err
+	}, nil
+}
@@ -0,0 +1,136 @@
+package lb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+func testNodes(n int) []string {
+	nodes := []string{}
+	for i := 0; i < n; i++ {
+		nodes = append(nodes, fmt.Sprintf("10.0.0.%d:8080", i+1))
+	}
+	return nodes
+}
+
+// 每个key所属的节点名称
+func ringOwners(nodes []string, keys int) map[string]string {
+	ring := NewHashRing(nodes, 0)
+	owners := map[string]string{}
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		owners[key] = nodes[ring.Get(key, nil)]
+	}
+	return owners
+}
+
+func TestHashRingStable(t *testing.T) {
+
+	nodes := testNodes(10)
+	owners := ringOwners(nodes, 10000)
+
+	// 不同客户端得到的节点顺序不同，相同的key仍然属于同一个节点
+	reversed := []string{}
+	for i := len(nodes) - 1; i >= 0; i-- {
+		reversed = append(reversed, nodes[i])
+	}
+	for key, owner := range ringOwners(reversed, 10000) {
+		if owners[key] != owner {
+			t.Fatalf("key: %s, owner: %s, reversed owner: %s", key, owners[key], owner)
+		}
+	}
+
+	counts := map[string]int{}
+	for _, owner := range owners {
+		counts[owner]++
+	}
+	for _, node := range nodes {
+		if counts[node] < 500 || counts[node] > 1500 {
+			t.Fatalf("unbalanced ring: %v", counts)
+		}
+	}
+}
+
+func TestHashRingRemoveNode(t *testing.T) {
+
+	nodes := testNodes(10)
+	owners := ringOwners(nodes, 10000)
+
+	removed := nodes[3]
+	after := ringOwners(append(append([]string{}, nodes[:3]...), nodes[4:]...), 10000)
+
+	// 只有被删除节点的key迁移
+	moved := 0
+	for key, owner := range owners {
+		if owner == removed {
+			moved++
+			continue
+		}
+		if after[key] != owner {
+			t.Fatalf("key: %s moved from %s to %s", key, owner, after[key])
+		}
+	}
+
+	if moved > 1500 {
+		t.Fatalf("moved %d keys, want about 1/10", moved)
+	}
+}
+
+func TestHashRingUnavailable(t *testing.T) {
+
+	nodes := testNodes(10)
+	ring := NewHashRing(nodes, 0)
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("user-%d", i)
+		owner := ring.Get(key, nil)
+
+		// 所属节点不可用时迁移到其他节点，其他节点不可用不影响
+		if index := ring.Get(key, func(index int) bool { return index != owner }); index == owner || index < 0 {
+			t.Fatalf("key: %s, owner unavailable but got %d", key, index)
+		}
+		if index := ring.Get(key, func(index int) bool { return index == owner }); index != owner {
+			t.Fatalf("key: %s, owner: %d, got %d", key, owner, index)
+		}
+		if index := ring.Get(key, func(int) bool { return false }); index != owner {
+			t.Fatalf("key: %s, all unavailable, owner: %d, got %d", key, owner, index)
+		}
+	}
+}
+
+type fixedInstanceEndpointer struct {
+	instances []string
+	endpoints []endpoint.Endpoint
+}
+
+func (f *fixedInstanceEndpointer) Endpoints() ([]endpoint.Endpoint, error) {
+	return f.endpoints, nil
+}
+
+func (f *fixedInstanceEndpointer) InstanceEndpoints() ([]string, []endpoint.Endpoint, error) {
+	return f.instances, f.endpoints, nil
+}
+
+func TestConsistentHashBalancer(t *testing.T) {
+
+	s := &fixedInstanceEndpointer{instances: testNodes(5)}
+	for _, instance := range s.instances {
+		s.endpoints = append(s.endpoints, namedEndpoint(instance, 0, nil))
+	}
+
+	b := NewConsistentHashBalancer(s, nil)
+
+	for i := 0; i < 100; i++ {
+		ctx := WithHashKey(context.Background(), fmt.Sprintf("user-%d", i))
+
+		first := call(t, b, ctx)
+		for j := 0; j < 5; j++ {
+			if instance := call(t, b, ctx); first != instance {
+				t.Fatalf("key: user-%d, instance: %s, first: %s", i, instance, first)
+			}
+		}
+	}
+}
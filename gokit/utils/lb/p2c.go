@@ -0,0 +1,203 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jkrand "github.com/jkprj/jkfr/gokit/utils/rand"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	glb "github.com/go-kit/kit/sd/lb"
+)
+
+var (
+	P2C_EWMA_DECAY = 10 * time.Second // 延迟EWMA的衰减时间常数，实例空闲时延迟按该时间常数衰减
+	P2C_COOL_DOWN  = time.Second      // 实例请求失败后的冷却时间，冷却期间尽量不选择该实例
+)
+
+// 单个实例的负载统计：峰值EWMA延迟和正在处理的请求数
+type EWMAStat struct {
+	inflight int64
+
+	mt        sync.Mutex
+	ewma      float64 // 纳秒
+	stamp     time.Time
+	coolUntil time.Time
+}
+
+// 请求开始时调用，返回开始时间
+func (s *EWMAStat) Start() time.Time {
+	atomic.AddInt64(&s.inflight, 1)
+	return time.Now()
+}
+
+// 请求结束时调用，失败的请求不更新延迟，实例进入冷却
+func (s *EWMAStat) Done(start time.Time, failed bool) {
+
+	atomic.AddInt64(&s.inflight, -1)
+
+	now := time.Now()
+
+	s.mt.Lock()
+	defer s.mt.Unlock()
+
+	if failed {
+		s.coolUntil = now.Add(P2C_COOL_DOWN)
+		return
+	}
+
+	rtt := float64(now.Sub(start))
+
+	// 峰值EWMA：延迟变大时立即生效，变小时平滑衰减
+	if rtt > s.ewma {
+		s.ewma = rtt
+	} else {
+		w := math.Exp(-float64(now.Sub(s.stamp)) / float64(P2C_EWMA_DECAY))
+		s.ewma = s.ewma*w + rtt*(1-w)
+	}
+	s.stamp = now
+}
+
+// 是否在请求失败后的冷却中
+func (s *EWMAStat) Cooling() bool {
+	s.mt.Lock()
+	defer s.mt.Unlock()
+
+	return time.Now().Before(s.coolUntil)
+}
+
+// 负载评分，越小越好，冷却中的实例返回 math.MaxFloat64
+func (s *EWMAStat) Score() float64 {
+
+	now := time.Now()
+
+	s.mt.Lock()
+	if now.Before(s.coolUntil) {
+		s.mt.Unlock()
+		return math.MaxFloat64
+	}
+
+	// 空闲时间越长延迟衰减越多，避免延迟高峰过后的实例一直选不到
+	ewma := s.ewma * math.Exp(-float64(now.Sub(s.stamp))/float64(P2C_EWMA_DECAY))
+	s.mt.Unlock()
+
+	return (ewma + 1) * float64(atomic.LoadInt64(&s.inflight)+1)
+}
+
+// 从n个实例中随机选两个，返回评分较小的下标
+func P2CPick(n int, score func(index int) float64) int {
+
+	if n <= 1 {
+		return 0
+	}
+
+	i := jkrand.Intn(n)
+	j := jkrand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+
+	if score(j) < score(i) {
+		return j
+	}
+
+	return i
+}
+
+func defaultFailureClassifier(err error) bool {
+	return nil != err && !errors.Is(err, context.Canceled)
+}
+
+// Parameters :
+// s         服务发现的 Endpointer
+// isFailure 失败判断，失败的实例会冷却一段时间，业务错误不应该算作失败；为nil时除调用方取消外的错误都算失败
+func NewP2CEWMABalancer(s sd.Endpointer, isFailure func(err error) bool) glb.Balancer {
+
+	if nil == isFailure {
+		isFailure = defaultFailureClassifier
+	}
+
+	return &p2cEWMA{s: s, isFailure: isFailure, stats: map[reflect.Value]*EWMAStat{}}
+}
+
+type p2cEWMA struct {
+	s         sd.Endpointer
+	isFailure func(err error) bool
+
+	mt    sync.RWMutex
+	eps   []endpoint.Endpoint
+	stats map[reflect.Value]*EWMAStat
+}
+
+// Endpointer 每次实例变化都会生成新的endpoint列表，列表变化时才重建统计，保留仍然存在的实例的统计
+func (p *p2cEWMA) getStats(eps []endpoint.Endpoint) []*EWMAStat {
+
+	stats := make([]*EWMAStat, len(eps))
+
+	p.mt.RLock()
+	same := len(p.eps) == len(eps) && (0 == len(eps) || &p.eps[0] == &eps[0])
+	if same {
+		for i, ep := range eps {
+			stats[i] = p.stats[reflect.ValueOf(ep)]
+		}
+		p.mt.RUnlock()
+		return stats
+	}
+	p.mt.RUnlock()
+
+	p.mt.Lock()
+	defer p.mt.Unlock()
+
+	newStats := make(map[reflect.Value]*EWMAStat, len(eps))
+	for i, ep := range eps {
+		key := reflect.ValueOf(ep)
+		st, ok := p.stats[key]
+		if !ok {
+			st = new(EWMAStat)
+		}
+		newStats[key] = st
+		stats[i] = st
+	}
+
+	p.stats = newStats
+	p.eps = eps
+
+	return stats
+}
+
+func (p *p2cEWMA) Endpoint() (endpoint.Endpoint, error) {
+
+	endpoints, err := p.s.Endpoints()
+	if nil != err {
+		return nil, err
+	}
+
+	if len(endpoints) <= 0 {
+		return nil, glb.ErrNoEndpoints
+	}
+
+	stats := p.getStats(endpoints)
+
+	index := P2CPick(len(endpoints), func(i int) float64 {
+		return stats[i].Score()
+	})
+
+	ep, st := endpoints[index], stats[index]
+
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+
+		bg := st.Start()
+
+		response, err = ep(ctx, request)
+
+		st.Done(bg, nil != err && p.isFailure(err))
+
+		return response, err
+	}, nil
+}
@@ -0,0 +1,69 @@
+package lb
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	glb "github.com/go-kit/kit/sd/lb"
+)
+
+// 返回名称的endpoint，delay为处理时间，err不为nil时返回错误
+func namedEndpoint(name string, delay time.Duration, err error) endpoint.Endpoint {
+	return func(context.Context, interface{}) (interface{}, error) {
+		time.Sleep(delay)
+		return name, err
+	}
+}
+
+// 通过balancer调用一次，返回处理请求的endpoint名称
+func call(t *testing.T, b glb.Balancer, ctx context.Context) string {
+
+	ep, err := b.Endpoint()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	res, _ := ep(ctx, nil)
+	return res.(string)
+}
+
+func TestP2CPreferLowerEWMA(t *testing.T) {
+
+	b := NewP2CEWMABalancer(sd.FixedEndpointer{
+		namedEndpoint("fast0", 0, nil),
+		namedEndpoint("fast1", 0, nil),
+		namedEndpoint("slow", 20*time.Millisecond, nil),
+	}, nil)
+
+	counts := map[string]int{}
+	for i := 0; i < 60; i++ {
+		counts[call(t, b, context.Background())]++
+	}
+
+	// 没有请求过的实例评分最低，慢实例被选中一次后延迟EWMA变大，之后每次比较都输给快实例
+	if 1 < counts["slow"] {
+		t.Fatalf("slow endpoint picked %d times, counts: %v", counts["slow"], counts)
+	}
+}
+
+func TestP2CAvoidCooling(t *testing.T) {
+
+	b := NewP2CEWMABalancer(sd.FixedEndpointer{
+		namedEndpoint("ok", 0, nil),
+		namedEndpoint("fail", 0, errors.New("unavailable")),
+	}, nil)
+
+	counts := map[string]int{}
+	for i := 0; i < 20; i++ {
+		counts[call(t, b, context.Background())]++
+	}
+
+	// 失败后进入冷却，冷却期间不再选择
+	if 1 != counts["fail"] {
+		t.Fatalf("failed endpoint picked %d times, counts: %v", counts["fail"], counts)
+	}
+}
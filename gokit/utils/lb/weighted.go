@@ -0,0 +1,68 @@
+package lb
+
+import (
+	"sync"
+
+	jksd "github.com/jkprj/jkfr/gokit/sd"
+
+	"github.com/go-kit/kit/endpoint"
+	glb "github.com/go-kit/kit/sd/lb"
+)
+
+// 平滑加权轮询，权重来自服务实例注册时的 Weights(如 registry.WithWeight)，
+// 权重为2的实例获得权重为1的实例两倍的请求，并且请求交错分配，不会连续发送到同一个实例
+// Parameters :
+// s 服务发现的 Endpointer，需要能获取实例元数据(如 jksd.DefaultEndpointer)，获取不到权重时按1处理
+func NewWeightedBalancer(s jksd.MetaEndpointer) glb.Balancer {
+	return &weighted{s: s, current: map[string]int{}}
+}
+
+type weighted struct {
+	s jksd.MetaEndpointer
+
+	mt      sync.Mutex
+	current map[string]int // 每个实例的当前权重，key为实例地址
+}
+
+func (w *weighted) Endpoint() (endpoint.Endpoint, error) {
+
+	instances, err := w.s.Instances()
+	if nil != err {
+		return nil, err
+	}
+
+	if len(instances) <= 0 {
+		return nil, glb.ErrNoEndpoints
+	}
+
+	w.mt.Lock()
+	defer w.mt.Unlock()
+
+	// 实例变化后删除已经不存在的实例
+	if len(w.current) > len(instances) {
+		exists := make(map[string]int, len(instances))
+		for _, ins := range instances {
+			exists[ins.Instance] = w.current[ins.Instance]
+		}
+		w.current = exists
+	}
+
+	best, total := -1, 0
+	for i, ins := range instances {
+		weight := ins.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+
+		w.current[ins.Instance] += weight
+		total += weight
+
+		if best < 0 || w.current[ins.Instance] > w.current[instances[best].Instance] {
+			best = i
+		}
+	}
+
+	w.current[instances[best].Instance] -= total
+
+	return instances[best].Endpoint, nil
+}
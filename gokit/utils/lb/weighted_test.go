@@ -0,0 +1,70 @@
+package lb
+
+import (
+	"context"
+	"testing"
+
+	jksd "github.com/jkprj/jkfr/gokit/sd"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+type fixedMetaEndpointer []jksd.Instance
+
+func (f fixedMetaEndpointer) Endpoints() ([]endpoint.Endpoint, error) {
+	eps := []endpoint.Endpoint{}
+	for _, ins := range f {
+		eps = append(eps, ins.Endpoint)
+	}
+	return eps, nil
+}
+
+func (f fixedMetaEndpointer) Instances() ([]jksd.Instance, error) {
+	return f, nil
+}
+
+func weightedInstance(name string, weight int) jksd.Instance {
+	return jksd.Instance{Instance: name, InstanceMeta: jksd.InstanceMeta{Weight: weight}, Endpoint: namedEndpoint(name, 0, nil)}
+}
+
+func TestWeightedSmooth(t *testing.T) {
+
+	b := NewWeightedBalancer(fixedMetaEndpointer{weightedInstance("a", 2), weightedInstance("b", 1)})
+
+	picks := []string{}
+	for i := 0; i < 300; i++ {
+		picks = append(picks, call(t, b, context.Background()))
+	}
+
+	counts := map[string]int{}
+	for _, pick := range picks {
+		counts[pick]++
+	}
+	if 200 != counts["a"] || 100 != counts["b"] {
+		t.Fatalf("counts: %v, want a:200 b:100", counts)
+	}
+
+	// 平滑分配：按 a b a 循环，b 插在两次 a 之间，而不是 a a b
+	for i, pick := range picks {
+		if want := []string{"a", "b", "a"}[i%3]; want != pick {
+			t.Fatalf("not smooth at %d: %v", i, picks[:i+1])
+		}
+	}
+}
+
+func TestWeightedDefaultWeight(t *testing.T) {
+
+	// 没有权重的实例按1处理
+	b := NewWeightedBalancer(fixedMetaEndpointer{weightedInstance("a", 0), weightedInstance("b", -1), weightedInstance("c", 1)})
+
+	counts := map[string]int{}
+	for i := 0; i < 300; i++ {
+		counts[call(t, b, context.Background())]++
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		if 100 != counts[name] {
+			t.Fatalf("counts: %v, want 100 each", counts)
+		}
+	}
+}
@@ -54,6 +54,21 @@ func GetEnvInt(key string, def int) int {
 	return i
 }
 
+func GetEnvFloat(key string, def float64) float64 {
+
+	str := getenv(key)
+	if "" == str {
+		return def
+	}
+
+	f, err := strconv.ParseFloat(str, 64)
+	if nil != err {
+		return def
+	}
+
+	return f
+}
+
 func GetEnvInts(key string, sep string, def []int) []int {
 	strs := GetEnvStrings(key, sep, nil)
 	values := []int{}